@@ -0,0 +1,106 @@
+// Code generated by protoc-gen-go.
+// source: auth.proto
+// DO NOT EDIT!
+
+/*
+Package auth is a generated protocol buffer package.
+
+It is generated from these files:
+	auth.proto
+
+It has these top-level messages:
+	SessionRequest
+	SessionReply
+*/
+package auth
+
+import proto "github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/protobuf/proto"
+
+import (
+	context "github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	grpc "github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+
+type SessionRequest struct {
+	Token string `protobuf:"bytes,1,opt,name=token" json:"token,omitempty"`
+}
+
+func (m *SessionRequest) Reset()         { *m = SessionRequest{} }
+func (m *SessionRequest) String() string { return proto.CompactTextString(m) }
+func (*SessionRequest) ProtoMessage()    {}
+
+type SessionReply struct {
+	Valid  bool   `protobuf:"varint,1,opt,name=valid" json:"valid,omitempty"`
+	UserId string `protobuf:"bytes,2,opt,name=user_id" json:"user_id,omitempty"`
+}
+
+func (m *SessionReply) Reset()         { *m = SessionReply{} }
+func (m *SessionReply) String() string { return proto.CompactTextString(m) }
+func (*SessionReply) ProtoMessage()    {}
+
+func init() {
+}
+
+// Client API for Auth service
+
+type AuthClient interface {
+	ValidateSession(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*SessionReply, error)
+}
+
+type authClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAuthClient(cc *grpc.ClientConn) AuthClient {
+	return &authClient{cc}
+}
+
+func (c *authClient) ValidateSession(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*SessionReply, error) {
+	out := new(SessionReply)
+	err := grpc.Invoke(ctx, "/auth.Auth/ValidateSession", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Auth service
+
+type AuthServer interface {
+	ValidateSession(context.Context, *SessionRequest) (*SessionReply, error)
+}
+
+func RegisterAuthServer(s *grpc.Server, srv AuthServer) {
+	s.RegisterService(&_Auth_serviceDesc, srv)
+}
+
+func _Auth_ValidateSession_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(SessionRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(AuthServer).ValidateSession(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _Auth_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "auth.Auth",
+	HandlerType: (*AuthServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ValidateSession",
+			Handler:    _Auth_ValidateSession_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:generate protoc --go_out=plugins=grpc:. -I ../protos ../protos/auth.proto
+
+package auth
+
+import (
+	"errors"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrInvalidToken is returned if the session token is not valid.
+var ErrInvalidToken = errors.New("invalid session token")
+
+// Authenticator validates session tokens of connecting clients.
+type Authenticator interface {
+	// Authenticate returns the id of the user the session token belongs to.
+	// ErrInvalidToken is returned if the token is not valid. Any other error
+	// means the token could not be validated.
+	Authenticate(ctx context.Context, token string) (string, error)
+}
+
+var _ Authenticator = (*ServiceAuthenticator)(nil)
+
+// ServiceAuthenticator is an Authenticator that validates the session tokens
+// using the auth service.
+type ServiceAuthenticator struct {
+	Client AuthClient
+}
+
+// Authenticate implements the Authenticator interface.
+func (a *ServiceAuthenticator) Authenticate(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrInvalidToken
+	}
+	reply, err := a.Client.ValidateSession(ctx, &SessionRequest{
+		Token: token,
+	})
+	if err != nil {
+		return "", err
+	}
+	if !reply.Valid || reply.UserId == "" {
+		return "", ErrInvalidToken
+	}
+	return reply.UserId, nil
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package auth_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/auth"
+)
+
+type AuthClientMock struct {
+	OnValidateSession func(context.Context, *auth.SessionRequest) (*auth.SessionReply, error)
+}
+
+func (m *AuthClientMock) ValidateSession(ctx context.Context, req *auth.SessionRequest, opts ...grpc.CallOption) (*auth.SessionReply, error) {
+	return m.OnValidateSession(ctx, req)
+}
+
+func TestServiceAuthenticatorValidSession(t *testing.T) {
+	a := &auth.ServiceAuthenticator{
+		Client: &AuthClientMock{
+			OnValidateSession: func(ctx context.Context, req *auth.SessionRequest) (*auth.SessionReply, error) {
+				if req.Token != "token1" {
+					t.Errorf("Unexpected token: %s", req.Token)
+				}
+				return &auth.SessionReply{Valid: true, UserId: "user1"}, nil
+			},
+		},
+	}
+	userID, err := a.Authenticate(context.Background(), "token1")
+	if err != nil {
+		t.Fatalf("Valid session should be accepted but got: %s", err)
+	}
+	if userID != "user1" {
+		t.Errorf("Unexpected user id: %s", userID)
+	}
+}
+
+func TestServiceAuthenticatorInvalidSession(t *testing.T) {
+	a := &auth.ServiceAuthenticator{
+		Client: &AuthClientMock{
+			OnValidateSession: func(ctx context.Context, req *auth.SessionRequest) (*auth.SessionReply, error) {
+				return &auth.SessionReply{}, nil
+			},
+		},
+	}
+	if _, err := a.Authenticate(context.Background(), "token1"); err != auth.ErrInvalidToken {
+		t.Errorf("Invalid session should be rejected but got: %v", err)
+	}
+}
+
+func TestServiceAuthenticatorError(t *testing.T) {
+	a := &auth.ServiceAuthenticator{
+		Client: &AuthClientMock{
+			OnValidateSession: func(ctx context.Context, req *auth.SessionRequest) (*auth.SessionReply, error) {
+				return nil, errors.New("error")
+			},
+		},
+	}
+	if _, err := a.Authenticate(context.Background(), "token1"); err == nil || err == auth.ErrInvalidToken {
+		t.Errorf("Service error should be returned but got: %v", err)
+	}
+}
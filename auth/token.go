@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var _ Authenticator = (*TokenVerifier)(nil)
+
+// TokenVerifier is an Authenticator that verifies JSON Web Tokens signed with
+// HMAC SHA-256 locally without calling any service. The user id is taken from
+// the subject claim. Tokens without an expiration time are rejected.
+type TokenVerifier struct {
+	Secret []byte
+
+	// Now returns the current time. If not set time.Now is used.
+	Now func() time.Time
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+}
+
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+// Authenticate implements the Authenticator interface.
+func (v *TokenVerifier) Authenticate(ctx context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", ErrInvalidToken
+	}
+
+	signature, err := base64.URLEncoding.DecodeString(padSegment(parts[2]))
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, v.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", ErrInvalidToken
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", ErrInvalidToken
+	}
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	t := now().Unix()
+	if claims.ExpiresAt == 0 || t >= claims.ExpiresAt || t < claims.NotBefore {
+		return "", ErrInvalidToken
+	}
+	if claims.Subject == "" {
+		return "", ErrInvalidToken
+	}
+	return claims.Subject, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON token segment.
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.URLEncoding.DecodeString(padSegment(seg))
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// padSegment adds the base64 padding stripped from token segments.
+func padSegment(seg string) string {
+	if l := len(seg) % 4; l > 0 {
+		seg += strings.Repeat("=", 4-l)
+	}
+	return seg
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package auth_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/auth"
+)
+
+func encodeSegment(s string) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString([]byte(s)), "=")
+}
+
+func signToken(secret, header, claims string) string {
+	unsigned := encodeSegment(header) + "." + encodeSegment(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + strings.TrimRight(base64.URLEncoding.EncodeToString(mac.Sum(nil)), "=")
+}
+
+func newVerifier() *auth.TokenVerifier {
+	return &auth.TokenVerifier{
+		Secret: []byte("secret"),
+		Now: func() time.Time {
+			return time.Unix(1000, 0)
+		},
+	}
+}
+
+func TestTokenVerifierValidToken(t *testing.T) {
+	token := signToken("secret", `{"alg":"HS256","typ":"JWT"}`, `{"sub":"user1","exp":2000}`)
+	userID, err := newVerifier().Authenticate(context.Background(), token)
+	if err != nil {
+		t.Fatalf("Valid token should be accepted but got: %s", err)
+	}
+	if userID != "user1" {
+		t.Errorf("Unexpected user id: %s", userID)
+	}
+}
+
+func TestTokenVerifierInvalidTokens(t *testing.T) {
+	tokens := map[string]string{
+		"malformed":     "abc",
+		"bad signature": signToken("other", `{"alg":"HS256"}`, `{"sub":"user1","exp":2000}`),
+		"alg none":      encodeSegment(`{"alg":"none"}`) + "." + encodeSegment(`{"sub":"user1","exp":2000}`) + ".",
+		"expired":       signToken("secret", `{"alg":"HS256"}`, `{"sub":"user1","exp":1000}`),
+		"no expiration": signToken("secret", `{"alg":"HS256"}`, `{"sub":"user1"}`),
+		"not yet valid": signToken("secret", `{"alg":"HS256"}`, `{"sub":"user1","exp":2000,"nbf":1500}`),
+		"no subject":    signToken("secret", `{"alg":"HS256"}`, `{"exp":2000}`),
+	}
+	for name, token := range tokens {
+		if _, err := newVerifier().Authenticate(context.Background(), token); err != auth.ErrInvalidToken {
+			t.Errorf("Token (%s) should be rejected but got: %v", name, err)
+		}
+	}
+}
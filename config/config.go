@@ -0,0 +1,552 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package config loads the gateway configuration from flags, environment
+// variables and an optional config file.
+//
+// Every setting is a flag. A flag that is not set on the command line is
+// taken from the environment variable SOCKET_<NAME>, where NAME is the upper
+// cased flag name, and then from the config file. The config file holds one
+// "name = value" pair per line and lines starting with # are ignored.
+package config
+
+import (
+	"bufio"
+	"compress/flate"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/protogalaxy/service-socket/ratelimit"
+	"github.com/protogalaxy/service-socket/socket"
+	"github.com/protogalaxy/service-socket/websocket"
+)
+
+// EnvPrefix is the prefix of the environment variables holding the settings.
+const EnvPrefix = "SOCKET_"
+
+type Config struct {
+	File string
+
+	WebsocketAddr string
+	GRPCAddr      string
+	AdminAddr     string
+	PresenceAddr  string
+	BrokerAddr    string
+	AuthAddr      string
+	AuthSecret    string
+	GatewayID     string
+	Environment   string
+
+	RegistryShards int
+	QueueSize      int
+
+	OverflowPolicy     string
+	OverflowTimeout    time.Duration
+	OverflowCloseCode  int
+	MaxOverflowTimeout time.Duration
+
+	BatchSize   int
+	BatchLinger time.Duration
+
+	MaxMessageSize int64
+	MaxFrameSize   int64
+	Subprotocols   string
+	AllowedOrigins string
+
+	ClientTopics           string
+	MaxClientSubscriptions int
+
+	ConnMessageRate  float64
+	ConnMessageBurst float64
+	ConnByteRate     float64
+	ConnByteBurst    float64
+	UserMessageRate  float64
+	UserMessageBurst float64
+	UserByteRate     float64
+	UserByteBurst    float64
+	RateLimitAction  string
+
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	IdleTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	Compression                        bool
+	CompressionLevel                   int
+	CompressionThreshold               int
+	CompressionServerNoContextTakeover bool
+	CompressionClientNoContextTakeover bool
+
+	RouteConcurrency int
+	RouteOrdered     bool
+
+	BrokerStreams      int
+	BrokerStreamWindow int
+
+	LeaseInterval   time.Duration
+	AuthTimeout     time.Duration
+	PresenceTimeout time.Duration
+	RouteTimeout    time.Duration
+	HealthTimeout   time.Duration
+	ReportInterval  time.Duration
+
+	RetryAttempts      int
+	RetryBaseDelay     time.Duration
+	RetryMaxDelay      time.Duration
+	BreakerFailures    int
+	BreakerOpenTimeout time.Duration
+
+	ShutdownTimeout time.Duration
+	ReconnectDelay  time.Duration
+}
+
+// Default returns the configuration used when nothing is overridden.
+func Default() Config {
+	return Config{
+		WebsocketAddr:  ":8080",
+		GRPCAddr:       ":9090",
+		AdminAddr:      ":9100",
+		PresenceAddr:   "localhost:9091",
+		BrokerAddr:     "localhost:9092",
+		AuthAddr:       "localhost:9093",
+		RegistryShards: 1,
+		QueueSize:      10,
+
+		OverflowPolicy:     "drop_newest",
+		OverflowTimeout:    100 * time.Millisecond,
+		OverflowCloseCode:  4008,
+		MaxOverflowTimeout: socket.DefaultMaxOverflowTimeout,
+
+		BatchSize: 16 * 1024,
+
+		MaxMessageSize: 1 << 20,
+		MaxFrameSize:   1 << 20,
+
+		MaxClientSubscriptions: 32,
+
+		ConnMessageRate:  100,
+		ConnMessageBurst: 200,
+		ConnByteRate:     1 << 20,
+		ConnByteBurst:    2 << 20,
+		UserMessageRate:  300,
+		UserMessageBurst: 600,
+		UserByteRate:     3 << 20,
+		UserByteBurst:    6 << 20,
+		RateLimitAction:  "throttle",
+
+		PingInterval: 30 * time.Second,
+		PongTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+
+		CompressionLevel:     flate.BestSpeed,
+		CompressionThreshold: 256,
+
+		RouteConcurrency: 4,
+
+		BrokerStreams:      4,
+		BrokerStreamWindow: 256,
+
+		LeaseInterval:   30 * time.Second,
+		AuthTimeout:     5 * time.Second,
+		PresenceTimeout: 2 * time.Second,
+		RouteTimeout:    5 * time.Second,
+		HealthTimeout:   time.Second,
+		ReportInterval:  time.Second,
+
+		RetryAttempts:      3,
+		RetryBaseDelay:     50 * time.Millisecond,
+		RetryMaxDelay:      time.Second,
+		BreakerFailures:    5,
+		BreakerOpenTimeout: 10 * time.Second,
+
+		ShutdownTimeout: 30 * time.Second,
+		ReconnectDelay:  10 * time.Second,
+	}
+}
+
+// RegisterFlags defines a flag for every setting using the current values
+// as the defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.File, "config", c.File, "path of an optional config file")
+	fs.StringVar(&c.WebsocketAddr, "ws_addr", c.WebsocketAddr, "listen address of the websocket server")
+	fs.StringVar(&c.GRPCAddr, "grpc_addr", c.GRPCAddr, "listen address of the gRPC server")
+	fs.StringVar(&c.AdminAddr, "admin_addr", c.AdminAddr, "listen address of the metrics and health endpoints, disabled if empty")
+	fs.StringVar(&c.PresenceAddr, "presence_addr", c.PresenceAddr, "address of the device presence service")
+	fs.StringVar(&c.BrokerAddr, "broker_addr", c.BrokerAddr, "address of the message broker service")
+	fs.StringVar(&c.AuthAddr, "auth_addr", c.AuthAddr, "address of the auth service")
+	fs.StringVar(&c.AuthSecret, "auth_secret", c.AuthSecret, "HMAC secret for verifying session tokens locally instead of using the auth service")
+	fs.StringVar(&c.GatewayID, "gateway_id", c.GatewayID, "unique id of the gateway instance, generated if not set")
+	fs.StringVar(&c.Environment, "environment", c.Environment, "name of the deployment environment selecting the environment specific overrides")
+	fs.IntVar(&c.RegistryShards, "registry_shards", c.RegistryShards, "number of independent socket registry event loops")
+	fs.IntVar(&c.QueueSize, "queue_size", c.QueueSize, "number of outgoing messages of every priority class buffered for a socket")
+	fs.StringVar(&c.OverflowPolicy, "overflow_policy", c.OverflowPolicy, "handling of messages routed to a full socket queue: drop_newest, drop_oldest, coalesce, block or disconnect")
+	fs.DurationVar(&c.OverflowTimeout, "overflow_timeout", c.OverflowTimeout, "time the default block overflow policy waits for room in a socket queue")
+	fs.IntVar(&c.OverflowCloseCode, "overflow_close_code", c.OverflowCloseCode, "close code sent to clients disconnected by the disconnect overflow policy")
+	fs.DurationVar(&c.MaxOverflowTimeout, "max_overflow_timeout", c.MaxOverflowTimeout, "maximum time a block overflow policy requested by a caller waits for room in a socket queue while holding up the registry")
+	fs.IntVar(&c.BatchSize, "batch_size", c.BatchSize, "maximum size in bytes of the batch frames written to clients that opted in to them")
+	fs.DurationVar(&c.BatchLinger, "batch_linger", c.BatchLinger, "maximum time to wait for more messages before writing a batch frame that is not full")
+	fs.Int64Var(&c.MaxMessageSize, "max_message_size", c.MaxMessageSize, "maximum size in bytes of the messages read from the websocket clients, 1MiB if 0")
+	fs.Int64Var(&c.MaxFrameSize, "max_frame_size", c.MaxFrameSize, "maximum size in bytes of the frames read from the websocket clients, 1MiB if 0")
+	fs.Float64Var(&c.ConnMessageRate, "conn_message_rate", c.ConnMessageRate, "inbound messages per second allowed per connection, unlimited if 0")
+	fs.Float64Var(&c.ConnMessageBurst, "conn_message_burst", c.ConnMessageBurst, "inbound messages a connection can send at once, conn_message_rate if 0")
+	fs.Float64Var(&c.ConnByteRate, "conn_byte_rate", c.ConnByteRate, "inbound bytes per second allowed per connection, unlimited if 0")
+	fs.Float64Var(&c.ConnByteBurst, "conn_byte_burst", c.ConnByteBurst, "inbound bytes a connection can send at once, conn_byte_rate if 0")
+	fs.Float64Var(&c.UserMessageRate, "user_message_rate", c.UserMessageRate, "inbound messages per second allowed for all the connections of a user, unlimited if 0")
+	fs.Float64Var(&c.UserMessageBurst, "user_message_burst", c.UserMessageBurst, "inbound messages the connections of a user can send at once, user_message_rate if 0")
+	fs.Float64Var(&c.UserByteRate, "user_byte_rate", c.UserByteRate, "inbound bytes per second allowed for all the connections of a user, unlimited if 0")
+	fs.Float64Var(&c.UserByteBurst, "user_byte_burst", c.UserByteBurst, "inbound bytes the connections of a user can send at once, user_byte_rate if 0")
+	fs.StringVar(&c.RateLimitAction, "rate_limit_action", c.RateLimitAction, "handling of inbound messages exceeding the rate limits: drop, throttle or close")
+	fs.StringVar(&c.AllowedOrigins, "allowed_origins", c.AllowedOrigins, "comma separated origins allowed to open websocket connections, *.domain matches subdomains; only the gateway's own origin if empty")
+	fs.StringVar(&c.ClientTopics, "client_topics", c.ClientTopics, "comma separated topics the websocket clients may subscribe to, a trailing * matches any suffix and {user} the client's user id; none if empty")
+	fs.IntVar(&c.MaxClientSubscriptions, "max_client_subscriptions", c.MaxClientSubscriptions, "maximum number of topics a websocket client can subscribe to, 32 if 0")
+	fs.StringVar(&c.Subprotocols, "subprotocols", c.Subprotocols, "comma separated websocket subprotocols supported in the order of preference")
+	fs.DurationVar(&c.PingInterval, "ping_interval", c.PingInterval, "interval of the pings sent to the websocket clients, disabled if 0")
+	fs.DurationVar(&c.PongTimeout, "pong_timeout", c.PongTimeout, "time a websocket client has to answer a ping before it is disconnected")
+	fs.DurationVar(&c.IdleTimeout, "idle_timeout", c.IdleTimeout, "time a websocket client can go without sending a message before it is disconnected, disabled if 0")
+	fs.DurationVar(&c.WriteTimeout, "write_timeout", c.WriteTimeout, "maximum time of a single write to a websocket client, unlimited if 0")
+	fs.BoolVar(&c.Compression, "compression", c.Compression, "enable permessage-deflate for the websocket clients that offer it")
+	fs.IntVar(&c.CompressionLevel, "compression_level", c.CompressionLevel, "flate compression level of the outgoing messages, from -1 (default) to 9")
+	fs.IntVar(&c.CompressionThreshold, "compression_threshold", c.CompressionThreshold, "minimum size in bytes of the outgoing messages that are compressed")
+	fs.BoolVar(&c.CompressionServerNoContextTakeover, "compression_server_no_context_takeover", c.CompressionServerNoContextTakeover, "compress every outgoing message on its own instead of reusing the state of the previous messages")
+	fs.BoolVar(&c.CompressionClientNoContextTakeover, "compression_client_no_context_takeover", c.CompressionClientNoContextTakeover, "ask the clients to compress every message on its own")
+	fs.IntVar(&c.RouteConcurrency, "route_concurrency", c.RouteConcurrency, "maximum number of inbound messages routed at once per socket")
+	fs.BoolVar(&c.RouteOrdered, "route_ordered", c.RouteOrdered, "route the inbound messages of a socket one at a time in order")
+	fs.IntVar(&c.BrokerStreams, "broker_streams", c.BrokerStreams, "number of streams routing the inbound messages to the broker, unary calls are used if 0")
+	fs.IntVar(&c.BrokerStreamWindow, "broker_stream_window", c.BrokerStreamWindow, "maximum number of unacknowledged messages per broker stream")
+	fs.DurationVar(&c.LeaseInterval, "presence_lease_interval", c.LeaseInterval, "interval of renewing the device presence leases, at least 1s")
+	fs.DurationVar(&c.AuthTimeout, "auth_timeout", c.AuthTimeout, "timeout of authenticating a client")
+	fs.DurationVar(&c.PresenceTimeout, "presence_timeout", c.PresenceTimeout, "timeout of setting a device status")
+	fs.DurationVar(&c.RouteTimeout, "route_timeout", c.RouteTimeout, "timeout of routing an inbound message to the broker")
+	fs.DurationVar(&c.HealthTimeout, "health_timeout", c.HealthTimeout, "timeout of the readiness checks")
+	fs.DurationVar(&c.ReportInterval, "report_interval", c.ReportInterval, "interval of the delivery reports sent over streaming send calls")
+	fs.IntVar(&c.RetryAttempts, "retry_attempts", c.RetryAttempts, "maximum number of attempts of idempotent downstream calls")
+	fs.DurationVar(&c.RetryBaseDelay, "retry_base_delay", c.RetryBaseDelay, "delay before the first retry of a downstream call, doubled with every retry")
+	fs.DurationVar(&c.RetryMaxDelay, "retry_max_delay", c.RetryMaxDelay, "maximum delay between retries of a downstream call")
+	fs.IntVar(&c.BreakerFailures, "breaker_failures", c.BreakerFailures, "consecutive failures that open the circuit breaker of a downstream")
+	fs.DurationVar(&c.BreakerOpenTimeout, "breaker_open_timeout", c.BreakerOpenTimeout, "time an open circuit breaker rejects calls before a trial call")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown_timeout", c.ShutdownTimeout, "maximum time for draining connections on shutdown")
+	fs.DurationVar(&c.ReconnectDelay, "reconnect_delay", c.ReconnectDelay, "maximum reconnect delay suggested to clients on shutdown")
+}
+
+// Load parses the command line arguments and fills in the flags that were
+// not set from the environment and the config file. Command line arguments
+// take precedence over the environment which takes precedence over the file.
+// The resulting configuration is validated.
+func (c *Config) Load(fs *flag.FlagSet, args []string, getenv func(string) string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	cmdline := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+		cmdline[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		if v := getenv(EnvName(f.Name)); v != "" {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid value %q for %s: %s", v, EnvName(f.Name), e)
+			}
+			set[f.Name] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.File != "" {
+		if err := c.loadFile(fs, set); err != nil {
+			return err
+		}
+	}
+	c.applyEnvironment(cmdline, getenv)
+	return c.Validate()
+}
+
+// applyEnvironment applies the overrides of the environment to the settings
+// not given on the command line. The allowed origins of an environment are
+// taken from SOCKET_ALLOWED_ORIGINS_<ENVIRONMENT> named as described by
+// EnvName.
+func (c *Config) applyEnvironment(cmdline map[string]bool, getenv func(string) string) {
+	if c.Environment == "" || cmdline["allowed_origins"] {
+		return
+	}
+	if v := getenv(EnvName("allowed_origins_" + c.Environment)); v != "" {
+		c.AllowedOrigins = v
+	}
+}
+
+// EnvName returns the environment variable name for the flag. Characters
+// other than letters and digits are replaced with underscores.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, flagName)
+}
+
+// loadFile sets the flags not already set from the config file.
+func (c *Config) loadFile(fs *flag.FlagSet, set map[string]bool) error {
+	f, err := os.Open(c.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		kv := strings.SplitN(text, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s:%d: expected name = value", c.File, line)
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", c.File, line, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %s", c.File, line, value, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Validate checks that the configuration is usable.
+func (c *Config) Validate() error {
+	addrs := []struct {
+		name, value string
+	}{
+		{"ws_addr", c.WebsocketAddr},
+		{"grpc_addr", c.GRPCAddr},
+		{"presence_addr", c.PresenceAddr},
+		{"broker_addr", c.BrokerAddr},
+	}
+	for _, a := range addrs {
+		if a.value == "" {
+			return fmt.Errorf("%s must be set", a.name)
+		}
+	}
+	if c.AuthAddr == "" && c.AuthSecret == "" {
+		return fmt.Errorf("auth_addr or auth_secret must be set")
+	}
+	if c.RegistryShards < 1 {
+		return fmt.Errorf("registry_shards must be at least 1, got %d", c.RegistryShards)
+	}
+	if c.QueueSize < 1 {
+		return fmt.Errorf("queue_size must be at least 1, got %d", c.QueueSize)
+	}
+	if c.RouteConcurrency < 1 {
+		return fmt.Errorf("route_concurrency must be at least 1, got %d", c.RouteConcurrency)
+	}
+	if _, err := socket.ParseOverflowAction(c.OverflowPolicy); err != nil {
+		return fmt.Errorf("overflow_policy: %s", err)
+	}
+	if !socket.ValidCloseCode(c.OverflowCloseCode) {
+		return fmt.Errorf("overflow_close_code must be 1000 or between 3000 and 4999, got %d", c.OverflowCloseCode)
+	}
+	if c.BatchSize < 1 {
+		return fmt.Errorf("batch_size must be at least 1, got %d", c.BatchSize)
+	}
+	if c.BatchLinger < 0 {
+		return fmt.Errorf("batch_linger must not be negative, got %s", c.BatchLinger)
+	}
+	if c.MaxMessageSize < 0 {
+		return fmt.Errorf("max_message_size must not be negative, got %d", c.MaxMessageSize)
+	}
+	if c.MaxFrameSize < 0 {
+		return fmt.Errorf("max_frame_size must not be negative, got %d", c.MaxFrameSize)
+	}
+	rates := []struct {
+		name  string
+		value float64
+	}{
+		{"conn_message_rate", c.ConnMessageRate},
+		{"conn_message_burst", c.ConnMessageBurst},
+		{"conn_byte_rate", c.ConnByteRate},
+		{"conn_byte_burst", c.ConnByteBurst},
+		{"user_message_rate", c.UserMessageRate},
+		{"user_message_burst", c.UserMessageBurst},
+		{"user_byte_rate", c.UserByteRate},
+		{"user_byte_burst", c.UserByteBurst},
+	}
+	for _, r := range rates {
+		if r.value < 0 {
+			return fmt.Errorf("%s must not be negative, got %g", r.name, r.value)
+		}
+	}
+	if _, err := websocket.ParseOriginAllowlist(c.OriginList()); err != nil {
+		return fmt.Errorf("allowed_origins: %s", err)
+	}
+	if _, err := websocket.ParseTopicAllowlist(c.TopicList()); err != nil {
+		return fmt.Errorf("client_topics: %s", err)
+	}
+	if c.MaxClientSubscriptions < 0 {
+		return fmt.Errorf("max_client_subscriptions must not be negative, got %d", c.MaxClientSubscriptions)
+	}
+	if _, err := websocket.ParseRateLimitAction(c.RateLimitAction); err != nil {
+		return fmt.Errorf("rate_limit_action: %s", err)
+	}
+	if c.PingInterval > 0 && c.PongTimeout <= 0 {
+		return fmt.Errorf("pong_timeout must be positive when pings are enabled, got %s", c.PongTimeout)
+	}
+	keepalive := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"ping_interval", c.PingInterval},
+		{"idle_timeout", c.IdleTimeout},
+		{"write_timeout", c.WriteTimeout},
+	}
+	for _, d := range keepalive {
+		if d.value < 0 {
+			return fmt.Errorf("%s must not be negative, got %s", d.name, d.value)
+		}
+	}
+	if c.CompressionLevel < flate.DefaultCompression || c.CompressionLevel > flate.BestCompression {
+		return fmt.Errorf("compression_level must be between %d and %d, got %d", flate.DefaultCompression, flate.BestCompression, c.CompressionLevel)
+	}
+	if c.CompressionThreshold < 0 {
+		return fmt.Errorf("compression_threshold must not be negative, got %d", c.CompressionThreshold)
+	}
+	if c.BrokerStreams < 0 {
+		return fmt.Errorf("broker_streams must not be negative, got %d", c.BrokerStreams)
+	}
+	if c.BrokerStreamWindow < 1 {
+		return fmt.Errorf("broker_stream_window must be at least 1, got %d", c.BrokerStreamWindow)
+	}
+	if c.RetryAttempts < 1 {
+		return fmt.Errorf("retry_attempts must be at least 1, got %d", c.RetryAttempts)
+	}
+	if c.BreakerFailures < 1 {
+		return fmt.Errorf("breaker_failures must be at least 1, got %d", c.BreakerFailures)
+	}
+	if c.RetryMaxDelay < c.RetryBaseDelay {
+		return fmt.Errorf("retry_max_delay must not be less than retry_base_delay")
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"auth_timeout", c.AuthTimeout},
+		{"presence_timeout", c.PresenceTimeout},
+		{"route_timeout", c.RouteTimeout},
+		{"health_timeout", c.HealthTimeout},
+		{"overflow_timeout", c.OverflowTimeout},
+		{"max_overflow_timeout", c.MaxOverflowTimeout},
+		{"report_interval", c.ReportInterval},
+		{"retry_base_delay", c.RetryBaseDelay},
+		{"breaker_open_timeout", c.BreakerOpenTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", d.name, d.value)
+		}
+	}
+	if c.LeaseInterval < time.Second {
+		return fmt.Errorf("presence_lease_interval must be at least 1s, got %s", c.LeaseInterval)
+	}
+	if c.ReconnectDelay < 0 {
+		return fmt.Errorf("reconnect_delay must not be negative, got %s", c.ReconnectDelay)
+	}
+	return nil
+}
+
+// SubprotocolList returns the configured subprotocols.
+func (c *Config) SubprotocolList() []string {
+	return splitList(c.Subprotocols)
+}
+
+// OriginList returns the configured allowed origin patterns.
+func (c *Config) OriginList() []string {
+	return splitList(c.AllowedOrigins)
+}
+
+// TopicList returns the configured topic patterns the clients may subscribe
+// to.
+func (c *Config) TopicList() []string {
+	return splitList(c.ClientTopics)
+}
+
+// splitList splits a comma separated list dropping the empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ConnLimits returns the rate limits of every connection.
+func (c *Config) ConnLimits() ratelimit.Limits {
+	return ratelimit.Limits{
+		Messages: ratelimit.Rate{PerSecond: c.ConnMessageRate, Burst: c.ConnMessageBurst},
+		Bytes:    ratelimit.Rate{PerSecond: c.ConnByteRate, Burst: c.ConnByteBurst},
+	}
+}
+
+// UserLimits returns the rate limits shared by the connections of a user.
+func (c *Config) UserLimits() ratelimit.Limits {
+	return ratelimit.Limits{
+		Messages: ratelimit.Rate{PerSecond: c.UserMessageRate, Burst: c.UserMessageBurst},
+		Bytes:    ratelimit.Rate{PerSecond: c.UserByteRate, Burst: c.UserByteBurst},
+	}
+}
+
+// secretFlags are the flags whose values are masked when the configuration
+// is formatted.
+var secretFlags = map[string]bool{
+	"auth_secret": true,
+}
+
+// String formats the configuration for logging as the name=value pairs of
+// all the flags. Secrets are masked.
+func (c Config) String() string {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	var settings []string
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "<hidden>"
+		}
+		if _, ok := f.Value.(flag.Getter).Get().(string); ok {
+			value = fmt.Sprintf("%q", value)
+		}
+		settings = append(settings, f.Name+"="+value)
+	})
+	return strings.Join(settings, " ")
+}
@@ -0,0 +1,219 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package config_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/config"
+)
+
+func load(t *testing.T, args []string, env map[string]string) (config.Config, error) {
+	cfg := config.Default()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	cfg.RegisterFlags(fs)
+	err := cfg.Load(fs, args, func(name string) string {
+		return env[name]
+	})
+	return cfg, err
+}
+
+func writeFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatalf("Creating temp file should not fail but got: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("Writing temp file should not fail but got: %s", err)
+	}
+	return f.Name()
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := load(t, nil, nil)
+	if err != nil {
+		t.Fatalf("Loading defaults should not fail but got: %s", err)
+	}
+	if cfg != config.Default() {
+		t.Errorf("Expected default config but got: %s", cfg)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeFile(t, `
+# deployment overrides
+presence_addr = presence:9091
+broker_addr = broker:9092
+queue_size = 20
+`)
+	defer os.Remove(path)
+
+	cfg, err := load(t, []string{"-config", path, "-queue_size", "30"}, map[string]string{
+		"SOCKET_BROKER_ADDR":   "env-broker:9092",
+		"SOCKET_ROUTE_TIMEOUT": "1s",
+	})
+	if err != nil {
+		t.Fatalf("Loading config should not fail but got: %s", err)
+	}
+	if cfg.PresenceAddr != "presence:9091" {
+		t.Errorf("Expected presence address from file but got: %s", cfg.PresenceAddr)
+	}
+	if cfg.BrokerAddr != "env-broker:9092" {
+		t.Errorf("Expected broker address from environment but got: %s", cfg.BrokerAddr)
+	}
+	if cfg.QueueSize != 30 {
+		t.Errorf("Expected queue size from flags but got: %d", cfg.QueueSize)
+	}
+	if cfg.RouteTimeout != time.Second {
+		t.Errorf("Expected route timeout from environment but got: %s", cfg.RouteTimeout)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []string{
+		"unknown = 1",
+		"queue_size",
+		"queue_size = many",
+		"config = other.conf",
+	}
+	for _, test := range tests {
+		path := writeFile(t, test)
+		_, err := load(t, []string{"-config", path}, nil)
+		os.Remove(path)
+		if err == nil {
+			t.Errorf("Expected error for %q", test)
+		}
+	}
+}
+
+func TestConfigEnvironmentOverride(t *testing.T) {
+	env := map[string]string{
+		"SOCKET_ENVIRONMENT":             "staging",
+		"SOCKET_ALLOWED_ORIGINS":         "https://example.com",
+		"SOCKET_ALLOWED_ORIGINS_STAGING": "https://*.staging.example.com",
+	}
+	cfg, err := load(t, nil, env)
+	if err != nil {
+		t.Fatalf("Loading config should not fail but got: %s", err)
+	}
+	if cfg.AllowedOrigins != "https://*.staging.example.com" {
+		t.Errorf("Expected allowed origins of the environment but got: %s", cfg.AllowedOrigins)
+	}
+
+	cfg, err = load(t, []string{"-allowed_origins", "http://localhost:*"}, env)
+	if err != nil {
+		t.Fatalf("Loading config should not fail but got: %s", err)
+	}
+	if cfg.AllowedOrigins != "http://localhost:*" {
+		t.Errorf("Expected allowed origins from flags but got: %s", cfg.AllowedOrigins)
+	}
+}
+
+func TestConfigEnvironmentNameNormalized(t *testing.T) {
+	cfg, err := load(t, nil, map[string]string{
+		"SOCKET_ENVIRONMENT":                  "staging-eu.1",
+		"SOCKET_ALLOWED_ORIGINS_STAGING_EU_1": "https://*.eu.example.com",
+	})
+	if err != nil {
+		t.Fatalf("Loading config should not fail but got: %s", err)
+	}
+	if cfg.AllowedOrigins != "https://*.eu.example.com" {
+		t.Errorf("Expected allowed origins of the environment but got: %s", cfg.AllowedOrigins)
+	}
+	if name := config.EnvName("allowed_origins_prod-us"); name != "SOCKET_ALLOWED_ORIGINS_PROD_US" {
+		t.Errorf("Unexpected environment variable name: %s", name)
+	}
+}
+
+func TestConfigInvalidEnvironment(t *testing.T) {
+	_, err := load(t, nil, map[string]string{"SOCKET_AUTH_TIMEOUT": "soon"})
+	if err == nil || !strings.Contains(err.Error(), "SOCKET_AUTH_TIMEOUT") {
+		t.Errorf("Expected error naming the variable but got: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-ws_addr", ""}, "ws_addr"},
+		{[]string{"-registry_shards", "0"}, "registry_shards"},
+		{[]string{"-queue_size", "0"}, "queue_size"},
+		{[]string{"-overflow_policy", "retry"}, "overflow_policy"},
+		{[]string{"-overflow_close_code", "1001"}, "overflow_close_code"},
+		{[]string{"-max_overflow_timeout", "0"}, "max_overflow_timeout"},
+		{[]string{"-batch_linger", "-1ms"}, "batch_linger"},
+		{[]string{"-max_message_size", "-1"}, "max_message_size"},
+		{[]string{"-user_byte_rate", "-1"}, "user_byte_rate"},
+		{[]string{"-rate_limit_action", "ignore"}, "rate_limit_action"},
+		{[]string{"-allowed_origins", "ftp://example.com"}, "allowed_origins"},
+		{[]string{"-client_topics", "a*b"}, "client_topics"},
+		{[]string{"-max_client_subscriptions", "-1"}, "max_client_subscriptions"},
+		{[]string{"-pong_timeout", "0"}, "pong_timeout"},
+		{[]string{"-idle_timeout", "-1s"}, "idle_timeout"},
+		{[]string{"-compression_level", "10"}, "compression_level"},
+		{[]string{"-route_timeout", "0"}, "route_timeout"},
+		{[]string{"-presence_lease_interval", "500ms"}, "presence_lease_interval"},
+		{[]string{"-reconnect_delay", "-1s"}, "reconnect_delay"},
+		{[]string{"-auth_addr", ""}, "auth_addr"},
+	}
+	for _, test := range tests {
+		_, err := load(t, test.args, nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error about %s for %v but got: %v", test.err, test.args, err)
+		}
+	}
+}
+
+func TestConfigStringHidesSecret(t *testing.T) {
+	cfg := config.Default()
+	cfg.AuthSecret = "topsecret"
+	if s := cfg.String(); strings.Contains(s, "topsecret") {
+		t.Errorf("Secret should not be printed: %s", s)
+	}
+}
+
+func TestConfigStringListsAllFlags(t *testing.T) {
+	cfg := config.Default()
+	cfg.Subprotocols = "v1 v2"
+	s := cfg.String()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		if !strings.Contains(s, f.Name+"=") {
+			t.Errorf("Setting %s should be printed: %s", f.Name, s)
+		}
+	})
+	if !strings.Contains(s, `subprotocols="v1 v2"`) || !strings.Contains(s, "queue_size=10") {
+		t.Errorf("Settings should be formatted by type: %s", s)
+	}
+}
+
+func TestConfigSubprotocolList(t *testing.T) {
+	cfg := config.Default()
+	cfg.Subprotocols = "v2.socket, v1.socket,"
+	if p := cfg.SubprotocolList(); !reflect.DeepEqual(p, []string{"v2.socket", "v1.socket"}) {
+		t.Errorf("Unexpected subprotocols: %v", p)
+	}
+}
@@ -11,6 +11,8 @@ It is generated from these files:
 It has these top-level messages:
 	StatusRequest
 	StatusReply
+	LeaseRequest
+	LeaseReply
 	Device
 */
 package devicepresence
@@ -68,6 +70,10 @@ func (x Device_Status) String() string {
 
 type StatusRequest struct {
 	Device *Device `protobuf:"bytes,1,opt,name=device" json:"device,omitempty"`
+	// Duration of an online device's lease. The device is considered offline
+	// once the lease expires. Zero means the lease never expires.
+	LeaseSeconds int64  `protobuf:"varint,2,opt,name=lease_seconds" json:"lease_seconds,omitempty"`
+	GatewayId    string `protobuf:"bytes,3,opt,name=gateway_id" json:"gateway_id,omitempty"`
 }
 
 func (m *StatusRequest) Reset()         { *m = StatusRequest{} }
@@ -88,6 +94,26 @@ func (m *StatusReply) Reset()         { *m = StatusReply{} }
 func (m *StatusReply) String() string { return proto.CompactTextString(m) }
 func (*StatusReply) ProtoMessage()    {}
 
+type LeaseRequest struct {
+	GatewayId    string   `protobuf:"bytes,1,opt,name=gateway_id" json:"gateway_id,omitempty"`
+	DeviceIds    []string `protobuf:"bytes,2,rep,name=device_ids" json:"device_ids,omitempty"`
+	LeaseSeconds int64    `protobuf:"varint,3,opt,name=lease_seconds" json:"lease_seconds,omitempty"`
+}
+
+func (m *LeaseRequest) Reset()         { *m = LeaseRequest{} }
+func (m *LeaseRequest) String() string { return proto.CompactTextString(m) }
+func (*LeaseRequest) ProtoMessage()    {}
+
+type LeaseReply struct {
+	// Devices whose leases could not be renewed because they already expired
+	// or are not known to the presence service.
+	ExpiredDeviceIds []string `protobuf:"bytes,1,rep,name=expired_device_ids" json:"expired_device_ids,omitempty"`
+}
+
+func (m *LeaseReply) Reset()         { *m = LeaseReply{} }
+func (m *LeaseReply) String() string { return proto.CompactTextString(m) }
+func (*LeaseReply) ProtoMessage()    {}
+
 type Device struct {
 	Id     string        `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
 	Type   Device_Type   `protobuf:"varint,2,opt,name=type,enum=devicepresence.Device_Type" json:"type,omitempty"`
@@ -108,6 +134,7 @@ func init() {
 
 type PresenceManagerClient interface {
 	SetStatus(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusReply, error)
+	RenewLeases(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*LeaseReply, error)
 }
 
 type presenceManagerClient struct {
@@ -127,10 +154,20 @@ func (c *presenceManagerClient) SetStatus(ctx context.Context, in *StatusRequest
 	return out, nil
 }
 
+func (c *presenceManagerClient) RenewLeases(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*LeaseReply, error) {
+	out := new(LeaseReply)
+	err := grpc.Invoke(ctx, "/devicepresence.PresenceManager/RenewLeases", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for PresenceManager service
 
 type PresenceManagerServer interface {
 	SetStatus(context.Context, *StatusRequest) (*StatusReply, error)
+	RenewLeases(context.Context, *LeaseRequest) (*LeaseReply, error)
 }
 
 func RegisterPresenceManagerServer(s *grpc.Server, srv PresenceManagerServer) {
@@ -149,6 +186,18 @@ func _PresenceManager_SetStatus_Handler(srv interface{}, ctx context.Context, bu
 	return out, nil
 }
 
+func _PresenceManager_RenewLeases_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(LeaseRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PresenceManagerServer).RenewLeases(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 var _PresenceManager_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "devicepresence.PresenceManager",
 	HandlerType: (*PresenceManagerServer)(nil),
@@ -157,6 +206,10 @@ var _PresenceManager_serviceDesc = grpc.ServiceDesc{
 			MethodName: "SetStatus",
 			Handler:    _PresenceManager_SetStatus_Handler,
 		},
+		{
+			MethodName: "RenewLeases",
+			Handler:    _PresenceManager_RenewLeases_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{},
 }
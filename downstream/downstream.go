@@ -0,0 +1,286 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package downstream applies deadlines, retries and circuit breaking to the
+// calls made to other services.
+package downstream
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
+	"github.com/protogalaxy/service-socket/metrics"
+)
+
+var (
+	retries  = metrics.NewCounterVec("socket_downstream_retries_total", "Total number of retried downstream calls.", "downstream")
+	rejected = metrics.NewCounterVec("socket_downstream_rejected_total", "Total number of downstream calls rejected by an open circuit breaker.", "downstream")
+	open     = metrics.NewGaugeVec("socket_downstream_breaker_open", "Whether the downstream circuit breaker is open.", "downstream")
+)
+
+// ErrOpen is returned without calling the downstream while its circuit
+// breaker is open.
+var ErrOpen = errors.New("circuit breaker open")
+
+// permanentError marks an error that must not be retried.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent wraps the error so the call is not retried. The downstream
+// answered so the error doesn't count as a failure for the circuit breaker.
+// Retry returns the original error.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// transient returns true if the error indicates the downstream could not
+// handle the call and trying again may succeed.
+func transient(err error) bool {
+	if err == nil || err == ErrOpen {
+		return false
+	}
+	if _, ok := err.(permanentError); ok {
+		return false
+	}
+	switch err {
+	case context.Canceled:
+		return false
+	case context.DeadlineExceeded:
+		return true
+	}
+	switch grpc.Code(err) {
+	case codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.FailedPrecondition, codes.OutOfRange,
+		codes.Unimplemented, codes.Unauthenticated:
+		return false
+	}
+	return true
+}
+
+func unwrap(err error) error {
+	if p, ok := err.(permanentError); ok {
+		return p.err
+	}
+	return err
+}
+
+// Policy bounds every call to a downstream with a deadline and optionally
+// retries the idempotent ones and guards them with a circuit breaker.
+type Policy struct {
+	// Name identifies the downstream in logs and metrics.
+	Name string
+	// Timeout is the deadline of a single attempt.
+	Timeout time.Duration
+	// Attempts is the maximum number of attempts made by Retry.
+	Attempts int
+	// BaseDelay is the delay before the first retry. It doubles with every
+	// attempt up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Breaker is shared by all the calls to the downstream if set.
+	Breaker *Breaker
+}
+
+// Call makes a single attempt. It is meant for calls that are not
+// idempotent.
+func (p *Policy) Call(ctx context.Context, call func(context.Context) error) error {
+	return unwrap(p.attempt(ctx, call))
+}
+
+// Retry calls the idempotent call until it succeeds, fails with an error
+// that is not transient or the attempts are exhausted. The retries are
+// delayed by an exponential backoff with jitter.
+func (p *Policy) Retry(ctx context.Context, call func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := p.attempt(ctx, call)
+		if !transient(err) || attempt >= p.Attempts {
+			return unwrap(err)
+		}
+		delay := p.backoff(attempt)
+		glog.V(2).Infof("Retrying %s call in %s: %s", p.Name, delay, err)
+		retries.With(p.Name).Inc()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return unwrap(err)
+		}
+	}
+}
+
+func (p *Policy) attempt(ctx context.Context, call func(context.Context) error) error {
+	var gen uint64
+	if p.Breaker != nil {
+		var err error
+		if gen, err = p.Breaker.allow(); err != nil {
+			rejected.With(p.Name).Inc()
+			return err
+		}
+	}
+	callCtx := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	err := call(callCtx)
+	if p.Breaker != nil {
+		if ctx.Err() != nil {
+			// The caller gave up so the call says nothing about the downstream.
+			p.Breaker.release(gen)
+		} else {
+			p.Breaker.record(p.Name, gen, transient(err))
+		}
+	}
+	return err
+}
+
+// backoff returns the delay before the retry following the attempt. Half of
+// the delay is randomized so the clients don't retry in lockstep.
+func (p *Policy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+type breakerState int
+
+const (
+	closed breakerState = iota
+	opened
+	halfOpen
+)
+
+// Breaker opens after a number of consecutive failed calls and rejects all
+// calls until the open timeout passes. Then a single trial call is let
+// through which closes the breaker if it succeeds or opens it again.
+type Breaker struct {
+	// Failures is the number of consecutive failures that open the breaker.
+	Failures int
+	// OpenTimeout is how long the breaker stays open before a trial call.
+	OpenTimeout time.Duration
+	// Now returns the current time, time.Now is used if nil.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// generation changes with every state change so the outcomes of the
+	// calls let through in an earlier state are ignored.
+	generation uint64
+}
+
+// NewBreaker creates a closed breaker.
+func NewBreaker(failures int, openTimeout time.Duration) *Breaker {
+	return &Breaker{
+		Failures:    failures,
+		OpenTimeout: openTimeout,
+	}
+}
+
+func (b *Breaker) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+// Open returns true if the breaker currently rejects calls.
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != closed
+}
+
+// allow returns the generation the call is let through in. It is passed
+// back with the outcome of the call.
+func (b *Breaker) allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case opened:
+		if b.now().Sub(b.openedAt) < b.OpenTimeout {
+			return 0, ErrOpen
+		}
+		b.setState(halfOpen)
+	case halfOpen:
+		// Only the trial call is let through.
+		return 0, ErrOpen
+	}
+	return b.generation, nil
+}
+
+func (b *Breaker) setState(state breakerState) {
+	b.state = state
+	b.generation++
+}
+
+// release gives up the trial call without recording its outcome so the next
+// call is let through as the trial instead.
+func (b *Breaker) release(gen uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen == b.generation && b.state == halfOpen {
+		b.setState(opened)
+	}
+}
+
+// record records the outcome of a call let through in the generation. Only
+// the trial call can close an open breaker.
+func (b *Breaker) record(name string, gen uint64, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen != b.generation {
+		return
+	}
+	if !failed {
+		if b.state != closed {
+			glog.Infof("Closing %s circuit breaker", name)
+			open.With(name).Set(0)
+			b.setState(closed)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == halfOpen || b.failures >= b.Failures {
+		if b.state == closed {
+			glog.Warningf("Opening %s circuit breaker after %d failures", name, b.failures)
+			open.With(name).Set(1)
+		}
+		b.setState(opened)
+		b.openedAt = b.now()
+	}
+}
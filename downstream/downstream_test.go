@@ -0,0 +1,254 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package downstream_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
+	"github.com/protogalaxy/service-socket/downstream"
+)
+
+var errUnavailable = grpc.Errorf(codes.Unavailable, "unavailable")
+
+func TestPolicyCallSetsDeadline(t *testing.T) {
+	p := &downstream.Policy{Name: "test", Timeout: time.Second}
+	var calls int
+	err := p.Call(context.Background(), func(ctx context.Context) error {
+		calls++
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Call should have a deadline")
+		}
+		return errUnavailable
+	})
+	if err != errUnavailable {
+		t.Errorf("Expected call error but got: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Call should not be retried but got %d attempts", calls)
+	}
+}
+
+func TestPolicyRetry(t *testing.T) {
+	p := &downstream.Policy{Name: "test", Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	var calls int
+	err := p.Retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errUnavailable
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected the last attempt to succeed but got: %s", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts but got %d", calls)
+	}
+}
+
+func TestPolicyRetryGivesUp(t *testing.T) {
+	p := &downstream.Policy{Name: "test", Attempts: 2}
+	var calls int
+	err := p.Retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		return errUnavailable
+	})
+	if err != errUnavailable {
+		t.Errorf("Expected the last error but got: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 attempts but got %d", calls)
+	}
+}
+
+func TestPolicyRetryStopsOnPermanentError(t *testing.T) {
+	permanent := errors.New("invalid")
+	tests := []error{
+		downstream.Permanent(permanent),
+		grpc.Errorf(codes.InvalidArgument, "invalid"),
+		grpc.Errorf(codes.NotFound, "not found"),
+	}
+	for _, test := range tests {
+		p := &downstream.Policy{Name: "test", Attempts: 3}
+		var calls int
+		err := p.Retry(context.Background(), func(ctx context.Context) error {
+			calls++
+			return test
+		})
+		if calls != 1 {
+			t.Errorf("Expected a single attempt for %v but got %d", test, calls)
+		}
+		if test == tests[0] && err != permanent {
+			t.Errorf("Expected the unwrapped error but got: %v", err)
+		}
+	}
+}
+
+func TestPolicyRetryHonorsContext(t *testing.T) {
+	p := &downstream.Policy{Name: "test", Attempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	var calls int
+	err := p.Retry(ctx, func(ctx context.Context) error {
+		calls++
+		return errUnavailable
+	})
+	if err != errUnavailable || calls != 1 {
+		t.Errorf("Expected to stop waiting for the retry but got %d attempts and: %v", calls, err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := downstream.NewBreaker(2, time.Second)
+	b.Now = func() time.Time { return now }
+	p := &downstream.Policy{Name: "test", Attempts: 1, Breaker: b}
+
+	var calls int
+	fail := func(ctx context.Context) error {
+		calls++
+		return errUnavailable
+	}
+	succeed := func(ctx context.Context) error {
+		calls++
+		return nil
+	}
+
+	p.Call(context.Background(), fail)
+	if b.Open() {
+		t.Fatal("Breaker should not open before reaching the failure threshold")
+	}
+	p.Call(context.Background(), fail)
+	if !b.Open() {
+		t.Fatal("Breaker should open after reaching the failure threshold")
+	}
+	if err := p.Call(context.Background(), succeed); err != downstream.ErrOpen {
+		t.Errorf("Expected open breaker to reject calls but got: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Open breaker should not call the downstream")
+	}
+
+	// Trial call after the open timeout fails and opens the breaker again.
+	now = now.Add(time.Second)
+	p.Call(context.Background(), fail)
+	if err := p.Call(context.Background(), succeed); err != downstream.ErrOpen {
+		t.Errorf("Expected failed trial call to open the breaker but got: %v", err)
+	}
+
+	// Successful trial call closes the breaker.
+	now = now.Add(time.Second)
+	if err := p.Call(context.Background(), succeed); err != nil {
+		t.Errorf("Expected trial call to succeed but got: %s", err)
+	}
+	if b.Open() {
+		t.Error("Breaker should close after a successful trial call")
+	}
+}
+
+func TestBreakerIgnoresPermanentErrors(t *testing.T) {
+	b := downstream.NewBreaker(1, time.Second)
+	p := &downstream.Policy{Name: "test", Attempts: 1, Breaker: b}
+	p.Call(context.Background(), func(ctx context.Context) error {
+		return grpc.Errorf(codes.NotFound, "not found")
+	})
+	if b.Open() {
+		t.Error("Errors returned by a healthy downstream should not open the breaker")
+	}
+}
+
+func TestBreakerIgnoresCallerContextErrors(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := downstream.NewBreaker(1, time.Second)
+	b.Now = func() time.Time { return now }
+	p := &downstream.Policy{Name: "test", Attempts: 1, Breaker: b}
+
+	p.Call(context.Background(), func(ctx context.Context) error {
+		return errUnavailable
+	})
+	if !b.Open() {
+		t.Fatal("Breaker should open after reaching the failure threshold")
+	}
+
+	// Trial call abandoned by the caller neither closes nor reopens the breaker.
+	now = now.Add(time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := p.Retry(ctx, func(ctx context.Context) error {
+		cancel()
+		return ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected the caller's error but got: %v", err)
+	}
+	if !b.Open() {
+		t.Error("Canceled trial call should not close the breaker")
+	}
+
+	// The next call is let through as the trial.
+	var called bool
+	err = p.Call(context.Background(), func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Errorf("Expected a new trial call to be made but got: %v", err)
+	}
+	if b.Open() {
+		t.Error("Breaker should close after a successful trial call")
+	}
+}
+
+func TestBreakerIgnoresCallsFromEarlierStates(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := downstream.NewBreaker(1, time.Second)
+	b.Now = func() time.Time { return now }
+	p := &downstream.Policy{Name: "test", Attempts: 1, Breaker: b}
+
+	// A slow call is let through while the breaker is still closed.
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Call(context.Background(), func(ctx context.Context) error {
+			close(started)
+			<-finish
+			return nil
+		})
+	}()
+	<-started
+
+	p.Call(context.Background(), func(ctx context.Context) error {
+		return errUnavailable
+	})
+	if !b.Open() {
+		t.Fatal("Breaker should open after reaching the failure threshold")
+	}
+
+	close(finish)
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !b.Open() {
+		t.Error("Success of a call let through before the breaker opened should not close it")
+	}
+	if err := p.Call(context.Background(), func(ctx context.Context) error { return nil }); err != downstream.ErrOpen {
+		t.Errorf("Expected breaker to keep rejecting calls but got: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:generate protoc --go_out=plugins=grpc:. -I ../protos ../protos/health.proto
+
+package health
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
+)
+
+// ErrDraining is reported by the readiness check while the process shuts down.
+var ErrDraining = errors.New("draining")
+
+// Check reports an error if a dependency is not ready.
+type Check func(ctx context.Context) error
+
+// Checker aggregates readiness checks. It serves them as HTTP probes and as
+// the standard gRPC health checking service.
+type Checker struct {
+	// Timeout bounds running all the checks.
+	Timeout time.Duration
+	// Services are the gRPC service names reported by the health service in
+	// addition to the empty name denoting the whole server.
+	Services []string
+
+	mu       sync.Mutex
+	checks   map[string]Check
+	draining bool
+}
+
+// NewChecker creates a checker without any checks.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		Timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+// Add adds a named readiness check.
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// SetDraining makes the checker report not ready from now on.
+func (c *Checker) SetDraining() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+}
+
+// Ready runs all the checks concurrently and returns the errors of the
+// failed ones by name. Checks that don't finish within the timeout fail.
+func (c *Checker) Ready(ctx context.Context) map[string]error {
+	c.mu.Lock()
+	draining := c.draining
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.Unlock()
+
+	failed := make(map[string]error)
+	if draining {
+		failed["draining"] = ErrDraining
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	pending := make(map[string]bool, len(checks))
+	for name, check := range checks {
+		pending[name] = true
+		go func(name string, check Check) {
+			results <- result{name, check(ctx)}
+		}(name, check)
+	}
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.name)
+			if r.err != nil {
+				failed[r.name] = r.err
+			}
+		case <-ctx.Done():
+			for name := range pending {
+				failed[name] = ctx.Err()
+			}
+			return failed
+		}
+	}
+	return failed
+}
+
+// LiveHandler returns a handler that reports the process is alive.
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// ReadyHandler returns a handler that responds with 200 if all the checks
+// pass and with 503 listing the failed checks otherwise.
+func (c *Checker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed := c.Ready(context.Background())
+		if len(failed) == 0 {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		names := make([]string, 0, len(failed))
+		for name := range failed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s: %s\n", name, failed[name])
+		}
+	})
+}
+
+// Check implements the HealthServer interface.
+func (c *Checker) Check(ctx context.Context, req *HealthCheckRequest) (*HealthCheckResponse, error) {
+	if !c.knownService(req.Service) {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service: %s", req.Service)
+	}
+	status := HealthCheckResponse_SERVING
+	if len(c.Ready(ctx)) > 0 {
+		status = HealthCheckResponse_NOT_SERVING
+	}
+	return &HealthCheckResponse{Status: status}, nil
+}
+
+func (c *Checker) knownService(service string) bool {
+	if service == "" {
+		return true
+	}
+	for _, s := range c.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnCheck returns a check that succeeds if an RPC can be made over the
+// connection. The server's health service is called and a server that does
+// not implement it is still considered ready since it responded.
+func ConnCheck(cc *grpc.ClientConn) Check {
+	client := NewHealthClient(cc)
+	return func(ctx context.Context) error {
+		reply, err := client.Check(ctx, &HealthCheckRequest{})
+		switch {
+		case grpc.Code(err) == codes.Unimplemented:
+			return nil
+		case err != nil:
+			return err
+		case reply.Status != HealthCheckResponse_SERVING:
+			return fmt.Errorf("status %s", reply.Status)
+		}
+		return nil
+	}
+}
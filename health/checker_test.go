@@ -0,0 +1,160 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package health_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
+	"github.com/protogalaxy/service-socket/health"
+)
+
+func TestCheckerReady(t *testing.T) {
+	c := health.NewChecker(10 * time.Millisecond)
+	c.Add("ok", func(ctx context.Context) error { return nil })
+	if failed := c.Ready(context.Background()); len(failed) != 0 {
+		t.Fatalf("Expected checker to be ready but got: %v", failed)
+	}
+
+	c.Add("broken", func(ctx context.Context) error { return errors.New("broken") })
+	c.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	failed := c.Ready(context.Background())
+	if len(failed) != 2 || failed["broken"] == nil || failed["slow"] != context.DeadlineExceeded {
+		t.Errorf("Expected broken and slow checks to fail but got: %v", failed)
+	}
+}
+
+func TestCheckerDraining(t *testing.T) {
+	c := health.NewChecker(time.Second)
+	c.SetDraining()
+	failed := c.Ready(context.Background())
+	if failed["draining"] != health.ErrDraining {
+		t.Errorf("Expected draining checker not to be ready but got: %v", failed)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	c := health.NewChecker(time.Second)
+	srv := httptest.NewServer(c.ReadyHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request should not fail but got: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 but got: %d", resp.StatusCode)
+	}
+
+	c.Add("presence", func(ctx context.Context) error { return errors.New("not connected") })
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request should not fail but got: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 but got: %d", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "presence: not connected") {
+		t.Errorf("Expected failed check in the body but got: %s", body)
+	}
+}
+
+func TestCheckerHealthService(t *testing.T) {
+	c := health.NewChecker(time.Second)
+	c.Services = []string{"socket.Sender"}
+
+	for _, service := range []string{"", "socket.Sender"} {
+		reply, err := c.Check(context.Background(), &health.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("Check should not fail but got: %s", err)
+		}
+		if reply.Status != health.HealthCheckResponse_SERVING {
+			t.Errorf("Expected %q to be serving but got: %s", service, reply.Status)
+		}
+	}
+
+	_, err := c.Check(context.Background(), &health.HealthCheckRequest{Service: "unknown"})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected not found error but got: %v", err)
+	}
+
+	c.SetDraining()
+	reply, err := c.Check(context.Background(), &health.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check should not fail but got: %s", err)
+	}
+	if reply.Status != health.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected draining server not to be serving but got: %s", reply.Status)
+	}
+}
+
+func serve(t *testing.T, register func(*grpc.Server)) (*grpc.ClientConn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening should not fail but got: %s", err)
+	}
+	s := grpc.NewServer()
+	register(s)
+	go s.Serve(l)
+	cc, err := grpc.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dialing should not fail but got: %s", err)
+	}
+	return cc, func() {
+		cc.Close()
+		s.Stop()
+	}
+}
+
+func TestConnCheck(t *testing.T) {
+	c := health.NewChecker(time.Second)
+	cc, stop := serve(t, func(s *grpc.Server) {
+		health.RegisterHealthServer(s, c)
+	})
+	defer stop()
+
+	check := health.ConnCheck(cc)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Expected serving connection to pass but got: %s", err)
+	}
+	c.SetDraining()
+	if err := check(context.Background()); err == nil {
+		t.Error("Expected not serving connection to fail")
+	}
+}
+
+func TestConnCheckWithoutHealthService(t *testing.T) {
+	cc, stop := serve(t, func(s *grpc.Server) {})
+	defer stop()
+
+	if err := health.ConnCheck(cc)(context.Background()); err != nil {
+		t.Errorf("Expected connection to a server without health service to pass but got: %s", err)
+	}
+}
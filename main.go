@@ -16,59 +16,252 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/auth"
+	"github.com/protogalaxy/service-socket/config"
 	"github.com/protogalaxy/service-socket/devicepresence"
+	"github.com/protogalaxy/service-socket/downstream"
+	"github.com/protogalaxy/service-socket/health"
 	"github.com/protogalaxy/service-socket/messagebroker"
+	"github.com/protogalaxy/service-socket/metrics"
+	"github.com/protogalaxy/service-socket/presence"
+	"github.com/protogalaxy/service-socket/ratelimit"
 	"github.com/protogalaxy/service-socket/socket"
+	"github.com/protogalaxy/service-socket/transport"
 	"github.com/protogalaxy/service-socket/websocket"
 )
 
+// registry is a socket registry that can be run and closed.
+type registry interface {
+	socket.Registry
+	Run()
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+func newRegistry(shards int) registry {
+	if shards > 1 {
+		return socket.NewShardedRegistry(shards)
+	}
+	return socket.NewRegistry()
+}
+
+// newPolicy creates the call policy of a downstream with its own circuit breaker.
+func newPolicy(cfg config.Config, name string, timeout time.Duration, attempts int) *downstream.Policy {
+	return &downstream.Policy{
+		Name:      name,
+		Timeout:   timeout,
+		Attempts:  attempts,
+		BaseDelay: cfg.RetryBaseDelay,
+		MaxDelay:  cfg.RetryMaxDelay,
+		Breaker:   downstream.NewBreaker(cfg.BreakerFailures, cfg.BreakerOpenTimeout),
+	}
+}
+
+// defaultGatewayID generates a gateway id that is unique among the running instances.
+func defaultGatewayID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "gateway"
+	}
+	return fmt.Sprintf("%s-%x", host, rand.Int63())
+}
+
 func main() {
-	flag.Parse()
+	cfg := config.Default()
+	cfg.RegisterFlags(flag.CommandLine)
+	if err := cfg.Load(flag.CommandLine, os.Args[1:], os.Getenv); err != nil {
+		glog.Fatalf("invalid configuration: %s", err)
+	}
 	rand.Seed(time.Now().UnixNano())
+	if cfg.GatewayID == "" {
+		cfg.GatewayID = defaultGatewayID()
+	}
+	glog.V(1).Infof("Effective configuration: %s", cfg)
 
-	socketRegistry := socket.NewRegistry()
+	checker := health.NewChecker(cfg.HealthTimeout)
+	checker.Services = []string{"socket.Sender"}
+
+	socketRegistry := newRegistry(cfg.RegistryShards)
 	go socketRegistry.Run()
+	checker.Add("registry", socketRegistry.Ping)
 
-	conn, err := grpc.Dial("localhost:9091")
+	conn, err := grpc.Dial(cfg.PresenceAddr)
 	if err != nil {
 		glog.Fatalf("could not connect: %v", err)
 	}
 	defer conn.Close()
 	dpc := devicepresence.NewPresenceManagerClient(conn)
+	checker.Add("presence", health.ConnCheck(conn))
+
+	leases := presence.NewLeaseRenewer(dpc, cfg.GatewayID, cfg.LeaseInterval)
+	go leases.Run()
+	defer leases.Close()
 
-	conn2, err := grpc.Dial("localhost:9092")
+	conn2, err := grpc.Dial(cfg.BrokerAddr)
 	if err != nil {
 		glog.Fatalf("could not connect: %v", err)
 	}
 	defer conn2.Close()
-	mbc := messagebroker.NewBrokerClient(conn2)
+	mbc := messagebroker.NewMux(messagebroker.NewBrokerClient(conn2), cfg.BrokerStreams, cfg.BrokerStreamWindow)
+	checker.Add("broker", health.ConnCheck(conn2))
+
+	var authenticator auth.Authenticator
+	if cfg.AuthSecret != "" {
+		authenticator = &auth.TokenVerifier{
+			Secret: []byte(cfg.AuthSecret),
+		}
+	} else {
+		conn3, err := grpc.Dial(cfg.AuthAddr)
+		if err != nil {
+			glog.Fatalf("could not connect: %v", err)
+		}
+		defer conn3.Close()
+		checker.Add("auth", health.ConnCheck(conn3))
+		authenticator = &auth.ServiceAuthenticator{
+			Client: auth.NewAuthClient(conn3),
+		}
+	}
 
-	connHandler := websocket.ConnectionHandler{
+	// The policy, action, origin and topic patterns were checked when the config was validated.
+	overflow, _ := socket.ParseOverflowAction(cfg.OverflowPolicy)
+	rateLimitAction, _ := websocket.ParseRateLimitAction(cfg.RateLimitAction)
+	origins, _ := websocket.ParseOriginAllowlist(cfg.OriginList())
+	topics, _ := websocket.ParseTopicAllowlist(cfg.TopicList())
+	connHandler := &websocket.ConnectionHandler{
+		Authenticator:  authenticator,
 		Registry:       socketRegistry,
 		DevicePresence: dpc,
 		MessageBroker:  mbc,
+		Leases:         leases,
+		GatewayID:      cfg.GatewayID,
+		Policies: websocket.Policies{
+			Auth:     newPolicy(cfg, "auth", cfg.AuthTimeout, cfg.RetryAttempts),
+			Presence: newPolicy(cfg, "presence", cfg.PresenceTimeout, cfg.RetryAttempts),
+			// Routing a message is not idempotent so it is never retried.
+			Broker: newPolicy(cfg, "broker", cfg.RouteTimeout, 1),
+		},
+		RouteConcurrency: cfg.RouteConcurrency,
+		RouteOrdered:     cfg.RouteOrdered,
+		QueueSize:        cfg.QueueSize,
+		Overflow: socket.OverflowPolicy{
+			Action:    overflow,
+			Timeout:   cfg.OverflowTimeout,
+			CloseCode: cfg.OverflowCloseCode,
+		},
+		BatchSize:      cfg.BatchSize,
+		BatchLinger:    cfg.BatchLinger,
+		Subprotocols:   cfg.SubprotocolList(),
+		MaxMessageSize: cfg.MaxMessageSize,
+		MaxFrameSize:   cfg.MaxFrameSize,
+		Origins:        origins,
+		Keepalive: websocket.Keepalive{
+			PingInterval: cfg.PingInterval,
+			PongTimeout:  cfg.PongTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+		},
+		ConnLimits:      cfg.ConnLimits(),
+		RateLimitAction: rateLimitAction,
+		ReconnectDelay:  cfg.ReconnectDelay,
+
+		AuthorizeSubscription: topics.Allowed,
+		MaxSubscriptions:      cfg.MaxClientSubscriptions,
+	}
+	if userLimits := cfg.UserLimits(); userLimits.Enabled() {
+		connHandler.UserLimits = ratelimit.NewUsers(userLimits)
+	}
+	if cfg.Compression {
+		connHandler.Compression = &transport.Compression{
+			Level:                   cfg.CompressionLevel,
+			Threshold:               cfg.CompressionThreshold,
+			ServerNoContextTakeover: cfg.CompressionServerNoContextTakeover,
+			ClientNoContextTakeover: cfg.CompressionClientNoContextTakeover,
+		}
 	}
 
+	stopping := make(chan struct{})
+
+	ws, err := net.Listen("tcp", cfg.WebsocketAddr)
+	if err != nil {
+		glog.Fatalf("failed to listen: %v", err)
+	}
 	go func() {
 		http.Handle("/", connHandler.Handler())
-		glog.Fatal(http.ListenAndServe(":8080", nil))
+		err := http.Serve(ws, nil)
+		select {
+		case <-stopping:
+		default:
+			glog.Fatal(err)
+		}
 	}()
 
-	s, err := net.Listen("tcp", ":9090")
+	s, err := net.Listen("tcp", cfg.GRPCAddr)
 	if err != nil {
 		glog.Fatalf("failed to listen: %v", err)
 	}
 
 	grpcServer := grpc.NewServer()
-	socket.RegisterSenderServer(grpcServer, &socket.Sender{
-		Sockets: socketRegistry,
-	})
-	grpcServer.Serve(s)
+	sender := &socket.Sender{
+		Sockets:            socketRegistry,
+		ReportInterval:     cfg.ReportInterval,
+		MaxOverflowTimeout: cfg.MaxOverflowTimeout,
+	}
+	socket.RegisterSenderServer(grpcServer, sender)
+	health.RegisterHealthServer(grpcServer, checker)
+	go func() {
+		err := grpcServer.Serve(s)
+		select {
+		case <-stopping:
+		default:
+			glog.Fatal(err)
+		}
+	}()
+
+	if cfg.AdminAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			mux.Handle("/healthz", health.LiveHandler())
+			mux.Handle("/readyz", checker.ReadyHandler())
+			glog.Fatal(http.ListenAndServe(cfg.AdminAddr, mux))
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	glog.Infof("Received %s, shutting down", sig)
+	close(stopping)
+	checker.SetDraining()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting new websockets and disconnect the existing ones which
+	// marks their devices offline.
+	ws.Close()
+	if err := connHandler.Shutdown(ctx); err != nil {
+		glog.Warningf("Not all websocket connections closed: %s", err)
+	}
+	mbc.Close()
+
+	if err := sender.Drain(ctx); err != nil {
+		glog.Warningf("Not all sender calls finished: %s", err)
+	}
+	grpcServer.Stop()
+	socketRegistry.Close()
+	glog.Info("Shutdown complete")
+	glog.Flush()
 }
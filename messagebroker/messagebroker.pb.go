@@ -11,6 +11,8 @@ It is generated from these files:
 It has these top-level messages:
 	RouteRequest
 	RouteReply
+	StreamRequest
+	RouteAck
 */
 package messagebroker
 
@@ -29,7 +31,12 @@ var _ grpc.ClientConn
 var _ = proto.Marshal
 
 type RouteRequest struct {
-	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	Data       []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	SocketId   int64  `protobuf:"varint,2,opt,name=socket_id" json:"socket_id,omitempty"`
+	UserId     string `protobuf:"bytes,3,opt,name=user_id" json:"user_id,omitempty"`
+	GatewayId  string `protobuf:"bytes,4,opt,name=gateway_id" json:"gateway_id,omitempty"`
+	ReceivedAt int64  `protobuf:"varint,5,opt,name=received_at" json:"received_at,omitempty"`
+	MessageId  string `protobuf:"bytes,6,opt,name=message_id" json:"message_id,omitempty"`
 }
 
 func (m *RouteRequest) Reset()         { *m = RouteRequest{} }
@@ -43,6 +50,32 @@ func (m *RouteReply) Reset()         { *m = RouteReply{} }
 func (m *RouteReply) String() string { return proto.CompactTextString(m) }
 func (*RouteReply) ProtoMessage()    {}
 
+type StreamRequest struct {
+	Sequence uint64        `protobuf:"varint,1,opt,name=sequence" json:"sequence,omitempty"`
+	Request  *RouteRequest `protobuf:"bytes,2,opt,name=request" json:"request,omitempty"`
+}
+
+func (m *StreamRequest) Reset()         { *m = StreamRequest{} }
+func (m *StreamRequest) String() string { return proto.CompactTextString(m) }
+func (*StreamRequest) ProtoMessage()    {}
+
+func (m *StreamRequest) GetRequest() *RouteRequest {
+	if m != nil {
+		return m.Request
+	}
+	return nil
+}
+
+type RouteAck struct {
+	Sequence uint64 `protobuf:"varint,1,opt,name=sequence" json:"sequence,omitempty"`
+	Code     uint32 `protobuf:"varint,2,opt,name=code" json:"code,omitempty"`
+	Error    string `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *RouteAck) Reset()         { *m = RouteAck{} }
+func (m *RouteAck) String() string { return proto.CompactTextString(m) }
+func (*RouteAck) ProtoMessage()    {}
+
 func init() {
 }
 
@@ -50,6 +83,7 @@ func init() {
 
 type BrokerClient interface {
 	Route(ctx context.Context, in *RouteRequest, opts ...grpc.CallOption) (*RouteReply, error)
+	RouteStream(ctx context.Context, opts ...grpc.CallOption) (Broker_RouteStreamClient, error)
 }
 
 type brokerClient struct {
@@ -69,10 +103,42 @@ func (c *brokerClient) Route(ctx context.Context, in *RouteRequest, opts ...grpc
 	return out, nil
 }
 
+func (c *brokerClient) RouteStream(ctx context.Context, opts ...grpc.CallOption) (Broker_RouteStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Broker_serviceDesc.Streams[0], c.cc, "/messagebroker.Broker/RouteStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &brokerRouteStreamClient{stream}
+	return x, nil
+}
+
+type Broker_RouteStreamClient interface {
+	Send(*StreamRequest) error
+	Recv() (*RouteAck, error)
+	grpc.ClientStream
+}
+
+type brokerRouteStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *brokerRouteStreamClient) Send(m *StreamRequest) error {
+	return x.ClientStream.SendProto(m)
+}
+
+func (x *brokerRouteStreamClient) Recv() (*RouteAck, error) {
+	m := new(RouteAck)
+	if err := x.ClientStream.RecvProto(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Server API for Broker service
 
 type BrokerServer interface {
 	Route(context.Context, *RouteRequest) (*RouteReply, error)
+	RouteStream(Broker_RouteStreamServer) error
 }
 
 func RegisterBrokerServer(s *grpc.Server, srv BrokerServer) {
@@ -91,6 +157,32 @@ func _Broker_Route_Handler(srv interface{}, ctx context.Context, buf []byte) (pr
 	return out, nil
 }
 
+func _Broker_RouteStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BrokerServer).RouteStream(&brokerRouteStreamServer{stream})
+}
+
+type Broker_RouteStreamServer interface {
+	Send(*RouteAck) error
+	Recv() (*StreamRequest, error)
+	grpc.ServerStream
+}
+
+type brokerRouteStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *brokerRouteStreamServer) Send(m *RouteAck) error {
+	return x.ServerStream.SendProto(m)
+}
+
+func (x *brokerRouteStreamServer) Recv() (*StreamRequest, error) {
+	m := new(StreamRequest)
+	if err := x.ServerStream.RecvProto(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _Broker_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "messagebroker.Broker",
 	HandlerType: (*BrokerServer)(nil),
@@ -100,5 +192,12 @@ var _Broker_serviceDesc = grpc.ServiceDesc{
 			Handler:    _Broker_Route_Handler,
 		},
 	},
-	Streams: []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "RouteStream",
+			Handler:       _Broker_RouteStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
 }
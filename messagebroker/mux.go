@@ -0,0 +1,361 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package messagebroker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
+	"github.com/protogalaxy/service-socket/metrics"
+)
+
+var (
+	openStreams    = metrics.NewGauge("socket_broker_streams", "Number of open broker route streams.")
+	unaryFallbacks = metrics.NewCounter("socket_broker_unary_fallbacks_total", "Total number of messages routed by unary calls because the broker doesn't support streaming.")
+)
+
+// ErrMuxClosed is returned for messages routed after the mux is closed.
+var ErrMuxClosed = errors.New("broker mux closed")
+
+// Mux is a BrokerClient that routes the messages of all the local sockets
+// over a small pool of long-lived RouteStream streams. Every message waits
+// for its acknowledgement. While the broker doesn't support streaming the
+// messages are routed by unary Route calls.
+type Mux struct {
+	Client BrokerClient
+	// Streams is the number of streams in the pool.
+	Streams int
+	// Window limits the number of unacknowledged messages per stream.
+	Window int
+	// RetryStreaming is the delay before trying to open a stream again after
+	// the broker rejected streaming.
+	RetryStreaming time.Duration
+
+	mu          sync.Mutex
+	pool        []poolSlot
+	next        int
+	unsupported time.Time
+	closed      bool
+}
+
+// NewMux creates a mux with a pool of streams over the client.
+func NewMux(client BrokerClient, streams, window int) *Mux {
+	return &Mux{
+		Client:         client,
+		Streams:        streams,
+		Window:         window,
+		RetryStreaming: time.Minute,
+	}
+}
+
+// Route implements the BrokerClient interface. The message is sent over one
+// of the streams and the call returns once the broker acknowledges it.
+func (m *Mux) Route(ctx context.Context, in *RouteRequest, opts ...grpc.CallOption) (*RouteReply, error) {
+	s, err := m.stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		unaryFallbacks.Inc()
+		return m.Client.Route(ctx, in, opts...)
+	}
+	err = s.route(ctx, in)
+	if grpc.Code(err) == codes.Unimplemented && m.rejectStreaming(s) {
+		// The broker never saw the message so it is safe to send it again.
+		unaryFallbacks.Inc()
+		return m.Client.Route(ctx, in, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &RouteReply{}, nil
+}
+
+// RouteStream implements the BrokerClient interface.
+func (m *Mux) RouteStream(ctx context.Context, opts ...grpc.CallOption) (Broker_RouteStreamClient, error) {
+	return m.Client.RouteStream(ctx, opts...)
+}
+
+// poolSlot holds a stream of the pool. While the stream is being opened
+// opening is closed once the attempt finishes.
+type poolSlot struct {
+	stream  *routeStream
+	opening chan struct{}
+}
+
+// stream returns the next stream from the pool opening it if needed. A nil
+// stream is returned if the messages should be routed by unary calls. The
+// lock is not held while a stream is opened so the callers waiting for it
+// give up once their context is done.
+func (m *Mux) stream(ctx context.Context) (*routeStream, error) {
+	i := -1
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, ErrMuxClosed
+		}
+		if m.Streams <= 0 || time.Now().Before(m.unsupported) {
+			m.mu.Unlock()
+			return nil, nil
+		}
+		if m.pool == nil {
+			m.pool = make([]poolSlot, m.Streams)
+		}
+		if i < 0 {
+			i = m.next
+			m.next = (m.next + 1) % len(m.pool)
+		}
+		slot := &m.pool[i]
+		if s := slot.stream; s != nil && !s.broken() {
+			m.mu.Unlock()
+			return s, nil
+		}
+		if opening := slot.opening; opening != nil {
+			m.mu.Unlock()
+			select {
+			case <-opening:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		opening := make(chan struct{})
+		slot.stream = nil
+		slot.opening = opening
+		m.mu.Unlock()
+
+		s, err := m.open()
+
+		m.mu.Lock()
+		slot.opening = nil
+		close(opening)
+		if m.closed {
+			m.mu.Unlock()
+			if s != nil {
+				s.close(ErrMuxClosed)
+			}
+			return nil, ErrMuxClosed
+		}
+		if err != nil {
+			m.mu.Unlock()
+			glog.Warningf("Could not open broker stream: %s", err)
+			return nil, err
+		}
+		slot.stream = s
+		m.mu.Unlock()
+		return s, nil
+	}
+}
+
+// open opens a new stream.
+func (m *Mux) open() (*routeStream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := m.Client.RouteStream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	window := m.Window
+	if window <= 0 {
+		window = 1
+	}
+	s := &routeStream{
+		client:  client,
+		cancel:  cancel,
+		window:  make(chan struct{}, window),
+		sending: make(chan struct{}, 1),
+		pending: make(map[uint64]chan error),
+		done:    make(chan struct{}),
+	}
+	openStreams.Inc()
+	go s.receive()
+	return s, nil
+}
+
+// rejectStreaming switches to unary calls after the broker rejected the
+// stream as unimplemented. It returns true if the mux no longer streams.
+func (m *Mux) rejectStreaming(s *routeStream) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false
+	}
+	if time.Now().After(m.unsupported) {
+		glog.Warningf("Broker doesn't support streaming, falling back to unary calls")
+		m.unsupported = time.Now().Add(m.RetryStreaming)
+	}
+	for i := range m.pool {
+		if m.pool[i].stream == s {
+			m.pool[i].stream = nil
+		}
+	}
+	return true
+}
+
+// Close closes all the streams. Messages waiting for acknowledgement fail.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for _, slot := range m.pool {
+		if slot.stream != nil {
+			slot.stream.close(ErrMuxClosed)
+		}
+	}
+	m.pool = nil
+	return nil
+}
+
+// routeStream is a single stream of the pool.
+type routeStream struct {
+	client Broker_RouteStreamClient
+	cancel context.CancelFunc
+	// window holds a token for every unacknowledged message and sending
+	// holds a token while a message is sent.
+	window  chan struct{}
+	sending chan struct{}
+
+	mu       sync.Mutex
+	sequence uint64
+	pending  map[uint64]chan error
+	err      error
+	done     chan struct{}
+}
+
+// route sends the message and waits for its acknowledgement.
+func (s *routeStream) route(ctx context.Context, in *RouteRequest) error {
+	select {
+	case s.window <- struct{}{}:
+	case <-s.done:
+		return s.error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.window }()
+
+	ack := make(chan error, 1)
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	s.sequence++
+	seq := s.sequence
+	s.pending[seq] = ack
+	s.mu.Unlock()
+	defer s.forget(seq)
+
+	select {
+	case s.sending <- struct{}{}:
+	case <-s.done:
+		return s.error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	err := s.client.Send(&StreamRequest{Sequence: seq, Request: in})
+	<-s.sending
+	if err != nil {
+		s.close(err)
+		return err
+	}
+
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *routeStream) forget(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, seq)
+}
+
+// receive delivers the acknowledgements until the stream breaks.
+func (s *routeStream) receive() {
+	for {
+		ack, err := s.client.Recv()
+		if err != nil {
+			s.close(err)
+			return
+		}
+		s.mu.Lock()
+		c, ok := s.pending[ack.Sequence]
+		delete(s.pending, ack.Sequence)
+		s.mu.Unlock()
+		if !ok {
+			glog.V(2).Infof("Ack for unknown message %d", ack.Sequence)
+			continue
+		}
+		c <- ackError(ack)
+	}
+}
+
+// ackError returns the routing error reported by the acknowledgement.
+func ackError(ack *RouteAck) error {
+	if ack.Code == 0 {
+		return nil
+	}
+	return grpc.Errorf(codes.Code(ack.Code), "%s", ack.Error)
+}
+
+// close breaks the stream failing all the messages waiting for
+// acknowledgement with the error.
+func (s *routeStream) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	if grpc.Code(err) != codes.Unimplemented {
+		glog.Warningf("Broker stream closed: %s", err)
+	}
+	s.err = err
+	for seq, c := range s.pending {
+		c <- err
+		delete(s.pending, seq)
+	}
+	close(s.done)
+	openStreams.Dec()
+
+	// Half-close the stream so the broker finishes it. The stream is
+	// cancelled in case a send is stuck.
+	go func() {
+		t := time.AfterFunc(time.Second, s.cancel)
+		s.sending <- struct{}{}
+		s.client.CloseSend()
+		<-s.sending
+		t.Stop()
+		s.cancel()
+	}()
+}
+
+func (s *routeStream) broken() bool {
+	return s.error() != nil
+}
+
+func (s *routeStream) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
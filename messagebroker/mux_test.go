@@ -0,0 +1,288 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package messagebroker_test
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/protobuf/proto"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
+	"github.com/protogalaxy/service-socket/messagebroker"
+)
+
+// fakeBroker acknowledges every streamed message and records how the
+// messages were routed.
+type fakeBroker struct {
+	mu       sync.Mutex
+	unary    []string
+	streamed []string
+	streams  int
+}
+
+func (b *fakeBroker) Route(ctx context.Context, req *messagebroker.RouteRequest) (*messagebroker.RouteReply, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unary = append(b.unary, string(req.Data))
+	return &messagebroker.RouteReply{}, nil
+}
+
+func (b *fakeBroker) RouteStream(stream messagebroker.Broker_RouteStreamServer) error {
+	b.mu.Lock()
+	b.streams++
+	b.mu.Unlock()
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		ack := &messagebroker.RouteAck{Sequence: req.Sequence}
+		if string(req.Request.Data) == "reject" {
+			ack.Code = uint32(codes.InvalidArgument)
+			ack.Error = "rejected"
+		} else {
+			b.mu.Lock()
+			b.streamed = append(b.streamed, string(req.Request.Data))
+			b.mu.Unlock()
+		}
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// unaryBroker describes a broker service that doesn't support streaming.
+var unaryBroker = grpc.ServiceDesc{
+	ServiceName: "messagebroker.Broker",
+	HandlerType: (*messagebroker.BrokerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Route",
+			Handler: func(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+				in := new(messagebroker.RouteRequest)
+				if err := proto.Unmarshal(buf, in); err != nil {
+					return nil, err
+				}
+				return srv.(messagebroker.BrokerServer).Route(ctx, in)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func serve(t *testing.T, broker *fakeBroker, streaming bool) (messagebroker.BrokerClient, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening should not fail but got: %s", err)
+	}
+	s := grpc.NewServer()
+	if streaming {
+		messagebroker.RegisterBrokerServer(s, broker)
+	} else {
+		s.RegisterService(&unaryBroker, broker)
+	}
+	go s.Serve(l)
+	cc, err := grpc.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dialing should not fail but got: %s", err)
+	}
+	return messagebroker.NewBrokerClient(cc), func() {
+		cc.Close()
+		s.Stop()
+	}
+}
+
+func route(t *testing.T, mux *messagebroker.Mux, data string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := mux.Route(ctx, &messagebroker.RouteRequest{Data: []byte(data)})
+	return err
+}
+
+func TestMuxRoutesOverStreams(t *testing.T) {
+	broker := &fakeBroker{}
+	client, stop := serve(t, broker, true)
+	defer stop()
+	mux := messagebroker.NewMux(client, 2, 8)
+	defer mux.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := route(t, mux, "abc"); err != nil {
+				t.Errorf("Routing should not fail but got: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if len(broker.streamed) != 20 || len(broker.unary) != 0 {
+		t.Errorf("Expected all messages to be streamed but got %d streamed and %d unary", len(broker.streamed), len(broker.unary))
+	}
+	if broker.streams != 2 {
+		t.Errorf("Expected 2 streams but got %d", broker.streams)
+	}
+}
+
+func TestMuxReportsAckErrors(t *testing.T) {
+	broker := &fakeBroker{}
+	client, stop := serve(t, broker, true)
+	defer stop()
+	mux := messagebroker.NewMux(client, 1, 1)
+	defer mux.Close()
+
+	if err := route(t, mux, "reject"); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected the error from the ack but got: %v", err)
+	}
+	if err := route(t, mux, "abc"); err != nil {
+		t.Errorf("Stream should still be usable but got: %s", err)
+	}
+}
+
+func TestMuxFallsBackToUnary(t *testing.T) {
+	broker := &fakeBroker{}
+	client, stop := serve(t, broker, false)
+	defer stop()
+	mux := messagebroker.NewMux(client, 2, 8)
+	defer mux.Close()
+
+	for _, data := range []string{"a", "b", "c"} {
+		if err := route(t, mux, data); err != nil {
+			t.Fatalf("Routing should not fail but got: %s", err)
+		}
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if len(broker.unary) != 3 || broker.unary[0] != "a" || broker.unary[2] != "c" {
+		t.Errorf("Expected all messages to be routed by unary calls but got: %v", broker.unary)
+	}
+}
+
+func TestMuxClosed(t *testing.T) {
+	broker := &fakeBroker{}
+	client, stop := serve(t, broker, true)
+	defer stop()
+	mux := messagebroker.NewMux(client, 1, 1)
+	if err := route(t, mux, "abc"); err != nil {
+		t.Fatalf("Routing should not fail but got: %s", err)
+	}
+	mux.Close()
+	if err := route(t, mux, "abc"); err != messagebroker.ErrMuxClosed {
+		t.Errorf("Expected closed mux error but got: %v", err)
+	}
+}
+
+// gatedClient holds up opening the streams and sending the messages until the
+// gates are closed.
+type gatedClient struct {
+	messagebroker.BrokerClient
+	dial chan struct{}
+	send chan struct{}
+}
+
+func (c *gatedClient) RouteStream(ctx context.Context, opts ...grpc.CallOption) (messagebroker.Broker_RouteStreamClient, error) {
+	<-c.dial
+	stream, err := c.BrokerClient.RouteStream(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedStream{stream, c.send}, nil
+}
+
+type gatedStream struct {
+	messagebroker.Broker_RouteStreamClient
+	send chan struct{}
+}
+
+func (s *gatedStream) Send(req *messagebroker.StreamRequest) error {
+	<-s.send
+	return s.Broker_RouteStreamClient.Send(req)
+}
+
+// routeAsync routes the message in the background and returns the channel
+// receiving the result.
+func routeAsync(t *testing.T, mux *messagebroker.Mux, data string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- route(t, mux, data)
+	}()
+	return result
+}
+
+func TestMuxDoesNotBlockWhileOpening(t *testing.T) {
+	broker := &fakeBroker{}
+	client, stop := serve(t, broker, true)
+	defer stop()
+	gated := &gatedClient{client, make(chan struct{}), make(chan struct{})}
+	close(gated.send)
+	mux := messagebroker.NewMux(gated, 1, 8)
+
+	first := routeAsync(t, mux, "a")
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := mux.Route(ctx, &messagebroker.RouteRequest{Data: []byte("b")}); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded while the stream opens but got: %v", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		mux.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Closing the mux should not wait for the stream to open")
+	}
+	close(gated.dial)
+	if err := <-first; err != messagebroker.ErrMuxClosed {
+		t.Errorf("Expected closed mux error but got: %v", err)
+	}
+}
+
+func TestMuxSendHonorsContext(t *testing.T) {
+	broker := &fakeBroker{}
+	client, stop := serve(t, broker, true)
+	defer stop()
+	gated := &gatedClient{client, make(chan struct{}), make(chan struct{})}
+	close(gated.dial)
+	mux := messagebroker.NewMux(gated, 1, 8)
+	defer mux.Close()
+
+	first := routeAsync(t, mux, "a")
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := mux.Route(ctx, &messagebroker.RouteRequest{Data: []byte("b")}); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded while another message is sent but got: %v", err)
+	}
+	close(gated.send)
+	if err := <-first; err != nil {
+		t.Errorf("Routing should not fail but got: %s", err)
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package metrics implements counters, gauges and histograms that are exposed
+// over HTTP in the Prometheus text format.
+//
+// Metrics are created once, usually as package level variables, and are
+// registered in the DefaultRegistry.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefBuckets are the default histogram buckets in seconds suited for
+// measuring the latency of network calls.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric family that can write itself in the text format.
+type collector interface {
+	name() string
+	write(buf *bytes.Buffer)
+}
+
+// Registry holds the metrics exposed by a Handler.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// DefaultRegistry is the registry used by the package level constructors.
+var DefaultRegistry = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.collectors[c.name()]; ok {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	r.collectors[c.name()] = c
+}
+
+// WriteTo writes all the registered metrics sorted by name.
+func (r *Registry) WriteTo(buf *bytes.Buffer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make(map[string]collector, len(r.collectors))
+	for name, c := range r.collectors {
+		collectors[name] = c
+	}
+	r.mu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		collectors[name].write(buf)
+	}
+}
+
+// Handler returns a handler serving the registered metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		r.WriteTo(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
+
+// Handler returns a handler serving the metrics of the DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+// desc describes a metric family.
+type desc struct {
+	fqName string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.fqName
+}
+
+func (d *desc) writeHeader(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", d.fqName, escapeHelp(d.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", d.fqName, d.typ)
+}
+
+// labelPairs formats the label names with their values. Extra name and value
+// pairs are appended at the end.
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, v := range values {
+		pairs = append(pairs, d.labels[i]+`="`+escapeLabel(v)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v int64
+}
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+// Add adds n to the gauge.
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+// Set sets the gauge to n.
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// ObserveSince observes the number of seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(buf *bytes.Buffer, d *desc, values []string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", d.fqName, d.labelPairs(values, "le", formatFloat(upper)), cumulative)
+	}
+	fmt.Fprintf(buf, "%s_bucket%s %d\n", d.fqName, d.labelPairs(values, "le", "+Inf"), count)
+	fmt.Fprintf(buf, "%s_sum%s %s\n", d.fqName, d.labelPairs(values), formatFloat(sum))
+	fmt.Fprintf(buf, "%s_count%s %d\n", d.fqName, d.labelPairs(values), count)
+}
+
+// family is a metric family with a child metric per label value combination.
+type family struct {
+	desc
+	mu       sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string
+	newChild func() interface{}
+}
+
+func newFamily(d desc, newChild func() interface{}) *family {
+	return &family{
+		desc:     d,
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+		newChild: newChild,
+	}
+}
+
+// with returns the child for the label values creating it if needed.
+func (f *family) with(values []string) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.fqName, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.children[key]
+	if !ok {
+		c = f.newChild()
+		f.children[key] = c
+		f.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+func (f *family) write(buf *bytes.Buffer) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.children))
+	for key := range f.children {
+		keys = append(keys, key)
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	f.writeHeader(buf)
+	for _, key := range keys {
+		f.mu.Lock()
+		c, values := f.children[key], f.values[key]
+		f.mu.Unlock()
+		switch c := c.(type) {
+		case *Counter:
+			fmt.Fprintf(buf, "%s%s %d\n", f.fqName, f.labelPairs(values), c.Value())
+		case *Gauge:
+			fmt.Fprintf(buf, "%s%s %d\n", f.fqName, f.labelPairs(values), c.Value())
+		case *Histogram:
+			c.write(buf, &f.desc, values)
+		}
+	}
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	f *family
+}
+
+// With returns the counter for the label values.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.with(values).(*Counter)
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	f *family
+}
+
+// With returns the gauge for the label values.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.f.with(values).(*Gauge)
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	f *family
+}
+
+// With returns the histogram for the label values.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.f.with(values).(*Histogram)
+}
+
+// NewCounterVec creates a counter family in the registry.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	f := newFamily(desc{name, help, "counter", labels}, func() interface{} { return &Counter{} })
+	r.register(f)
+	return &CounterVec{f}
+}
+
+// NewGaugeVec creates a gauge family in the registry.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	f := newFamily(desc{name, help, "gauge", labels}, func() interface{} { return &Gauge{} })
+	r.register(f)
+	return &GaugeVec{f}
+}
+
+// NewHistogramVec creates a histogram family in the registry. The buckets
+// must be sorted in increasing order, DefBuckets are used if none are given.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	f := newFamily(desc{name, help, "histogram", labels}, func() interface{} { return newHistogram(buckets) })
+	r.register(f)
+	return &HistogramVec{f}
+}
+
+// NewCounter creates a counter without labels in the registry.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+// NewGauge creates a gauge without labels in the registry.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// NewHistogram creates a histogram without labels in the registry.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+// NewCounter creates a counter in the DefaultRegistry.
+func NewCounter(name, help string) *Counter {
+	return DefaultRegistry.NewCounter(name, help)
+}
+
+// NewCounterVec creates a counter family in the DefaultRegistry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+// NewGauge creates a gauge in the DefaultRegistry.
+func NewGauge(name, help string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help)
+}
+
+// NewGaugeVec creates a gauge family in the DefaultRegistry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return DefaultRegistry.NewGaugeVec(name, help, labels...)
+}
+
+// NewHistogram creates a histogram in the DefaultRegistry.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return DefaultRegistry.NewHistogram(name, help, buckets)
+}
+
+// NewHistogramVec creates a histogram family in the DefaultRegistry.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package metrics_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/protogalaxy/service-socket/metrics"
+)
+
+func expose(r *metrics.Registry) string {
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	return buf.String()
+}
+
+func TestCounterAndGauge(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := r.NewCounter("requests_total", "Total requests.")
+	g := r.NewGauge("active", "Active things.")
+	c.Inc()
+	c.Add(2)
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	expected := `# HELP active Active things.
+# TYPE active gauge
+active 1
+# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total 3
+`
+	if out := expose(r); out != expected {
+		t.Errorf("Unexpected output:\n%s", out)
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	r := metrics.NewRegistry()
+	v := r.NewCounterVec("dropped_total", "Dropped.", "reason")
+	v.With("queue_full").Inc()
+	v.With("not_found").Add(2)
+	v.With("queue_full").Inc()
+	v.With(`a"b\c`).Inc()
+
+	expected := `# HELP dropped_total Dropped.
+# TYPE dropped_total counter
+dropped_total{reason="a\"b\\c"} 1
+dropped_total{reason="not_found"} 2
+dropped_total{reason="queue_full"} 2
+`
+	if out := expose(r); out != expected {
+		t.Errorf("Unexpected output:\n%s", out)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "method")
+	h.With("Route").Observe(0.05)
+	h.With("Route").Observe(0.5)
+	h.With("Route").Observe(2)
+
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="Route",le="0.1"} 1
+latency_seconds_bucket{method="Route",le="1"} 2
+latency_seconds_bucket{method="Route",le="+Inf"} 3
+latency_seconds_sum{method="Route"} 2.55
+latency_seconds_count{method="Route"} 3
+`
+	if out := expose(r); out != expected {
+		t.Errorf("Unexpected output:\n%s", out)
+	}
+}
+
+func TestDuplicateMetricPanics(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounter("dup", "Duplicate.")
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a duplicate metric should panic")
+		}
+	}()
+	r.NewGauge("dup", "Duplicate.")
+}
+
+func TestHandler(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounter("hits_total", "Hits.").Inc()
+
+	srv := httptest.NewServer(r.Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request should not fail but got: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), "hits_total 1\n") {
+		t.Errorf("Unexpected body:\n%s", body)
+	}
+}
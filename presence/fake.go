@@ -0,0 +1,132 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package presence
+
+import (
+	"sync"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/devicepresence"
+)
+
+var _ devicepresence.PresenceManagerServer = (*FakeServer)(nil)
+
+// FakeServer is an in-memory PresenceManagerServer meant for tests.
+// Online devices are considered offline once their leases expire.
+type FakeServer struct {
+	// Now returns the current time. If not set time.Now is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	devices map[string]fakeDevice
+}
+
+type fakeDevice struct {
+	device    devicepresence.Device
+	gatewayID string
+	expires   time.Time
+}
+
+// NewFakeServer constructs a new FakeServer without any online devices.
+func NewFakeServer() *FakeServer {
+	return &FakeServer{
+		devices: make(map[string]fakeDevice),
+	}
+}
+
+func (s *FakeServer) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// SetStatus implements the PresenceManagerServer interface.
+func (s *FakeServer) SetStatus(ctx context.Context, req *devicepresence.StatusRequest) (*devicepresence.StatusReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.Device.Status == devicepresence.Device_OFFLINE {
+		delete(s.devices, req.Device.Id)
+		return &devicepresence.StatusReply{}, nil
+	}
+	d := fakeDevice{
+		device:    *req.Device,
+		gatewayID: req.GatewayId,
+	}
+	if req.LeaseSeconds > 0 {
+		d.expires = s.now().Add(time.Duration(req.LeaseSeconds) * time.Second)
+	}
+	s.devices[req.Device.Id] = d
+	return &devicepresence.StatusReply{}, nil
+}
+
+// RenewLeases implements the PresenceManagerServer interface.
+func (s *FakeServer) RenewLeases(ctx context.Context, req *devicepresence.LeaseRequest) (*devicepresence.LeaseReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply := &devicepresence.LeaseReply{}
+	for _, id := range req.DeviceIds {
+		d, ok := s.device(id)
+		if !ok {
+			reply.ExpiredDeviceIds = append(reply.ExpiredDeviceIds, id)
+			continue
+		}
+		if req.LeaseSeconds > 0 {
+			d.expires = s.now().Add(time.Duration(req.LeaseSeconds) * time.Second)
+		}
+		s.devices[id] = d
+	}
+	return reply, nil
+}
+
+// Device returns the device if it is online.
+func (s *FakeServer) Device(id string) (devicepresence.Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.device(id)
+	return d.device, ok
+}
+
+// device returns the device if it is online removing it if its lease expired.
+func (s *FakeServer) device(id string) (fakeDevice, bool) {
+	d, ok := s.devices[id]
+	if !ok {
+		return d, false
+	}
+	if !d.expires.IsZero() && !s.now().Before(d.expires) {
+		delete(s.devices, id)
+		return d, false
+	}
+	return d, true
+}
+
+// Client returns a PresenceManagerClient that calls the server directly.
+func (s *FakeServer) Client() devicepresence.PresenceManagerClient {
+	return fakeClient{s}
+}
+
+type fakeClient struct {
+	s *FakeServer
+}
+
+func (c fakeClient) SetStatus(ctx context.Context, in *devicepresence.StatusRequest, opts ...grpc.CallOption) (*devicepresence.StatusReply, error) {
+	return c.s.SetStatus(ctx, in)
+}
+
+func (c fakeClient) RenewLeases(ctx context.Context, in *devicepresence.LeaseRequest, opts ...grpc.CallOption) (*devicepresence.LeaseReply, error) {
+	return c.s.RenewLeases(ctx, in)
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package presence
+
+import (
+	"sync"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/devicepresence"
+)
+
+// LeaseRenewer keeps the leases of the gateway's online devices alive by
+// periodically renewing them with the presence service in batches.
+// If the gateway disappears the leases expire and the presence service can
+// mark the devices offline.
+type LeaseRenewer struct {
+	Client    devicepresence.PresenceManagerClient
+	GatewayID string
+
+	// Interval is the time between two lease renewals.
+	Interval time.Duration
+	// Lease is the lease duration requested from the presence service.
+	// It should span multiple renewal intervals.
+	Lease time.Duration
+	// BatchSize is the maximum number of devices renewed by a single call.
+	BatchSize int
+	// Timeout limits the duration of a single call to the presence service.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	devices map[string]devicepresence.Device
+	// restoring holds the cancel functions of the devices being set online
+	// again. Remove waits on restored until the device is no longer restored.
+	restoring map[string]context.CancelFunc
+	restored  *sync.Cond
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewLeaseRenewer constructs a new LeaseRenewer that renews the leases every
+// interval. The lease duration is set to three intervals.
+func NewLeaseRenewer(client devicepresence.PresenceManagerClient, gatewayID string, interval time.Duration) *LeaseRenewer {
+	r := &LeaseRenewer{
+		Client:    client,
+		GatewayID: gatewayID,
+		Interval:  interval,
+		Lease:     3 * interval,
+		BatchSize: 500,
+		Timeout:   interval,
+		devices:   make(map[string]devicepresence.Device),
+		restoring: make(map[string]context.CancelFunc),
+		done:      make(chan struct{}),
+	}
+	r.restored = sync.NewCond(&r.mu)
+	return r
+}
+
+// LeaseSeconds returns the lease duration that should be requested when
+// setting the device online. The lease is rounded up to whole seconds as a
+// lease of zero seconds never expires.
+func (r *LeaseRenewer) LeaseSeconds() int64 {
+	return int64((r.Lease + time.Second - 1) / time.Second)
+}
+
+// Add starts renewing the lease of the online device.
+func (r *LeaseRenewer) Add(d devicepresence.Device) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devices[d.Id] = d
+}
+
+// Remove stops renewing the lease of the device. If the device is being set
+// online again at the moment the call is canceled and Remove waits for it to
+// return so the device can be set offline afterwards.
+func (r *LeaseRenewer) Remove(deviceID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.devices, deviceID)
+	for {
+		cancel, ok := r.restoring[deviceID]
+		if !ok {
+			return
+		}
+		cancel()
+		r.restored.Wait()
+	}
+}
+
+// Run renews the leases every interval until the renewer is closed.
+// The method blocks and is normally run in a goroutine.
+func (r *LeaseRenewer) Run() {
+	t := time.NewTicker(r.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			glog.Info("Stopping lease renewal")
+			return
+		case <-t.C:
+			r.renew()
+		}
+	}
+}
+
+// Close implements the Closer interface.
+func (r *LeaseRenewer) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return nil
+}
+
+// renew renews the leases of all the devices in batches. Devices whose
+// leases already expired are set online again.
+func (r *LeaseRenewer) renew() {
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.devices))
+	for id := range r.devices {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+
+	for len(ids) > 0 {
+		n := r.BatchSize
+		if n <= 0 || n > len(ids) {
+			n = len(ids)
+		}
+		r.renewBatch(ids[:n])
+		ids = ids[n:]
+	}
+}
+
+func (r *LeaseRenewer) renewBatch(ids []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	reply, err := r.Client.RenewLeases(ctx, &devicepresence.LeaseRequest{
+		GatewayId:    r.GatewayID,
+		DeviceIds:    ids,
+		LeaseSeconds: r.LeaseSeconds(),
+	})
+	if err != nil {
+		glog.Errorf("Problem renewing %d device leases: %s", len(ids), err)
+		return
+	}
+	glog.V(3).Infof("Renewed %d device leases", len(ids)-len(reply.ExpiredDeviceIds))
+	for _, id := range reply.ExpiredDeviceIds {
+		r.restore(id)
+	}
+}
+
+// restore sets the device with an expired lease online again if it is
+// still connected.
+func (r *LeaseRenewer) restore(deviceID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	r.mu.Lock()
+	d, ok := r.devices[deviceID]
+	if ok {
+		r.restoring[deviceID] = cancel
+	}
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	defer func() {
+		r.mu.Lock()
+		delete(r.restoring, deviceID)
+		r.restored.Broadcast()
+		r.mu.Unlock()
+	}()
+	glog.Warningf("Lease of device %s expired, setting it online again", deviceID)
+	d.Status = devicepresence.Device_ONLINE
+	_, err := r.Client.SetStatus(ctx, &devicepresence.StatusRequest{
+		Device:       &d,
+		LeaseSeconds: r.LeaseSeconds(),
+		GatewayId:    r.GatewayID,
+	})
+	if err != nil {
+		glog.Errorf("Problem setting device %s online: %s", deviceID, err)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package presence
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/devicepresence"
+)
+
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func setOnline(t *testing.T, s *FakeServer, id string, lease int64) devicepresence.Device {
+	d := devicepresence.Device{
+		Id:     id,
+		UserId: "user1",
+		Status: devicepresence.Device_ONLINE,
+	}
+	_, err := s.SetStatus(context.Background(), &devicepresence.StatusRequest{
+		Device:       &d,
+		LeaseSeconds: lease,
+	})
+	if err != nil {
+		t.Fatalf("Setting status should not fail but got: %s", err)
+	}
+	return d
+}
+
+func TestFakeServerLeaseExpires(t *testing.T) {
+	c := &clock{now: time.Unix(1000, 0)}
+	s := NewFakeServer()
+	s.Now = c.Now
+	setOnline(t, s, "a", 10)
+	setOnline(t, s, "b", 0)
+
+	c.Advance(10 * time.Second)
+	if _, ok := s.Device("a"); ok {
+		t.Error("Device with an expired lease should be offline")
+	}
+	if _, ok := s.Device("b"); !ok {
+		t.Error("Device without a lease should stay online")
+	}
+}
+
+func TestLeaseRenewerRenewsLeases(t *testing.T) {
+	c := &clock{now: time.Unix(1000, 0)}
+	s := NewFakeServer()
+	s.Now = c.Now
+	r := NewLeaseRenewer(s.Client(), "gw1", 10*time.Second)
+	r.BatchSize = 2
+	for _, id := range []string{"a", "b", "c"} {
+		r.Add(setOnline(t, s, id, r.LeaseSeconds()))
+	}
+	r.Remove("c")
+
+	c.Advance(20 * time.Second)
+	r.renew()
+	c.Advance(20 * time.Second)
+
+	for _, id := range []string{"a", "b"} {
+		if _, ok := s.Device(id); !ok {
+			t.Errorf("Lease of device %s should be renewed", id)
+		}
+	}
+	if _, ok := s.Device("c"); ok {
+		t.Error("Lease of removed device should not be renewed")
+	}
+}
+
+func TestLeaseRenewerRestoresExpiredDevices(t *testing.T) {
+	s := NewFakeServer()
+	r := NewLeaseRenewer(s.Client(), "gw1", 10*time.Second)
+	r.Add(devicepresence.Device{
+		Id:     "a",
+		UserId: "user1",
+		Status: devicepresence.Device_ONLINE,
+	})
+
+	r.renew()
+
+	d, ok := s.Device("a")
+	if !ok {
+		t.Fatal("Device unknown to the presence service should be set online")
+	}
+	if d.UserId != "user1" {
+		t.Errorf("Unexpected user id: %s", d.UserId)
+	}
+}
+
+func TestLeaseRenewerClose(t *testing.T) {
+	r := NewLeaseRenewer(NewFakeServer().Client(), "gw1", time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		r.Run()
+		close(done)
+	}()
+	r.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Millisecond):
+		t.Fatal("Renewer not closing")
+	}
+}
+
+func TestLeaseRenewerLeaseSecondsRoundsUp(t *testing.T) {
+	r := NewLeaseRenewer(NewFakeServer().Client(), "gw1", 100*time.Millisecond)
+	if s := r.LeaseSeconds(); s != 1 {
+		t.Errorf("Expected a lease of 1 second but got %d", s)
+	}
+	r.Lease = 3 * time.Second
+	if s := r.LeaseSeconds(); s != 3 {
+		t.Errorf("Expected a lease of 3 seconds but got %d", s)
+	}
+}
+
+// slowOnlineClient holds up setting the devices online until released or
+// the call is canceled.
+type slowOnlineClient struct {
+	devicepresence.PresenceManagerClient
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *slowOnlineClient) SetStatus(ctx context.Context, in *devicepresence.StatusRequest, opts ...grpc.CallOption) (*devicepresence.StatusReply, error) {
+	if in.Device.Status == devicepresence.Device_ONLINE {
+		close(c.entered)
+		select {
+		case <-c.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return c.PresenceManagerClient.SetStatus(ctx, in, opts...)
+}
+
+func TestLeaseRenewerRemoveCancelsRestore(t *testing.T) {
+	s := NewFakeServer()
+	client := &slowOnlineClient{s.Client(), make(chan struct{}), make(chan struct{})}
+	defer close(client.release)
+	r := NewLeaseRenewer(client, "gw1", time.Minute)
+	d := devicepresence.Device{Id: "a", UserId: "user1"}
+	r.Add(d)
+	go r.renew()
+	<-client.entered
+
+	removed := make(chan struct{})
+	go func() {
+		r.Remove("a")
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("Remove should cancel setting the device online instead of waiting for it")
+	}
+	if _, ok := s.Device("a"); ok {
+		t.Error("Canceled restore should not set the device online")
+	}
+
+	d.Status = devicepresence.Device_OFFLINE
+	client.SetStatus(context.Background(), &devicepresence.StatusRequest{Device: &d})
+	if _, ok := s.Device("a"); ok {
+		t.Error("Device set offline after it was removed should stay offline")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package ratelimit limits the rate of inbound messages with token buckets.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Rate is the rate of a token bucket. Up to Burst tokens are available at once
+// and they are refilled at PerSecond tokens per second. Burst defaults to
+// PerSecond if it is not set. A zero rate is not limited.
+type Rate struct {
+	PerSecond float64
+	Burst     float64
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst <= 0 {
+		return r.PerSecond
+	}
+	return r.Burst
+}
+
+// Limits are the message count and byte rates allowed by a Limiter.
+type Limits struct {
+	Messages Rate
+	Bytes    Rate
+}
+
+// Enabled reports whether any of the rates is limited.
+func (l Limits) Enabled() bool {
+	return l.Messages.PerSecond > 0 || l.Bytes.PerSecond > 0
+}
+
+// bucket is a token bucket. The tokens can go negative when more than the
+// burst is taken at once and the debt is repaid before anything else is
+// allowed.
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = b.rate.burst()
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate.PerSecond
+		if burst := b.rate.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+// put returns n tokens to the bucket without exceeding the burst.
+func (b *bucket) put(n float64) {
+	if b.rate.PerSecond <= 0 {
+		return
+	}
+	b.tokens += n
+	if burst := b.rate.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// wait returns how long to wait until n tokens can be taken. Taking more than
+// the burst only needs a full bucket.
+func (b *bucket) wait(n float64) time.Duration {
+	if b.rate.PerSecond <= 0 {
+		return 0
+	}
+	if burst := b.rate.burst(); n > burst {
+		n = burst
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate.PerSecond * float64(time.Second))
+}
+
+// Limiter limits the rate of messages and their bytes. It is safe for
+// concurrent use.
+type Limiter struct {
+	// Now returns the current time, time.Now is used if nil.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	messages bucket
+	bytes    bucket
+}
+
+// NewLimiter creates a limiter with full buckets.
+func NewLimiter(l Limits) *Limiter {
+	return &Limiter{
+		messages: bucket{rate: l.Messages},
+		bytes:    bucket{rate: l.Bytes},
+	}
+}
+
+func (l *Limiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// Allow takes a message of the given size from the buckets if both of them
+// allow it. Otherwise nothing is taken and the time after which the message
+// would be allowed is returned.
+func (l *Limiter) Allow(size int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.messages.refill(now)
+	l.bytes.refill(now)
+	wait := l.messages.wait(1)
+	if w := l.bytes.wait(float64(size)); w > wait {
+		wait = w
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	if l.messages.rate.PerSecond > 0 {
+		l.messages.tokens--
+	}
+	if l.bytes.rate.PerSecond > 0 {
+		l.bytes.tokens -= float64(size)
+	}
+	return true, 0
+}
+
+// Refund returns a message of the given size taken by Allow to the buckets.
+// It is used when the message is rejected by another limit after all.
+func (l *Limiter) Refund(size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages.put(1)
+	l.bytes.put(float64(size))
+}
+
+// Users shares a Limiter between all the connections of a user. The limiter
+// of a user is kept while any of its connections holds it.
+type Users struct {
+	limits Limits
+
+	mu    sync.Mutex
+	users map[string]*user
+}
+
+type user struct {
+	limiter *Limiter
+	refs    int
+}
+
+// NewUsers creates the per user limiters with the given limits.
+func NewUsers(l Limits) *Users {
+	return &Users{
+		limits: l,
+		users:  make(map[string]*user),
+	}
+}
+
+// Acquire returns the limiter of the user. Every Acquire must be followed by
+// a Release once the connection is done.
+func (u *Users) Acquire(userID string) *Limiter {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usr, ok := u.users[userID]
+	if !ok {
+		usr = &user{limiter: NewLimiter(u.limits)}
+		u.users[userID] = usr
+	}
+	usr.refs++
+	return usr.limiter
+}
+
+// Release releases the user's limiter acquired by a connection.
+func (u *Users) Release(userID string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usr, ok := u.users[userID]
+	if !ok {
+		return
+	}
+	usr.refs--
+	if usr.refs <= 0 {
+		delete(u.users, userID)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/ratelimit"
+)
+
+func TestLimiterMessages(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := ratelimit.NewLimiter(ratelimit.Limits{Messages: ratelimit.Rate{PerSecond: 10, Burst: 2}})
+	l.Now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow(100); !ok {
+			t.Fatalf("Expected message %d within the burst to be allowed", i)
+		}
+	}
+	ok, wait := l.Allow(100)
+	if ok || wait != 100*time.Millisecond {
+		t.Errorf("Expected message to be limited for 100ms but got: %t %s", ok, wait)
+	}
+	now = now.Add(100 * time.Millisecond)
+	if ok, _ := l.Allow(100); !ok {
+		t.Error("Expected message to be allowed after a refill")
+	}
+}
+
+func TestLimiterBytes(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := ratelimit.NewLimiter(ratelimit.Limits{Bytes: ratelimit.Rate{PerSecond: 100}})
+	l.Now = func() time.Time { return now }
+	// A message larger than the burst is allowed with a full bucket.
+	if ok, _ := l.Allow(150); !ok {
+		t.Fatal("Expected large message to be allowed with a full bucket")
+	}
+	ok, wait := l.Allow(10)
+	if ok || wait != 600*time.Millisecond {
+		t.Errorf("Expected the debt to be repaid first but got: %t %s", ok, wait)
+	}
+	now = now.Add(600 * time.Millisecond)
+	if ok, _ := l.Allow(10); !ok {
+		t.Error("Expected message to be allowed after the debt is repaid")
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := ratelimit.NewLimiter(ratelimit.Limits{})
+	for i := 0; i < 1000; i++ {
+		if ok, _ := l.Allow(1 << 20); !ok {
+			t.Fatal("Expected unlimited limiter to allow every message")
+		}
+	}
+}
+
+func TestLimiterRefund(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := ratelimit.NewLimiter(ratelimit.Limits{
+		Messages: ratelimit.Rate{PerSecond: 1},
+		Bytes:    ratelimit.Rate{PerSecond: 100},
+	})
+	l.Now = func() time.Time { return now }
+	if ok, _ := l.Allow(60); !ok {
+		t.Fatal("Expected message to be allowed")
+	}
+	l.Refund(60)
+	if ok, _ := l.Allow(100); !ok {
+		t.Error("Expected the refunded tokens to be available again")
+	}
+	l.Refund(100)
+	l.Refund(100)
+	l.Allow(100)
+	if ok, _ := l.Allow(1); ok {
+		t.Error("Expected refunds not to exceed the burst")
+	}
+}
+
+func TestUsersShareLimiter(t *testing.T) {
+	u := ratelimit.NewUsers(ratelimit.Limits{Messages: ratelimit.Rate{PerSecond: 1}})
+	a, b := u.Acquire("user"), u.Acquire("user")
+	if a != b {
+		t.Fatal("Expected connections of a user to share the limiter")
+	}
+	if other := u.Acquire("other"); other == a {
+		t.Error("Expected users to have separate limiters")
+	}
+	u.Release("user")
+	if c := u.Acquire("user"); c != a {
+		t.Error("Expected limiter to be kept while a connection holds it")
+	}
+	u.Release("user")
+	u.Release("user")
+	if c := u.Acquire("user"); c == a {
+		t.Error("Expected limiter to be dropped once released by all connections")
+	}
+}
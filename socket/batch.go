@@ -0,0 +1,70 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// BatchPrefix is the first byte of a batch frame. A batch frame combines
+// several messages written to a socket into a single frame. Every message
+// follows the prefix as its length, encoded as an unsigned varint, and its
+// data.
+const BatchPrefix byte = 2
+
+// DefaultBatchSize is the default maximum size of a batch frame in bytes.
+// A single message larger than the batch size is still written on its own.
+const DefaultBatchSize = 16 * 1024
+
+// EncodeBatch returns a batch frame combining the messages.
+func EncodeBatch(msgs ...[]byte) []byte {
+	frame := []byte{BatchPrefix}
+	for _, msg := range msgs {
+		frame = appendBatched(frame, msg)
+	}
+	return frame
+}
+
+// appendBatched appends the message to the batch frame.
+func appendBatched(frame, msg []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	frame = append(frame, n[:binary.PutUvarint(n[:], uint64(len(msg)))]...)
+	return append(frame, msg...)
+}
+
+// batchedLen returns the number of bytes the message takes in a batch frame.
+func batchedLen(msg []byte) int {
+	var n [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(n[:], uint64(len(msg))) + len(msg)
+}
+
+// SplitBatch returns the messages combined in the batch frame.
+func SplitBatch(frame []byte) ([][]byte, error) {
+	if len(frame) == 0 || frame[0] != BatchPrefix {
+		return nil, errors.New("not a batch frame")
+	}
+	var msgs [][]byte
+	for rest := frame[1:]; len(rest) > 0; {
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < size {
+			return nil, errors.New("batch frame truncated")
+		}
+		rest = rest[n:]
+		msgs = append(msgs, rest[:size])
+		rest = rest[size:]
+	}
+	return msgs, nil
+}
@@ -0,0 +1,45 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package socket_test
+
+import (
+	"testing"
+
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+func TestSplitBatchErrors(t *testing.T) {
+	tests := [][]byte{
+		nil,
+		{0, 1, 'a'},
+		{socket.BatchPrefix, 3, 'a'},
+		{socket.BatchPrefix, 0x80},
+	}
+	for _, frame := range tests {
+		if _, err := socket.SplitBatch(frame); err == nil {
+			t.Errorf("Splitting %v should fail", frame)
+		}
+	}
+}
+
+func TestSplitBatchEmptyMessages(t *testing.T) {
+	msgs, err := socket.SplitBatch([]byte{socket.BatchPrefix, 0, 1, 'a'})
+	if err != nil {
+		t.Fatalf("Splitting batch should not fail but got: %s", err)
+	}
+	if len(msgs) != 2 || len(msgs[0]) != 0 || string(msgs[1]) != "a" {
+		t.Errorf("Unexpected messages: %q", msgs)
+	}
+}
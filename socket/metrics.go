@@ -0,0 +1,80 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package socket
+
+import (
+	"strconv"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
+	"github.com/protogalaxy/service-socket/metrics"
+)
+
+var (
+	activeSockets   = metrics.NewGauge("socket_active_sockets", "Number of registered sockets.")
+	registrations   = metrics.NewCounter("socket_registrations_total", "Total number of registered sockets.")
+	unregistrations = metrics.NewCounter("socket_unregistrations_total", "Total number of unregistered sockets.")
+
+	messagesRouted  = metrics.NewCounter("socket_messages_routed_total", "Total number of messages put on a socket queue.")
+	messagesDropped = metrics.NewCounterVec("socket_messages_dropped_total", "Total number of messages that could not be routed to a socket.", "reason")
+	queueOverflows  = metrics.NewCounterVec("socket_queue_overflows_total", "Total number of messages routed to a full socket queue by outcome.", "outcome")
+
+	readerMessages = metrics.NewCounter("socket_reader_messages_total", "Total number of messages read from the sockets.")
+	readerBytes    = metrics.NewCounter("socket_reader_bytes_total", "Total number of bytes read from the sockets.")
+	writerMessages = metrics.NewCounter("socket_writer_messages_total", "Total number of messages written to the sockets.")
+	writerBytes    = metrics.NewCounter("socket_writer_bytes_total", "Total number of bytes written to the sockets.")
+	writerBatches  = metrics.NewCounter("socket_writer_batches_total", "Total number of batch frames written to the sockets.")
+
+	senderRequests = metrics.NewCounterVec("socket_sender_requests_total", "Total number of Sender RPCs by method and status code.", "method", "code")
+	senderDuration = metrics.NewHistogramVec("socket_sender_request_duration_seconds", "Latency of the Sender RPCs.", nil, "method")
+)
+
+// dropReason returns the drop reason label for an undelivered status.
+func dropReason(status DeliveryStatus) string {
+	switch status {
+	case QueueFull:
+		return "queue_full"
+	case NotFound:
+		return "not_found"
+	}
+	return "unknown"
+}
+
+var codeNames = map[codes.Code]string{
+	codes.OK:                 "OK",
+	codes.Canceled:           "Canceled",
+	codes.Unknown:            "Unknown",
+	codes.InvalidArgument:    "InvalidArgument",
+	codes.DeadlineExceeded:   "DeadlineExceeded",
+	codes.NotFound:           "NotFound",
+	codes.AlreadyExists:      "AlreadyExists",
+	codes.PermissionDenied:   "PermissionDenied",
+	codes.ResourceExhausted:  "ResourceExhausted",
+	codes.FailedPrecondition: "FailedPrecondition",
+	codes.Aborted:            "Aborted",
+	codes.OutOfRange:         "OutOfRange",
+	codes.Unimplemented:      "Unimplemented",
+	codes.Internal:           "Internal",
+	codes.Unavailable:        "Unavailable",
+	codes.DataLoss:           "DataLoss",
+	codes.Unauthenticated:    "Unauthenticated",
+}
+
+// codeName returns the status code label for the grpc code.
+func codeName(c codes.Code) string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return "Code(" + strconv.Itoa(int(c)) + ")"
+}
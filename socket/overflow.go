@@ -0,0 +1,234 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package socket
+
+import (
+	"fmt"
+	"time"
+)
+
+// OverflowAction selects what happens to a message routed to a socket whose
+// queue is full.
+type OverflowAction int
+
+const (
+	// DropNewest drops the routed message.
+	DropNewest OverflowAction = iota
+	// DropOldest drops the oldest queued message to make room for the routed one.
+	DropOldest
+	// Coalesce replaces the queued message with the same key by the routed
+	// one. The routed message is dropped if there is none.
+	Coalesce
+	// Block waits until there is room in the queue or the timeout expires.
+	// The registry handles no other events while it waits.
+	Block
+	// Disconnect drops the routed message and asks the socket to disconnect.
+	Disconnect
+)
+
+var overflowActionNames = map[OverflowAction]string{
+	DropNewest: "drop_newest",
+	DropOldest: "drop_oldest",
+	Coalesce:   "coalesce",
+	Block:      "block",
+	Disconnect: "disconnect",
+}
+
+func (a OverflowAction) String() string {
+	if name, ok := overflowActionNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("OverflowAction(%d)", int(a))
+}
+
+// ParseOverflowAction returns the action with the given name.
+func ParseOverflowAction(name string) (OverflowAction, error) {
+	for a, n := range overflowActionNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overflow action: %q", name)
+}
+
+// OverflowPolicy is applied when a message is routed to a socket whose queue
+// is full.
+type OverflowPolicy struct {
+	Action OverflowAction
+	// Timeout is how long Block waits for room in the queue.
+	Timeout time.Duration
+	// CloseCode is passed to the socket's Disconnect function.
+	CloseCode int
+}
+
+// DefaultMaxOverflowTimeout is the default maximum time the Block action
+// requested for a single message waits for room in a queue.
+const DefaultMaxOverflowTimeout = 100 * time.Millisecond
+
+// ValidCloseCode reports whether the code can be sent by the Disconnect
+// action. Only the normal closure and the codes reserved for libraries and
+// applications are allowed.
+func ValidCloseCode(code int) bool {
+	return code == 1000 || code >= 3000 && code <= 4999
+}
+
+// queues are the registry's ends of a socket's message channels.
+type queues struct {
+	priorities   [numPriorities]*queue
+	overflow     OverflowPolicy
+	disconnect   func(closeCode int)
+	disconnected bool
+}
+
+// newQueues returns the queues of the registered socket. Priority classes
+// without their own channel share the normal priority channel.
+func newQueues(s Socket) *queues {
+	normal := &queue{messages: s.Messages}
+	q := &queues{
+		priorities: [numPriorities]*queue{normal, normal, normal},
+		overflow:   s.Overflow,
+		disconnect: s.Disconnect,
+	}
+	if s.HighMessages != nil {
+		q.priorities[PriorityHigh] = &queue{messages: s.HighMessages}
+	}
+	if s.LowMessages != nil {
+		q.priorities[PriorityLow] = &queue{messages: s.LowMessages}
+	}
+	return q
+}
+
+// push puts the message on the queue of its priority applying the overflow
+// policy if it is full.
+func (qs *queues) push(data []byte, key string, priority Priority, policy OverflowPolicy) DeliveryStatus {
+	if qs.disconnected {
+		return QueueFull
+	}
+	q := qs.priorities[PriorityNormal]
+	if priority >= 0 && priority < numPriorities {
+		q = qs.priorities[priority]
+	}
+	if q.offer(data, key) {
+		return Delivered
+	}
+	if policy.Action == Disconnect {
+		qs.disconnected = true
+		if qs.disconnect != nil {
+			qs.disconnect(policy.CloseCode)
+		}
+		queueOverflows.With("disconnected").Inc()
+		return QueueFull
+	}
+	return q.overflow(data, key, policy)
+}
+
+// queue is the registry's end of a socket's message channel. The registry
+// must be the only sender on the channel so it can tell which of the messages
+// it sent are still queued.
+type queue struct {
+	messages chan []byte
+	// keys are the keys of the most recently queued messages, oldest first.
+	// Messages are received in order so the last len(messages) of them are
+	// the keys of the messages still in the queue.
+	keys []string
+}
+
+// overflow applies the overflow policy to a message that did not fit in the
+// queue.
+func (q *queue) overflow(data []byte, key string, policy OverflowPolicy) DeliveryStatus {
+	switch policy.Action {
+	case DropOldest:
+		select {
+		case <-q.messages:
+			if q.offer(data, key) {
+				queueOverflows.With("drop_oldest").Inc()
+				return Delivered
+			}
+		default:
+		}
+	case Coalesce:
+		if key != "" && q.coalesce(data, key) {
+			queueOverflows.With("coalesced").Inc()
+			return Delivered
+		}
+	case Block:
+		timer := time.NewTimer(policy.Timeout)
+		defer timer.Stop()
+		select {
+		case q.messages <- data:
+			q.record(key)
+			queueOverflows.With("blocked").Inc()
+			return Delivered
+		case <-timer.C:
+			queueOverflows.With("block_timeout").Inc()
+			return QueueFull
+		}
+	}
+	queueOverflows.With("drop_newest").Inc()
+	return QueueFull
+}
+
+// offer puts the message on the queue if there is room for it.
+func (q *queue) offer(data []byte, key string) bool {
+	select {
+	case q.messages <- data:
+		q.record(key)
+		return true
+	default:
+		return false
+	}
+}
+
+// record remembers the key of a queued message.
+func (q *queue) record(key string) {
+	if cap(q.messages) == 0 {
+		return
+	}
+	if len(q.keys) == cap(q.messages) {
+		copy(q.keys, q.keys[1:])
+		q.keys = q.keys[:len(q.keys)-1]
+	}
+	q.keys = append(q.keys, key)
+}
+
+// coalesce replaces the first queued message with the key by the data and
+// drops the later ones. All the queued messages are taken off the queue and
+// put back in order. It reports whether a message with the key was queued.
+func (q *queue) coalesce(data []byte, key string) bool {
+	var queued [][]byte
+	for drained := false; !drained; {
+		select {
+		case m := <-q.messages:
+			queued = append(queued, m)
+		default:
+			drained = true
+		}
+	}
+	keys := q.keys[len(q.keys)-len(queued):]
+	q.keys = make([]string, 0, cap(q.messages))
+
+	found := false
+	for i, m := range queued {
+		if keys[i] == key {
+			if found {
+				continue
+			}
+			found = true
+			m = data
+		}
+		q.offer(m, keys[i])
+	}
+	return found
+}
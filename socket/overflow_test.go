@@ -0,0 +1,157 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package socket_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+func TestOverflowDropNewest(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c := make(chan []byte, 1)
+	id := registerOverflow(t, reg, c, socket.OverflowPolicy{})
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("a")}, socket.Delivered)
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("b")}, socket.QueueFull)
+	checkReceivedMessage(t, c, "a")
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c := make(chan []byte, 2)
+	id := registerOverflow(t, reg, c, socket.OverflowPolicy{Action: socket.DropOldest})
+	for _, data := range []string{"a", "b", "c"} {
+		routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte(data)}, socket.Delivered)
+	}
+	checkReceivedMessage(t, c, "b")
+	checkReceivedMessage(t, c, "c")
+}
+
+func TestOverflowCoalesce(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c := make(chan []byte, 3)
+	id := registerOverflow(t, reg, c, socket.OverflowPolicy{Action: socket.Coalesce})
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("a1"), Key: "a"}, socket.Delivered)
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("b1"), Key: "b"}, socket.Delivered)
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("x")}, socket.Delivered)
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("a2"), Key: "a"}, socket.Delivered)
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("c1"), Key: "c"}, socket.QueueFull)
+
+	checkReceivedMessage(t, c, "a2")
+	checkReceivedMessage(t, c, "b1")
+	checkReceivedMessage(t, c, "x")
+}
+
+func TestOverflowBlock(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c := make(chan []byte, 1)
+	id := registerOverflow(t, reg, c, socket.OverflowPolicy{Action: socket.Block, Timeout: time.Millisecond})
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("a")}, socket.Delivered)
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("b")}, socket.QueueFull)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-c
+	}()
+	block := socket.OverflowPolicy{Action: socket.Block, Timeout: time.Second}
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("c"), Overflow: &block}, socket.Delivered)
+	checkReceivedMessage(t, c, "c")
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	disconnected := make(chan int, 1)
+	c := make(chan []byte, 1)
+	id, err := reg.RegisterSocket(socket.Socket{
+		Messages: c,
+		Overflow: socket.OverflowPolicy{Action: socket.Disconnect, CloseCode: 4000},
+		Disconnect: func(closeCode int) {
+			disconnected <- closeCode
+		},
+	})
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("a")}, socket.Delivered)
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("b")}, socket.QueueFull)
+	select {
+	case code := <-disconnected:
+		if code != 4000 {
+			t.Errorf("Expecting close code 4000 but got: %d", code)
+		}
+	default:
+		t.Fatal("Slow socket should be disconnected")
+	}
+
+	// Disconnected sockets don't receive any more messages.
+	<-c
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("c")}, socket.QueueFull)
+}
+
+func registerOverflow(t *testing.T, reg socket.Registry, c chan []byte, policy socket.OverflowPolicy) socket.ID {
+	id, err := reg.RegisterSocket(socket.Socket{Messages: c, Overflow: policy})
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+	return id
+}
+
+func routeStatus(t *testing.T, reg socket.Registry, msg socket.Message, expected socket.DeliveryStatus) {
+	status := make(chan socket.DeliveryStatus, 1)
+	msg.Status = status
+	reg.Messages() <- msg
+	if st := <-status; st != expected {
+		t.Errorf("Expecting %s routing %q but got: %s", expected, msg.Data, st)
+	}
+}
+
+func TestValidCloseCode(t *testing.T) {
+	for code, valid := range map[int]bool{
+		0: false, 1000: true, 1001: false, 1008: false, 2999: false,
+		3000: true, 4000: true, 4999: true, 5000: false,
+	} {
+		if socket.ValidCloseCode(code) != valid {
+			t.Errorf("Expecting ValidCloseCode(%d) to be %t", code, valid)
+		}
+	}
+}
+
+func TestParseOverflowAction(t *testing.T) {
+	for _, a := range []socket.OverflowAction{socket.DropNewest, socket.DropOldest, socket.Coalesce, socket.Block, socket.Disconnect} {
+		if parsed, err := socket.ParseOverflowAction(a.String()); err != nil || parsed != a {
+			t.Errorf("Expecting to parse %s but got: %s, %v", a, parsed, err)
+		}
+	}
+	if _, err := socket.ParseOverflowAction("retry"); err == nil {
+		t.Error("Parsing an unknown action should fail")
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package socket
+
+import "fmt"
+
+// Priority is the priority class of a message routed to a socket. Every class
+// is queued separately and the higher priority messages are written first.
+type Priority int
+
+const (
+	// PriorityNormal is used for most of the messages.
+	PriorityNormal Priority = iota
+	// PriorityHigh is used for messages that should not wait behind the bulk
+	// traffic, such as kicks or server notices.
+	PriorityHigh
+	// PriorityLow is used for bulk traffic that can wait.
+	PriorityLow
+)
+
+const numPriorities = 3
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
@@ -28,7 +28,7 @@ type Reader interface {
 }
 
 // MessageReader is a worker that reads from a specified Reader. Every message read
-// is send over its messages channel.
+// is send over its messages channel which is closed once the reader terminates.
 // If the Writer is set it will be closed after the Run terminates.
 // The Writer should not be set while the reader is running.
 type MessageReader struct {
@@ -50,9 +50,10 @@ func NewMessageReader(r Reader) *MessageReader {
 
 // Run reads messages from the underlying Reader and sends them to the messages channel.
 // Method terminates if a read error occurs or the reader is explicitly closed.
-// If set the Writer is closed before returning.
+// The messages channel is closed and if set the Writer is closed before returning.
 func (r *MessageReader) Run() {
 	defer func() {
+		close(r.messages)
 		if r.Writer != nil {
 			r.Writer.Close()
 		}
@@ -64,6 +65,8 @@ func (r *MessageReader) Run() {
 			glog.Warning("Unable to read: ", err)
 			return
 		}
+		readerMessages.Inc()
+		readerBytes.Add(uint64(len(data)))
 		select {
 		case r.messages <- data:
 			continue
@@ -74,7 +77,8 @@ func (r *MessageReader) Run() {
 	}
 }
 
-// Messages returns a receive only channel of read messages.
+// Messages returns a receive only channel of read messages. The channel is
+// closed when the reader terminates.
 func (r *MessageReader) Messages() <-chan []byte {
 	return r.messages
 }
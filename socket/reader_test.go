@@ -69,8 +69,10 @@ func TestMessageReaderExitOnReadError(t *testing.T) {
 		close(done)
 	}()
 	select {
-	case data := <-r.Messages():
-		t.Fatalf("No messages should be sent but got '%s'", string(data))
+	case data, ok := <-r.Messages():
+		if ok {
+			t.Fatalf("No messages should be sent but got '%s'", string(data))
+		}
 	case <-done:
 	case <-time.After(time.Millisecond):
 		t.Fatal("Reader shouled be closed on error")
@@ -103,6 +105,24 @@ func TestMessageReaderWriterIsClosed(t *testing.T) {
 	}
 }
 
+func TestMessageReaderMessagesClosed(t *testing.T) {
+	t.Parallel()
+	reader := MockReader{bytes.NewReader([]byte("ab"))}
+	r := socket.NewMessageReader(&reader)
+	go r.Run()
+	if m := readMessage(t, r.Messages()); m != "ab" {
+		t.Fatalf("Expecting message 'ab' but got '%s'", m)
+	}
+	select {
+	case _, ok := <-r.Messages():
+		if ok {
+			t.Fatal("No more messages should be sent")
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatal("Messages channel should be closed")
+	}
+}
+
 func readMessage(t *testing.T, m <-chan []byte) string {
 	select {
 	case data := <-m:
@@ -16,6 +16,7 @@ package socket
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -23,6 +24,7 @@ import (
 	"sync"
 
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
 // ID identifies the registered socket in the registry.
@@ -44,41 +46,94 @@ type Registry interface {
 	// routed to the matching sockets.
 	Messages() chan<- Message
 
+	// SocketMessages returns a send-only channel that receives the messages
+	// routed to the socket. Messages sent on it are routed the same way as
+	// the ones sent on Messages but may skip a hand-over between the
+	// registry's event loops.
+	SocketMessages(socketId ID) chan<- Message
+
+	// Multicasts returns a send-only channel that receives messages that are
+	// routed to multiple sockets at once.
+	Multicasts() chan<- Multicast
+
 	// Register registers a channel that messages are routed to for the socket.
 	// A new socket id is generated and returned that can be used to unregister
-	// the channel.
-	Register(messages chan<- []byte) (ID, error)
+	// the channel. Messages routed to a full channel are dropped.
+	// The registry must be the only sender on the channel.
+	Register(messages chan []byte) (ID, error)
+
+	// RegisterUser registers a channel the same way as Register but also
+	// associates the socket with the given user. Messages addressed to the
+	// user are routed to all of the user's registered sockets.
+	RegisterUser(userID string, messages chan []byte) (ID, error)
+
+	// RegisterSocket registers the socket the same way as RegisterUser using
+	// the socket's overflow policy for the messages routed to a full channel.
+	RegisterSocket(s Socket) (ID, error)
 
 	// Unregister unregisters a receiving channel from the registry.
 	// Once unregistered no more messages are going to be received.
 	// Until successfully unregistered the client should keep receiving the messages
 	// on the registered channel.
 	Unregister(socketId ID)
+
+	// Subscribe subscribes a registered socket to the topic. Messages published
+	// to the topic are routed to all of its subscribers.
+	// ErrNotFound is returned if the socket is not registered and ErrClosed
+	// once the registry is closed.
+	Subscribe(socketId ID, topic string) error
+
+	// Unsubscribe removes the socket's subscription to the topic.
+	// ErrNotFound is returned if the socket is not registered and ErrClosed
+	// once the registry is closed.
+	// Subscriptions are removed automatically when the socket is unregistered.
+	Unsubscribe(socketId ID, topic string) error
 }
 
+// ErrNotFound is returned if the operation refers to a socket that is not registered.
+var ErrNotFound = errors.New("socket not found")
+
+// ErrClosed is returned if the operation is attempted after the registry was
+// closed.
+var ErrClosed = errors.New("registry closed")
+
 var _ Registry = (*RegistryServer)(nil)
 
 // RegistryServer is an implementation of Registry using an event loop to handle the
 // received messages.
 type RegistryServer struct {
-	activeSockets map[ID]chan<- []byte
+	activeSockets map[ID]*queues
+	socketUsers   map[ID]string
+	userSockets   map[string]map[ID]struct{}
+	socketTopics  map[ID]map[string]struct{}
+	topicSockets  map[string]map[ID]struct{}
 
 	closeOnce sync.Once
 	done      chan struct{}
 
 	messages   chan Message
+	multicasts chan Multicast
 	register   chan registerSocket
 	unregister chan ID
+	subscribe  chan subscription
+	ping       chan struct{}
 }
 
 // NewRegistry constructs a new socket registry that is ready to be run.
 func NewRegistry() *RegistryServer {
 	return &RegistryServer{
-		activeSockets: make(map[ID]chan<- []byte),
+		activeSockets: make(map[ID]*queues),
+		socketUsers:   make(map[ID]string),
+		userSockets:   make(map[string]map[ID]struct{}),
+		socketTopics:  make(map[ID]map[string]struct{}),
+		topicSockets:  make(map[string]map[ID]struct{}),
 		done:          make(chan struct{}),
 		messages:      make(chan Message),
+		multicasts:    make(chan Multicast),
 		register:      make(chan registerSocket),
 		unregister:    make(chan ID),
+		subscribe:     make(chan subscription),
+		ping:          make(chan struct{}),
 	}
 }
 
@@ -92,23 +147,175 @@ func (r *RegistryServer) Run() {
 			glog.Info("Shutting down socket registry")
 			return
 		case m := <-r.messages:
-			if c, ok := r.activeSockets[m.SocketID]; ok {
-				select {
-				case c <- m.Data:
-					glog.V(4).Info("Message sent to socket")
-				default:
-					glog.Warning("Socket queue full")
-				}
-			} else {
-				glog.Warningf("Socket not found: %s", m.SocketID)
+			status := r.route(m.SocketID, m.Data, m.Key, m.Priority, m.Overflow)
+			if m.Status != nil {
+				m.Status <- status
 			}
+		case m := <-r.multicasts:
+			r.multicast(m)
 		case m := <-r.register:
-			glog.Infof("Registering socket: %s", m.SocketId)
-			r.activeSockets[m.SocketId] = m.Messages
+			r.addSocket(m)
 		case socketId := <-r.unregister:
-			glog.Infof("Unregistering socket: %s", socketId)
-			delete(r.activeSockets, socketId)
+			r.removeSocket(socketId)
+		case m := <-r.subscribe:
+			m.Result <- r.changeSubscription(m)
+		case <-r.ping:
+		}
+	}
+}
+
+// addSocket adds the socket to the active sockets and the user index.
+func (r *RegistryServer) addSocket(m registerSocket) {
+	glog.Infof("Registering socket: %s", m.SocketId)
+	if _, ok := r.activeSockets[m.SocketId]; !ok {
+		activeSockets.Inc()
+	}
+	registrations.Inc()
+	r.activeSockets[m.SocketId] = newQueues(m.Socket)
+	if m.UserID == "" {
+		return
+	}
+	r.socketUsers[m.SocketId] = m.UserID
+	addToIndex(r.userSockets, m.UserID, m.SocketId)
+}
+
+// removeSocket removes the socket from the active sockets and the user index.
+func (r *RegistryServer) removeSocket(socketId ID) {
+	glog.Infof("Unregistering socket: %s", socketId)
+	if _, ok := r.activeSockets[socketId]; ok {
+		activeSockets.Dec()
+		unregistrations.Inc()
+	}
+	delete(r.activeSockets, socketId)
+	for topic := range r.socketTopics[socketId] {
+		removeFromIndex(r.topicSockets, topic, socketId)
+	}
+	delete(r.socketTopics, socketId)
+	if userID, ok := r.socketUsers[socketId]; ok {
+		delete(r.socketUsers, socketId)
+		removeFromIndex(r.userSockets, userID, socketId)
+	}
+}
+
+// changeSubscription subscribes or unsubscribes the socket from the topic.
+func (r *RegistryServer) changeSubscription(m subscription) error {
+	if _, ok := r.activeSockets[m.SocketId]; !ok {
+		return ErrNotFound
+	}
+	topics, ok := r.socketTopics[m.SocketId]
+	if !ok {
+		topics = make(map[string]struct{})
+		r.socketTopics[m.SocketId] = topics
+	}
+	if m.Subscribe {
+		glog.V(2).Infof("Subscribing socket %s to topic %s", m.SocketId, m.Topic)
+		topics[m.Topic] = struct{}{}
+		addToIndex(r.topicSockets, m.Topic, m.SocketId)
+	} else {
+		glog.V(2).Infof("Unsubscribing socket %s from topic %s", m.SocketId, m.Topic)
+		delete(topics, m.Topic)
+		removeFromIndex(r.topicSockets, m.Topic, m.SocketId)
+	}
+	if len(topics) == 0 {
+		delete(r.socketTopics, m.SocketId)
+	}
+	return nil
+}
+
+// addToIndex adds the socket id to the set stored under the key.
+func addToIndex(index map[string]map[ID]struct{}, key string, socketId ID) {
+	sockets, ok := index[key]
+	if !ok {
+		sockets = make(map[ID]struct{})
+		index[key] = sockets
+	}
+	sockets[socketId] = struct{}{}
+}
+
+// removeFromIndex removes the socket id from the set stored under the key.
+// Empty sets are removed from the index.
+func removeFromIndex(index map[string]map[ID]struct{}, key string, socketId ID) {
+	sockets := index[key]
+	delete(sockets, socketId)
+	if len(sockets) == 0 {
+		delete(index, key)
+	}
+}
+
+// route sends the data to the channel of the socket with the given id that
+// matches the priority. The overflow policy overrides the socket's own policy
+// if it is set.
+func (r *RegistryServer) route(socketID ID, data []byte, key string, priority Priority, overflow *OverflowPolicy) DeliveryStatus {
+	q, ok := r.activeSockets[socketID]
+	if !ok {
+		glog.Warningf("Socket not found: %s", socketID)
+		messagesDropped.With(dropReason(NotFound)).Inc()
+		return NotFound
+	}
+	policy := q.overflow
+	if overflow != nil {
+		policy = *overflow
+	}
+	status := q.push(data, key, priority, policy)
+	if status != Delivered {
+		glog.Warningf("Socket queue full: %s", socketID)
+		messagesDropped.With(dropReason(status)).Inc()
+		return status
+	}
+	glog.V(4).Info("Message sent to socket")
+	messagesRouted.Inc()
+	return Delivered
+}
+
+// multicast routes the message to all the targeted sockets and reports the
+// results if requested.
+func (r *RegistryServer) multicast(m Multicast) {
+	targets := r.targets(m)
+	deliveries := make([]Delivery, 0, len(targets))
+	for _, socketID := range targets {
+		deliveries = append(deliveries, Delivery{socketID, r.route(socketID, m.Data, m.Key, m.Priority, m.Overflow)})
+	}
+	if m.Results != nil {
+		m.Results <- deliveries
+	}
+}
+
+// targets returns the ids of the sockets the multicast message is addressed to.
+func (r *RegistryServer) targets(m Multicast) []ID {
+	switch {
+	case m.Broadcast:
+		ids := make([]ID, 0, len(r.activeSockets))
+		for socketID := range r.activeSockets {
+			ids = append(ids, socketID)
 		}
+		return ids
+	case m.UserID != "":
+		return indexedSockets(r.userSockets, m.UserID)
+	case m.Topic != "":
+		return indexedSockets(r.topicSockets, m.Topic)
+	default:
+		return m.SocketIDs
+	}
+}
+
+// indexedSockets returns the ids of the sockets stored under the key.
+func indexedSockets(index map[string]map[ID]struct{}, key string) []ID {
+	sockets := index[key]
+	ids := make([]ID, 0, len(sockets))
+	for socketID := range sockets {
+		ids = append(ids, socketID)
+	}
+	return ids
+}
+
+// Ping checks that the event loop is handling events. It returns an error if
+// the loop does not respond before the context is done.
+func (r *RegistryServer) Ping(ctx context.Context) error {
+	select {
+	case r.ping <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -121,9 +328,17 @@ func (r *RegistryServer) Close() error {
 
 // Message is a single message that will be routed to the receiving socket channel
 // with the matching id.
+// If Status is set the routing outcome is sent on it once the message is routed.
+// The channel must be able to accept the status without blocking.
+// Key identifies the messages that replace each other when coalesced and
+// Overflow overrides the socket's overflow policy if it is set.
 type Message struct {
 	SocketID ID
 	Data     []byte
+	Status   chan<- DeliveryStatus
+	Key      string
+	Priority Priority
+	Overflow *OverflowPolicy
 }
 
 // Messages implements the Registry interface.
@@ -131,29 +346,172 @@ func (r *RegistryServer) Messages() chan<- Message {
 	return r.messages
 }
 
+// SocketMessages implements the Registry interface.
+func (r *RegistryServer) SocketMessages(socketId ID) chan<- Message {
+	return r.messages
+}
+
+// Multicast is a message that is routed to multiple sockets by a single
+// registry event. If Broadcast is set the message is routed to every
+// registered socket, otherwise if UserID is set it is routed to all the sockets
+// registered for the user and if Topic is set to all the topic's subscribers.
+// SocketIDs are only used if none of them is set.
+// If Results is set the delivery result for every targeted socket is sent on
+// it once the message is routed. The channel must be able to accept the
+// results without blocking.
+// Key, Priority and Overflow are applied to every targeted socket as they
+// are for Message.
+type Multicast struct {
+	SocketIDs []ID
+	UserID    string
+	Topic     string
+	Broadcast bool
+	Data      []byte
+	Results   chan<- []Delivery
+	Key       string
+	Priority  Priority
+	Overflow  *OverflowPolicy
+}
+
+// DeliveryStatus is the outcome of routing a message to a single socket.
+type DeliveryStatus int
+
+const (
+	// Delivered means the message was put on the socket's queue.
+	Delivered DeliveryStatus = iota
+	// QueueFull means the message was dropped because the socket's queue was full.
+	QueueFull
+	// NotFound means no socket with the given id is registered.
+	NotFound
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case Delivered:
+		return "delivered"
+	case QueueFull:
+		return "queue full"
+	case NotFound:
+		return "not found"
+	}
+	return fmt.Sprintf("DeliveryStatus(%d)", int(s))
+}
+
+// Delivery is the result of routing a message to a single socket.
+type Delivery struct {
+	SocketID ID
+	Status   DeliveryStatus
+}
+
+// Multicasts implements the Registry interface.
+func (r *RegistryServer) Multicasts() chan<- Multicast {
+	return r.multicasts
+}
+
+// Socket describes a socket being registered.
+type Socket struct {
+	// UserID associates the socket with the user if it is set.
+	UserID string
+	// Messages is the channel the messages are routed to. The registry must
+	// be the only sender on the channel.
+	Messages chan []byte
+	// HighMessages and LowMessages receive the messages of the high and low
+	// priority classes. Messages is used in place of a missing channel.
+	HighMessages chan []byte
+	LowMessages  chan []byte
+	// Overflow is applied to the messages routed to a full channel unless
+	// the message sets its own policy.
+	Overflow OverflowPolicy
+	// Disconnect is called with the policy's close code when the Disconnect
+	// overflow action is applied. It is called by the registry's event loop
+	// and must not block.
+	Disconnect func(closeCode int)
+}
+
 // registerSocket represents information needed for registering a socket's channel.
 type registerSocket struct {
+	Socket
 	SocketId ID
-	Messages chan<- []byte
 }
 
 // Register implements the Registry interface.
 // Error can occur if the random id could not be generated.
-func (r *RegistryServer) Register(messages chan<- []byte) (ID, error) {
-	socketIdBig, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+func (r *RegistryServer) Register(messages chan []byte) (ID, error) {
+	return r.RegisterSocket(Socket{Messages: messages})
+}
+
+// RegisterUser implements the Registry interface.
+// Sockets registered with an empty user id are not associated with any user.
+func (r *RegistryServer) RegisterUser(userID string, messages chan []byte) (ID, error) {
+	return r.RegisterSocket(Socket{UserID: userID, Messages: messages})
+}
+
+// RegisterSocket implements the Registry interface.
+func (r *RegistryServer) RegisterSocket(s Socket) (ID, error) {
+	socketId, err := newID()
 	if err != nil {
-		return 0, fmt.Errorf("generating socket id: %s", err)
+		return 0, err
 	}
-	socketId := ID(socketIdBig.Int64())
+	r.registerID(socketId, s)
+	return socketId, nil
+}
 
+// registerID registers the socket under an already generated socket id.
+func (r *RegistryServer) registerID(socketId ID, s Socket) {
 	r.register <- registerSocket{
+		Socket:   s,
 		SocketId: socketId,
-		Messages: messages,
 	}
-	return socketId, nil
+}
+
+// newID generates a new random socket id.
+func newID() (ID, error) {
+	socketIdBig, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return 0, fmt.Errorf("generating socket id: %s", err)
+	}
+	return ID(socketIdBig.Int64()), nil
 }
 
 // Unregister implements the Registry interface.
 func (r *RegistryServer) Unregister(socketId ID) {
 	r.unregister <- socketId
 }
+
+// subscription represents a change of a socket's topic subscription.
+type subscription struct {
+	SocketId  ID
+	Topic     string
+	Subscribe bool
+	Result    chan error
+}
+
+// Subscribe implements the Registry interface.
+func (r *RegistryServer) Subscribe(socketId ID, topic string) error {
+	return r.changeTopic(socketId, topic, true)
+}
+
+// Unsubscribe implements the Registry interface.
+func (r *RegistryServer) Unsubscribe(socketId ID, topic string) error {
+	return r.changeTopic(socketId, topic, false)
+}
+
+func (r *RegistryServer) changeTopic(socketId ID, topic string, subscribe bool) error {
+	result := make(chan error, 1)
+	select {
+	case r.subscribe <- subscription{
+		SocketId:  socketId,
+		Topic:     topic,
+		Subscribe: subscribe,
+		Result:    result,
+	}:
+	case <-r.done:
+		return ErrClosed
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-r.done:
+		return ErrClosed
+	}
+}
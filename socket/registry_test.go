@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/protogalaxy/service-socket/socket"
 )
 
@@ -103,6 +104,25 @@ func TestSocketRegistryMessageQueueFull(t *testing.T) {
 	}
 }
 
+func TestSocketRegistryPriorities(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	normal := make(chan []byte, 1)
+	high := make(chan []byte, 1)
+	id, err := reg.RegisterSocket(socket.Socket{Messages: normal, HighMessages: high})
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("h"), Priority: socket.PriorityHigh}, socket.Delivered)
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("n")}, socket.Delivered)
+	// Low priority messages share the normal queue without a queue of their own.
+	routeStatus(t, reg, socket.Message{SocketID: id, Data: []byte("l"), Priority: socket.PriorityLow}, socket.QueueFull)
+	checkReceivedMessage(t, high, "h")
+	checkReceivedMessage(t, normal, "n")
+}
+
 func socketSendMessage(t *testing.T, msgs chan<- socket.Message, socketId socket.ID, data string) {
 	select {
 	case msgs <- socket.Message{
@@ -152,3 +172,278 @@ func TestSocketRegistryUnregister(t *testing.T) {
 		t.Fatal("Registry not closing")
 	}
 }
+
+func TestSocketRegistryMulticast(t *testing.T) {
+	t.Parallel()
+	reg := socket.NewRegistry()
+	done := make(chan struct{})
+	go func() {
+		reg.Run()
+		close(done)
+	}()
+
+	c1 := make(chan []byte, 1)
+	id1, err := reg.Register(c1)
+	if err != nil {
+		t.Errorf("Registering socket should not fail but got: %s", err)
+	}
+	c2 := make(chan []byte)
+	id2, err := reg.Register(c2)
+	if err != nil {
+		t.Errorf("Registering socket should not fail but got: %s", err)
+	}
+
+	results := make(chan []socket.Delivery, 1)
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		SocketIDs: []socket.ID{id1, id2, id1 + id2},
+		Data:      []byte("abc"),
+		Results:   results,
+	})
+
+	checkReceivedMessage(t, c1, "abc")
+	checkDeliveries(t, results, []socket.Delivery{
+		{id1, socket.Delivered},
+		{id2, socket.QueueFull},
+		{id1 + id2, socket.NotFound},
+	})
+
+	reg.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Millisecond):
+		t.Fatal("Registry not closing")
+	}
+}
+
+func TestSocketRegistryBroadcast(t *testing.T) {
+	t.Parallel()
+	reg := socket.NewRegistry()
+	done := make(chan struct{})
+	go func() {
+		reg.Run()
+		close(done)
+	}()
+
+	c1 := make(chan []byte, 1)
+	if _, err := reg.Register(c1); err != nil {
+		t.Errorf("Registering socket should not fail but got: %s", err)
+	}
+	c2 := make(chan []byte, 1)
+	if _, err := reg.Register(c2); err != nil {
+		t.Errorf("Registering socket should not fail but got: %s", err)
+	}
+
+	results := make(chan []socket.Delivery, 1)
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		Broadcast: true,
+		Data:      []byte("abc"),
+		Results:   results,
+	})
+
+	checkReceivedMessage(t, c1, "abc")
+	checkReceivedMessage(t, c2, "abc")
+	select {
+	case d := <-results:
+		if len(d) != 2 {
+			t.Errorf("Expecting 2 deliveries but got: %v", d)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatal("No delivery results")
+	}
+
+	reg.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Millisecond):
+		t.Fatal("Registry not closing")
+	}
+}
+
+func socketSendMulticast(t *testing.T, msgs chan<- socket.Multicast, m socket.Multicast) {
+	select {
+	case msgs <- m:
+	case <-time.After(time.Millisecond):
+		t.Fatal("Multicast message not sent")
+	}
+}
+
+func checkDeliveries(t *testing.T, results <-chan []socket.Delivery, expected []socket.Delivery) {
+	select {
+	case d := <-results:
+		if len(d) != len(expected) {
+			t.Fatalf("Expecting deliveries %v but got %v", expected, d)
+		}
+		for i := range d {
+			if d[i] != expected[i] {
+				t.Errorf("Expecting delivery %v but got %v", expected[i], d[i])
+			}
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatal("No delivery results")
+	}
+}
+
+func TestSocketRegistrySendToUser(t *testing.T) {
+	t.Parallel()
+	reg := socket.NewRegistry()
+	done := make(chan struct{})
+	go func() {
+		reg.Run()
+		close(done)
+	}()
+
+	c1 := make(chan []byte, 1)
+	if _, err := reg.RegisterUser("user1", c1); err != nil {
+		t.Errorf("Registering socket should not fail but got: %s", err)
+	}
+	c2 := make(chan []byte, 1)
+	id2, err := reg.RegisterUser("user1", c2)
+	if err != nil {
+		t.Errorf("Registering socket should not fail but got: %s", err)
+	}
+	c3 := make(chan []byte, 1)
+	if _, err := reg.RegisterUser("user2", c3); err != nil {
+		t.Errorf("Registering socket should not fail but got: %s", err)
+	}
+
+	results := make(chan []socket.Delivery, 1)
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		UserID:  "user1",
+		Data:    []byte("abc"),
+		Results: results,
+	})
+	checkReceivedMessage(t, c1, "abc")
+	checkReceivedMessage(t, c2, "abc")
+	select {
+	case m := <-c3:
+		t.Errorf("Other user should not receive messages but got: %s", m)
+	default:
+	}
+	select {
+	case d := <-results:
+		if len(d) != 2 {
+			t.Errorf("Expecting 2 deliveries but got: %v", d)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatal("No delivery results")
+	}
+
+	reg.Unregister(id2)
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		UserID:  "user1",
+		Data:    []byte("def"),
+		Results: results,
+	})
+	checkReceivedMessage(t, c1, "def")
+	select {
+	case d := <-results:
+		if len(d) != 1 {
+			t.Errorf("Expecting 1 delivery after unregister but got: %v", d)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatal("No delivery results")
+	}
+
+	reg.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Millisecond):
+		t.Fatal("Registry not closing")
+	}
+}
+
+func TestSocketRegistryTopics(t *testing.T) {
+	t.Parallel()
+	reg := socket.NewRegistry()
+	done := make(chan struct{})
+	go func() {
+		reg.Run()
+		close(done)
+	}()
+
+	c1 := make(chan []byte, 1)
+	id1, err := reg.Register(c1)
+	if err != nil {
+		t.Errorf("Registering socket should not fail but got: %s", err)
+	}
+	c2 := make(chan []byte, 1)
+	id2, err := reg.Register(c2)
+	if err != nil {
+		t.Errorf("Registering socket should not fail but got: %s", err)
+	}
+
+	if err := reg.Subscribe(id1, "lobby:42"); err != nil {
+		t.Errorf("Subscribing should not fail but got: %s", err)
+	}
+	if err := reg.Subscribe(id2, "lobby:42"); err != nil {
+		t.Errorf("Subscribing should not fail but got: %s", err)
+	}
+	if err := reg.Subscribe(id1+id2, "lobby:42"); err != socket.ErrNotFound {
+		t.Errorf("Subscribing unknown socket should fail but got: %v", err)
+	}
+
+	results := make(chan []socket.Delivery, 1)
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		Topic:   "lobby:42",
+		Data:    []byte("abc"),
+		Results: results,
+	})
+	checkReceivedMessage(t, c1, "abc")
+	checkReceivedMessage(t, c2, "abc")
+	<-results
+
+	if err := reg.Unsubscribe(id1, "lobby:42"); err != nil {
+		t.Errorf("Unsubscribing should not fail but got: %s", err)
+	}
+	reg.Unregister(id2)
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		Topic:   "lobby:42",
+		Data:    []byte("def"),
+		Results: results,
+	})
+	checkDeliveries(t, results, []socket.Delivery{})
+
+	reg.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Millisecond):
+		t.Fatal("Registry not closing")
+	}
+}
+
+func TestSocketRegistrySubscribeAfterClose(t *testing.T) {
+	reg := socket.NewRegistry()
+	reg.Close()
+	done := make(chan error, 2)
+	go func() {
+		done <- reg.Subscribe(1, "lobby:42")
+		done <- reg.Unsubscribe(1, "lobby:42")
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != socket.ErrClosed {
+				t.Errorf("Expecting ErrClosed but got: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Subscription change blocked after the registry was closed")
+		}
+	}
+}
+
+func TestRegistryPing(t *testing.T) {
+	t.Parallel()
+	reg := socket.NewRegistry()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := reg.Ping(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected ping to a stopped registry to time out but got: %v", err)
+	}
+
+	go reg.Run()
+	defer reg.Close()
+	if err := reg.Ping(context.Background()); err != nil {
+		t.Errorf("Expected ping to a running registry to succeed but got: %s", err)
+	}
+}
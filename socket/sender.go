@@ -19,38 +19,549 @@ package socket
 
 import (
 	"errors"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
 )
 
+// DefaultReportInterval is how often SendStream reports delivery outcomes.
+const DefaultReportInterval = time.Second
+
 type Sender struct {
 	Sockets Registry
+	// ReportInterval is how often SendStream sends aggregated delivery
+	// reports. Defaults to DefaultReportInterval.
+	ReportInterval time.Duration
+	// MaxOverflowTimeout caps the time the Block overflow action requested
+	// by a caller waits for room in a socket queue while holding up the
+	// registry. Defaults to DefaultMaxOverflowTimeout.
+	MaxOverflowTimeout time.Duration
+
+	mu       sync.Mutex
+	draining bool
+	stop     chan struct{}
+	inflight sync.WaitGroup
+}
+
+// begin registers a new in-flight call of the method. Calls are rejected
+// once the sender starts draining.
+func (s *Sender) begin(method string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		senderRequests.With(method, codeName(codes.Unavailable)).Inc()
+		return grpc.Errorf(codes.Unavailable, "server is shutting down")
+	}
+	s.inflight.Add(1)
+	return nil
+}
+
+// end marks the in-flight call as finished and records its outcome.
+func (s *Sender) end(method string, start time.Time, err *error) {
+	senderRequests.With(method, codeName(errorCode(*err))).Inc()
+	senderDuration.With(method).ObserveSince(start)
+	s.inflight.Done()
+}
+
+// stopping returns a channel that is closed once the sender starts draining.
+// Long running calls use it to finish early.
+func (s *Sender) stopping() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopChan()
+}
+
+func (s *Sender) stopChan() chan struct{} {
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	return s.stop
+}
+
+// errorCode returns the status code reported for the error.
+func errorCode(err error) codes.Code {
+	switch err {
+	case nil:
+		return codes.OK
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	case context.Canceled:
+		return codes.Canceled
+	}
+	return grpc.Code(err)
+}
+
+// Drain rejects all new calls and waits until the in-flight calls finish or
+// the context is done.
+func (s *Sender) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.draining {
+		s.draining = true
+		close(s.stopChan())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func validateRequest(req *SendRequest) error {
 	if len(req.Data) == 0 {
 		return errors.New("empty message")
 	}
+	return validateOverflow(req.Overflow)
+}
+
+// validateOverflow checks the close code of a requested overflow policy. The
+// code goes out in the close frame so it is only checked if it is set or the
+// policy disconnects the socket.
+func validateOverflow(o *Overflow) error {
+	if o != nil && (o.CloseCode != 0 || o.Action == Overflow_DISCONNECT) {
+		if !ValidCloseCode(int(o.CloseCode)) {
+			return grpc.Errorf(codes.InvalidArgument, "invalid overflow close code: %d", o.CloseCode)
+		}
+	}
 	return nil
 }
 
-func (s *Sender) SendMessage(ctx context.Context, req *SendRequest) (*SendReply, error) {
+func (s *Sender) SendMessage(ctx context.Context, req *SendRequest) (_ *SendReply, err error) {
+	if err := s.begin("SendMessage"); err != nil {
+		return nil, err
+	}
+	defer s.end("SendMessage", time.Now(), &err)
+
 	if err := validateRequest(req); err != nil {
 		return nil, err
 	}
 
+	status := make(chan DeliveryStatus, 1)
+	key, overflow := s.overflowFromProto(req.Overflow)
 	msg := Message{
 		SocketID: ID(req.SocketId),
 		Data:     req.Data,
+		Status:   status,
+		Key:      key,
+		Priority: Priority(req.Priority),
+		Overflow: overflow,
 	}
 
 	select {
-	case s.Sockets.Messages() <- msg:
+	case s.Sockets.SocketMessages(msg.SocketID) <- msg:
 		glog.V(3).Info("Message sent")
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 
+	select {
+	case st := <-status:
+		if err := deliveryError(msg.SocketID, st); err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
 	return &SendReply{}, nil
 }
+
+// SendStream sends every message received over the stream to its socket the
+// same way SendMessage does. Outcomes are aggregated and reported back every
+// ReportInterval and once more when the client closes its side of the stream.
+func (s *Sender) SendStream(stream Sender_SendStreamServer) (err error) {
+	if err := s.begin("SendStream"); err != nil {
+		return err
+	}
+	defer s.end("SendStream", time.Now(), &err)
+
+	ctx := stream.Context()
+	done := make(chan struct{})
+	defer close(done)
+	requests := make(chan *SendRequest)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	interval := s.ReportInterval
+	if interval <= 0 {
+		interval = DefaultReportInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	stop := s.stopping()
+	report := &DeliveryReport{}
+	for {
+		select {
+		case req := <-requests:
+			if err := s.deliver(ctx, req, report); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := flushReport(stream, report); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			if err != io.EOF {
+				return err
+			}
+			return stream.Send(report)
+		case <-stop:
+			if err := flushReport(stream, report); err != nil {
+				return err
+			}
+			return grpc.Errorf(codes.Unavailable, "server is shutting down")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// deliver sends a streamed message to its socket and records the outcome in
+// the report.
+func (s *Sender) deliver(ctx context.Context, req *SendRequest, report *DeliveryReport) error {
+	if err := validateRequest(req); err != nil {
+		report.Invalid++
+		return nil
+	}
+
+	status := make(chan DeliveryStatus, 1)
+	key, overflow := s.overflowFromProto(req.Overflow)
+	msg := Message{
+		SocketID: ID(req.SocketId),
+		Data:     req.Data,
+		Status:   status,
+		Key:      key,
+		Priority: Priority(req.Priority),
+		Overflow: overflow,
+	}
+
+	select {
+	case s.Sockets.SocketMessages(msg.SocketID) <- msg:
+		glog.V(3).Info("Streamed message sent")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case st := <-status:
+		switch st {
+		case Delivered:
+			report.Delivered++
+			return nil
+		case QueueFull:
+			report.QueueFull++
+		case NotFound:
+			report.NotFound++
+		}
+		report.Failures = append(report.Failures, &SocketDelivery{
+			SocketId: req.SocketId,
+			Status:   deliveryStatusToProto[st],
+		})
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushReport sends the report if anything happened since the previous one
+// and resets it.
+func flushReport(stream Sender_SendStreamServer, report *DeliveryReport) error {
+	if report.Delivered+report.QueueFull+report.NotFound+report.Invalid == 0 {
+		return nil
+	}
+	if err := stream.Send(report); err != nil {
+		return err
+	}
+	*report = DeliveryReport{}
+	return nil
+}
+
+// deliveryError maps an unsuccessful delivery status to a grpc error.
+func deliveryError(socketID ID, status DeliveryStatus) error {
+	switch status {
+	case Delivered:
+		return nil
+	case NotFound:
+		return grpc.Errorf(codes.NotFound, "socket not found: %s", socketID)
+	case QueueFull:
+		return grpc.Errorf(codes.ResourceExhausted, "socket queue full: %s", socketID)
+	}
+	return grpc.Errorf(codes.Unknown, "unknown delivery status: %s", status)
+}
+
+func (s *Sender) SendMulticast(ctx context.Context, req *MulticastRequest) (_ *MulticastReply, err error) {
+	if err := s.begin("SendMulticast"); err != nil {
+		return nil, err
+	}
+	defer s.end("SendMulticast", time.Now(), &err)
+
+	if len(req.Data) == 0 {
+		return nil, errors.New("empty message")
+	}
+	if len(req.SocketIds) == 0 {
+		return nil, errors.New("no sockets specified")
+	}
+	if err := validateOverflow(req.Overflow); err != nil {
+		return nil, err
+	}
+
+	socketIDs := make([]ID, len(req.SocketIds))
+	for i, id := range req.SocketIds {
+		socketIDs[i] = ID(id)
+	}
+	key, overflow := s.overflowFromProto(req.Overflow)
+	deliveries, err := s.multicast(ctx, Multicast{
+		SocketIDs: socketIDs,
+		Data:      req.Data,
+		Key:       key,
+		Priority:  Priority(req.Priority),
+		Overflow:  overflow,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MulticastReply{Deliveries: deliveries}, nil
+}
+
+func (s *Sender) Broadcast(ctx context.Context, req *BroadcastRequest) (_ *BroadcastReply, err error) {
+	if err := s.begin("Broadcast"); err != nil {
+		return nil, err
+	}
+	defer s.end("Broadcast", time.Now(), &err)
+
+	if len(req.Data) == 0 {
+		return nil, errors.New("empty message")
+	}
+	if err := validateOverflow(req.Overflow); err != nil {
+		return nil, err
+	}
+
+	key, overflow := s.overflowFromProto(req.Overflow)
+	deliveries, err := s.multicast(ctx, Multicast{
+		Broadcast: true,
+		Data:      req.Data,
+		Key:       key,
+		Priority:  Priority(req.Priority),
+		Overflow:  overflow,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BroadcastReply{Deliveries: deliveries}, nil
+}
+
+func (s *Sender) SendToUser(ctx context.Context, req *UserRequest) (_ *UserReply, err error) {
+	if err := s.begin("SendToUser"); err != nil {
+		return nil, err
+	}
+	defer s.end("SendToUser", time.Now(), &err)
+
+	if len(req.Data) == 0 {
+		return nil, errors.New("empty message")
+	}
+	if req.UserId == "" {
+		return nil, errors.New("missing user id")
+	}
+	if err := validateOverflow(req.Overflow); err != nil {
+		return nil, err
+	}
+
+	key, overflow := s.overflowFromProto(req.Overflow)
+	deliveries, err := s.multicast(ctx, Multicast{
+		UserID:   req.UserId,
+		Data:     req.Data,
+		Key:      key,
+		Priority: Priority(req.Priority),
+		Overflow: overflow,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &UserReply{Deliveries: deliveries}, nil
+}
+
+func (s *Sender) PublishToTopic(ctx context.Context, req *PublishRequest) (_ *PublishReply, err error) {
+	if err := s.begin("PublishToTopic"); err != nil {
+		return nil, err
+	}
+	defer s.end("PublishToTopic", time.Now(), &err)
+
+	if len(req.Data) == 0 {
+		return nil, errors.New("empty message")
+	}
+	if req.Topic == "" {
+		return nil, errors.New("missing topic")
+	}
+	if err := validateOverflow(req.Overflow); err != nil {
+		return nil, err
+	}
+
+	key, overflow := s.overflowFromProto(req.Overflow)
+	deliveries, err := s.multicast(ctx, Multicast{
+		Topic:    req.Topic,
+		Data:     req.Data,
+		Key:      key,
+		Priority: Priority(req.Priority),
+		Overflow: overflow,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PublishReply{Deliveries: deliveries}, nil
+}
+
+func (s *Sender) Subscribe(ctx context.Context, req *SubscriptionRequest) (_ *SubscriptionReply, err error) {
+	if err := s.begin("Subscribe"); err != nil {
+		return nil, err
+	}
+	defer s.end("Subscribe", time.Now(), &err)
+
+	if req.Topic == "" {
+		return nil, errors.New("missing topic")
+	}
+	if err := s.changeTopic(ctx, s.Sockets.Subscribe, req); err != nil {
+		return nil, err
+	}
+	return &SubscriptionReply{}, nil
+}
+
+func (s *Sender) Unsubscribe(ctx context.Context, req *SubscriptionRequest) (_ *SubscriptionReply, err error) {
+	if err := s.begin("Unsubscribe"); err != nil {
+		return nil, err
+	}
+	defer s.end("Unsubscribe", time.Now(), &err)
+
+	if req.Topic == "" {
+		return nil, errors.New("missing topic")
+	}
+	if err := s.changeTopic(ctx, s.Sockets.Unsubscribe, req); err != nil {
+		return nil, err
+	}
+	return &SubscriptionReply{}, nil
+}
+
+// changeTopic applies the subscription change unless the context is done
+// first.
+func (s *Sender) changeTopic(ctx context.Context, change func(ID, string) error, req *SubscriptionRequest) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- change(ID(req.SocketId), req.Topic)
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return subscriptionError(ID(req.SocketId), err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// subscriptionError maps a registry subscription error to a grpc error.
+func subscriptionError(socketID ID, err error) error {
+	if err == ErrNotFound {
+		return grpc.Errorf(codes.NotFound, "socket not found: %s", socketID)
+	}
+	if err == ErrClosed {
+		return grpc.Errorf(codes.Unavailable, "server is shutting down")
+	}
+	return err
+}
+
+// multicast sends the message to the registry and waits for the delivery results.
+func (s *Sender) multicast(ctx context.Context, msg Multicast) ([]*SocketDelivery, error) {
+	results := make(chan []Delivery, 1)
+	msg.Results = results
+
+	select {
+	case s.Sockets.Multicasts() <- msg:
+		glog.V(3).Info("Multicast message sent")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case deliveries := <-results:
+		return deliveriesToProto(deliveries), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var overflowActionFromProto = map[Overflow_Action]OverflowAction{
+	Overflow_DROP_NEWEST: DropNewest,
+	Overflow_DROP_OLDEST: DropOldest,
+	Overflow_COALESCE:    Coalesce,
+	Overflow_BLOCK:       Block,
+	Overflow_DISCONNECT:  Disconnect,
+}
+
+// overflowFromProto returns the coalescing key and the overflow policy
+// requested for a message. The policy is nil if the socket's own policy
+// should be used. The requested timeout is capped by MaxOverflowTimeout.
+func (s *Sender) overflowFromProto(o *Overflow) (string, *OverflowPolicy) {
+	if o == nil {
+		return "", nil
+	}
+	action, ok := overflowActionFromProto[o.Action]
+	if !ok {
+		return o.Key, nil
+	}
+	maxTimeout := s.MaxOverflowTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = DefaultMaxOverflowTimeout
+	}
+	timeout := time.Duration(o.TimeoutMs) * time.Millisecond
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	return o.Key, &OverflowPolicy{
+		Action:    action,
+		Timeout:   timeout,
+		CloseCode: int(o.CloseCode),
+	}
+}
+
+var deliveryStatusToProto = map[DeliveryStatus]SocketDelivery_Status{
+	Delivered: SocketDelivery_DELIVERED,
+	QueueFull: SocketDelivery_QUEUE_FULL,
+	NotFound:  SocketDelivery_NOT_FOUND,
+}
+
+func deliveriesToProto(deliveries []Delivery) []*SocketDelivery {
+	res := make([]*SocketDelivery, len(deliveries))
+	for i, d := range deliveries {
+		res[i] = &SocketDelivery{
+			SocketId: int64(d.SocketID),
+			Status:   deliveryStatusToProto[d.Status],
+		}
+	}
+	return res
+}
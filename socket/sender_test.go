@@ -0,0 +1,541 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package socket_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/protobuf/proto"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/metadata"
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+func runRegistry(t *testing.T) (*socket.RegistryServer, func()) {
+	reg := socket.NewRegistry()
+	done := make(chan struct{})
+	go func() {
+		reg.Run()
+		close(done)
+	}()
+	return reg, func() {
+		reg.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Millisecond):
+			t.Fatal("Registry not closing")
+		}
+	}
+}
+
+func TestSenderSendMulticast(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c1 := make(chan []byte, 1)
+	id1, err := reg.Register(c1)
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+
+	s := &socket.Sender{Sockets: reg}
+	reply, err := s.SendMulticast(context.Background(), &socket.MulticastRequest{
+		SocketIds: []int64{int64(id1), int64(id1) + 1},
+		Data:      []byte("abc"),
+	})
+	if err != nil {
+		t.Fatalf("Sending multicast should not fail but got: %s", err)
+	}
+	checkReceivedMessage(t, c1, "abc")
+
+	expected := []socket.SocketDelivery{
+		{SocketId: int64(id1), Status: socket.SocketDelivery_DELIVERED},
+		{SocketId: int64(id1) + 1, Status: socket.SocketDelivery_NOT_FOUND},
+	}
+	if len(reply.Deliveries) != len(expected) {
+		t.Fatalf("Expecting %d deliveries but got: %v", len(expected), reply.Deliveries)
+	}
+	for i, d := range reply.Deliveries {
+		if *d != expected[i] {
+			t.Errorf("Expecting delivery %v but got %v", expected[i], *d)
+		}
+	}
+}
+
+func TestSenderSendMulticastNoSockets(t *testing.T) {
+	s := &socket.Sender{}
+	_, err := s.SendMulticast(context.Background(), &socket.MulticastRequest{
+		Data: []byte("abc"),
+	})
+	if err == nil {
+		t.Error("Multicast without sockets should fail")
+	}
+}
+
+func TestSenderBroadcast(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c1 := make(chan []byte, 1)
+	id1, err := reg.Register(c1)
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+
+	s := &socket.Sender{Sockets: reg}
+	reply, err := s.Broadcast(context.Background(), &socket.BroadcastRequest{
+		Data: []byte("abc"),
+	})
+	if err != nil {
+		t.Fatalf("Broadcast should not fail but got: %s", err)
+	}
+	checkReceivedMessage(t, c1, "abc")
+	if len(reply.Deliveries) != 1 || reply.Deliveries[0].SocketId != int64(id1) {
+		t.Errorf("Unexpected deliveries: %v", reply.Deliveries)
+	}
+}
+
+func TestSenderBroadcastEmptyMessage(t *testing.T) {
+	s := &socket.Sender{}
+	_, err := s.Broadcast(context.Background(), &socket.BroadcastRequest{})
+	if err == nil {
+		t.Error("Broadcasting an empty message should fail")
+	}
+}
+
+func TestSenderSendToUserMissingUser(t *testing.T) {
+	s := &socket.Sender{}
+	_, err := s.SendToUser(context.Background(), &socket.UserRequest{
+		Data: []byte("abc"),
+	})
+	if err == nil {
+		t.Error("Sending to a user without user id should fail")
+	}
+}
+
+func TestSenderSendMessage(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c1 := make(chan []byte, 1)
+	id1, err := reg.Register(c1)
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+
+	s := &socket.Sender{Sockets: reg}
+	_, err = s.SendMessage(context.Background(), &socket.SendRequest{
+		SocketId: int64(id1),
+		Data:     []byte("abc"),
+	})
+	if err != nil {
+		t.Fatalf("Sending message should not fail but got: %s", err)
+	}
+	checkReceivedMessage(t, c1, "abc")
+}
+
+func TestSenderSendMessageDeliveryErrors(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c1 := make(chan []byte)
+	id1, err := reg.Register(c1)
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+
+	s := &socket.Sender{Sockets: reg}
+	_, err = s.SendMessage(context.Background(), &socket.SendRequest{
+		SocketId: int64(id1),
+		Data:     []byte("abc"),
+	})
+	if c := grpc.Code(err); c != codes.ResourceExhausted {
+		t.Errorf("Expecting ResourceExhausted for a full queue but got: %s", err)
+	}
+
+	_, err = s.SendMessage(context.Background(), &socket.SendRequest{
+		SocketId: int64(id1) + 1,
+		Data:     []byte("abc"),
+	})
+	if c := grpc.Code(err); c != codes.NotFound {
+		t.Errorf("Expecting NotFound for an unknown socket but got: %s", err)
+	}
+}
+
+func TestSenderSendMessageCapsOverflowTimeout(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c1 := make(chan []byte)
+	id1, err := reg.Register(c1)
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+
+	s := &socket.Sender{Sockets: reg, MaxOverflowTimeout: 10 * time.Millisecond}
+	start := time.Now()
+	_, err = s.SendMessage(context.Background(), &socket.SendRequest{
+		SocketId: int64(id1),
+		Data:     []byte("abc"),
+		Overflow: &socket.Overflow{Action: socket.Overflow_BLOCK, TimeoutMs: 60000},
+	})
+	if c := grpc.Code(err); c != codes.ResourceExhausted {
+		t.Errorf("Expecting ResourceExhausted for a full queue but got: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expecting the block timeout to be capped but waited %s", elapsed)
+	}
+}
+
+func TestSenderSendMessageInvalidCloseCode(t *testing.T) {
+	t.Parallel()
+	s := &socket.Sender{}
+	for _, code := range []int32{0, 1001, 2999, 5000} {
+		_, err := s.SendMessage(context.Background(), &socket.SendRequest{
+			SocketId: 1,
+			Data:     []byte("abc"),
+			Overflow: &socket.Overflow{Action: socket.Overflow_DISCONNECT, CloseCode: code},
+		})
+		if c := grpc.Code(err); c != codes.InvalidArgument {
+			t.Errorf("Expecting close code %d to be rejected but got: %v", code, err)
+		}
+	}
+}
+
+func TestSenderFanOutInvalidCloseCode(t *testing.T) {
+	t.Parallel()
+	s := &socket.Sender{}
+	overflow := &socket.Overflow{Action: socket.Overflow_DISCONNECT, CloseCode: 1001}
+	calls := map[string]func() error{
+		"SendMulticast": func() error {
+			_, err := s.SendMulticast(context.Background(), &socket.MulticastRequest{
+				SocketIds: []int64{1},
+				Data:      []byte("abc"),
+				Overflow:  overflow,
+			})
+			return err
+		},
+		"Broadcast": func() error {
+			_, err := s.Broadcast(context.Background(), &socket.BroadcastRequest{
+				Data:     []byte("abc"),
+				Overflow: overflow,
+			})
+			return err
+		},
+		"SendToUser": func() error {
+			_, err := s.SendToUser(context.Background(), &socket.UserRequest{
+				UserId:   "user",
+				Data:     []byte("abc"),
+				Overflow: overflow,
+			})
+			return err
+		},
+		"PublishToTopic": func() error {
+			_, err := s.PublishToTopic(context.Background(), &socket.PublishRequest{
+				Topic:    "topic",
+				Data:     []byte("abc"),
+				Overflow: overflow,
+			})
+			return err
+		},
+	}
+	for method, call := range calls {
+		if err := call(); grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expecting %s to reject the close code but got: %v", method, err)
+		}
+	}
+}
+
+func TestSenderPublishToTopic(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c1 := make(chan []byte, 1)
+	id1, err := reg.Register(c1)
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+
+	s := &socket.Sender{Sockets: reg}
+	_, err = s.Subscribe(context.Background(), &socket.SubscriptionRequest{
+		SocketId: int64(id1),
+		Topic:    "match:abc",
+	})
+	if err != nil {
+		t.Fatalf("Subscribing should not fail but got: %s", err)
+	}
+	reply, err := s.PublishToTopic(context.Background(), &socket.PublishRequest{
+		Topic: "match:abc",
+		Data:  []byte("abc"),
+	})
+	if err != nil {
+		t.Fatalf("Publishing should not fail but got: %s", err)
+	}
+	checkReceivedMessage(t, c1, "abc")
+	if len(reply.Deliveries) != 1 {
+		t.Errorf("Expecting 1 delivery but got: %v", reply.Deliveries)
+	}
+}
+
+func TestSenderSubscribeNotFound(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	s := &socket.Sender{Sockets: reg}
+	_, err := s.Subscribe(context.Background(), &socket.SubscriptionRequest{
+		SocketId: 1,
+		Topic:    "match:abc",
+	})
+	if c := grpc.Code(err); c != codes.NotFound {
+		t.Errorf("Expecting NotFound for an unknown socket but got: %v", err)
+	}
+}
+
+func TestSenderSubscribeCanceled(t *testing.T) {
+	t.Parallel()
+	// The registry is not running so the subscription is never handled.
+	reg := socket.NewRegistry()
+	defer reg.Close()
+	s := &socket.Sender{Sockets: reg}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := s.Subscribe(ctx, &socket.SubscriptionRequest{
+		SocketId: 1,
+		Topic:    "match:abc",
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expecting the deadline to be exceeded but got: %v", err)
+	}
+}
+
+func TestSenderDrainRejectsNewCalls(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	s := &socket.Sender{Sockets: reg}
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("Draining idle sender should not fail but got: %s", err)
+	}
+	_, err := s.Broadcast(context.Background(), &socket.BroadcastRequest{Data: []byte("abc")})
+	if grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected unavailable error after draining but got: %v", err)
+	}
+}
+
+func TestSenderDrainWaitsForInflightCalls(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c := make(chan []byte, 1)
+	id, err := reg.Register(c)
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+
+	// Registry blocks until released so the message call stays in flight.
+	blocked := &blockingRegistry{
+		Registry: reg,
+		entered:  make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+	s := &socket.Sender{Sockets: blocked}
+	sent := make(chan error, 1)
+	go func() {
+		_, err := s.SendMessage(context.Background(), &socket.SendRequest{SocketId: int64(id), Data: []byte("abc")})
+		sent <- err
+	}()
+	<-blocked.entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected drain to time out but got: %v", err)
+	}
+
+	close(blocked.release)
+	if err := <-sent; err != nil {
+		t.Fatalf("In-flight call should succeed but got: %s", err)
+	}
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain should succeed after in-flight calls finish but got: %s", err)
+	}
+}
+
+func TestSenderSendStream(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	c1 := make(chan []byte, 1)
+	id1, err := reg.Register(c1)
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+
+	stream := newSendStream(context.Background())
+	stream.requests <- &socket.SendRequest{SocketId: int64(id1), Data: []byte("abc")}
+	stream.requests <- &socket.SendRequest{SocketId: int64(id1), Data: []byte("def")}
+	stream.requests <- &socket.SendRequest{SocketId: int64(id1) + 1, Data: []byte("abc")}
+	stream.requests <- &socket.SendRequest{SocketId: int64(id1)}
+	close(stream.requests)
+
+	s := &socket.Sender{Sockets: reg, ReportInterval: time.Hour}
+	if err := s.SendStream(stream); err != nil {
+		t.Fatalf("Streaming messages should not fail but got: %s", err)
+	}
+	checkReceivedMessage(t, c1, "abc")
+
+	if len(stream.reports) != 1 {
+		t.Fatalf("Expecting a single final report but got: %v", stream.reports)
+	}
+	r := stream.reports[0]
+	if r.Delivered != 1 || r.QueueFull != 1 || r.NotFound != 1 || r.Invalid != 1 {
+		t.Errorf("Unexpected delivery report: %v", r)
+	}
+	if len(r.Failures) != 2 {
+		t.Errorf("Expecting 2 failed deliveries but got: %v", r.Failures)
+	}
+}
+
+func TestSenderSendStreamPeriodicReports(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	stream := newSendStream(context.Background())
+	s := &socket.Sender{Sockets: reg, ReportInterval: time.Millisecond}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.SendStream(stream)
+	}()
+
+	stream.requests <- &socket.SendRequest{SocketId: 1, Data: []byte("abc")}
+	select {
+	case r := <-stream.sent:
+		if r.NotFound != 1 {
+			t.Errorf("Expecting a not found delivery but got: %v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expecting a periodic report")
+	}
+
+	close(stream.requests)
+	if err := <-done; err != nil {
+		t.Fatalf("Streaming messages should not fail but got: %s", err)
+	}
+}
+
+func TestSenderSendStreamCanceled(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream := newSendStream(ctx)
+	s := &socket.Sender{Sockets: reg}
+	if err := s.SendStream(stream); err != context.Canceled {
+		t.Errorf("Expecting the stream to be canceled but got: %v", err)
+	}
+}
+
+func TestSenderDrainStopsStreams(t *testing.T) {
+	t.Parallel()
+	reg, stop := runRegistry(t)
+	defer stop()
+
+	stream := newSendStream(context.Background())
+	s := &socket.Sender{Sockets: reg, ReportInterval: time.Millisecond}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.SendStream(stream)
+	}()
+	// Waiting for the first report makes sure the stream is in flight.
+	stream.requests <- &socket.SendRequest{SocketId: 1, Data: []byte("abc")}
+	<-stream.sent
+
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain should not fail but got: %s", err)
+	}
+	if err := <-done; grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Expecting the stream to be unavailable after draining but got: %v", err)
+	}
+}
+
+// sendStream is an in-memory Sender_SendStreamServer. Closing requests ends
+// the client side of the stream.
+type sendStream struct {
+	ctx      context.Context
+	requests chan *socket.SendRequest
+	sent     chan *socket.DeliveryReport
+	reports  []*socket.DeliveryReport
+}
+
+func newSendStream(ctx context.Context) *sendStream {
+	return &sendStream{
+		ctx:      ctx,
+		requests: make(chan *socket.SendRequest, 10),
+		sent:     make(chan *socket.DeliveryReport, 10),
+	}
+}
+
+func (s *sendStream) Send(r *socket.DeliveryReport) error {
+	c := *r
+	s.reports = append(s.reports, &c)
+	select {
+	case s.sent <- &c:
+	default:
+	}
+	return nil
+}
+
+func (s *sendStream) Recv() (*socket.SendRequest, error) {
+	req, ok := <-s.requests
+	if !ok {
+		return nil, io.EOF
+	}
+	return req, nil
+}
+
+func (s *sendStream) Context() context.Context        { return s.ctx }
+func (s *sendStream) SendProto(m proto.Message) error { return nil }
+func (s *sendStream) RecvProto(m proto.Message) error { return nil }
+func (s *sendStream) SendHeader(metadata.MD) error    { return nil }
+func (s *sendStream) SetTrailer(metadata.MD)          {}
+
+type blockingRegistry struct {
+	socket.Registry
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingRegistry) SocketMessages(socketId socket.ID) chan<- socket.Message {
+	close(r.entered)
+	<-r.release
+	return r.Registry.SocketMessages(socketId)
+}
@@ -0,0 +1,251 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package socket
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var _ Registry = (*ShardedRegistry)(nil)
+
+// ShardedRegistry is an implementation of Registry that partitions the sockets
+// by their id across multiple independent RegistryServer event loops.
+// SocketMessages returns the channel of the shard owning the socket so the
+// messages sent on it go to the shard directly. Messages sent on Messages
+// and Multicasts are handed over to the shards by a pool of dispatchers so
+// messages that are sent concurrently without waiting for their status can
+// be routed in a different order than they were sent in.
+type ShardedRegistry struct {
+	shards []*RegistryServer
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	messages   chan Message
+	multicasts chan Multicast
+}
+
+// NewShardedRegistry constructs a new socket registry with the given number of
+// shards that is ready to be run. At least one shard is always created.
+func NewShardedRegistry(shards int) *ShardedRegistry {
+	if shards < 1 {
+		shards = 1
+	}
+	r := &ShardedRegistry{
+		shards:     make([]*RegistryServer, shards),
+		done:       make(chan struct{}),
+		messages:   make(chan Message),
+		multicasts: make(chan Multicast),
+	}
+	for i := range r.shards {
+		r.shards[i] = NewRegistry()
+	}
+	return r
+}
+
+// Run starts the shards' event loops and the dispatchers that hand the received
+// messages over to them. The method blocks until the registry is closed and
+// is normally be run in a goroutine.
+func (r *ShardedRegistry) Run() {
+	var wg sync.WaitGroup
+	for _, shard := range r.shards {
+		wg.Add(1)
+		go func(shard *RegistryServer) {
+			shard.Run()
+			wg.Done()
+		}(shard)
+	}
+	for range r.shards {
+		wg.Add(1)
+		go func() {
+			r.dispatch()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	glog.Info("Sharded socket registry shut down")
+}
+
+// dispatch forwards the received messages to the shards owning the target sockets.
+func (r *ShardedRegistry) dispatch() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case m := <-r.messages:
+			select {
+			case r.shard(m.SocketID).messages <- m:
+			case <-r.done:
+				return
+			}
+		case m := <-r.multicasts:
+			r.multicast(m)
+		}
+	}
+}
+
+// multicast splits the message between the shards. Their results are merged
+// in the background so the dispatcher doesn't wait for them. Results for
+// explicitly listed sockets are reported in the order they were listed.
+func (r *ShardedRegistry) multicast(m Multicast) {
+	targeted := !m.Broadcast && m.UserID == "" && m.Topic == ""
+	parts := make(map[int]Multicast)
+	if targeted {
+		for _, socketID := range m.SocketIDs {
+			i := r.shardIndex(socketID)
+			part := parts[i]
+			part.SocketIDs = append(part.SocketIDs, socketID)
+			part.Data = m.Data
+			part.Key = m.Key
+			part.Priority = m.Priority
+			part.Overflow = m.Overflow
+			parts[i] = part
+		}
+	} else {
+		for i := range r.shards {
+			parts[i] = m
+		}
+	}
+
+	results := make(map[int]chan []Delivery, len(parts))
+	for i, part := range parts {
+		c := make(chan []Delivery, 1)
+		part.Results = c
+		select {
+		case r.shards[i].multicasts <- part:
+			results[i] = c
+		case <-r.done:
+			return
+		}
+	}
+	if m.Results == nil {
+		return
+	}
+	go r.mergeResults(m, targeted, results)
+}
+
+// mergeResults waits for the shards' results of the multicast and reports
+// them together.
+func (r *ShardedRegistry) mergeResults(m Multicast, targeted bool, results map[int]chan []Delivery) {
+	shardDeliveries := make(map[int][]Delivery, len(results))
+	for i, c := range results {
+		select {
+		case shardDeliveries[i] = <-c:
+		case <-r.done:
+			return
+		}
+	}
+
+	var deliveries []Delivery
+	if targeted {
+		deliveries = make([]Delivery, len(m.SocketIDs))
+		for j, socketID := range m.SocketIDs {
+			i := r.shardIndex(socketID)
+			deliveries[j] = shardDeliveries[i][0]
+			shardDeliveries[i] = shardDeliveries[i][1:]
+		}
+	} else {
+		for _, d := range shardDeliveries {
+			deliveries = append(deliveries, d...)
+		}
+	}
+	m.Results <- deliveries
+}
+
+// shardIndex returns the index of the shard owning the socket.
+func (r *ShardedRegistry) shardIndex(socketId ID) int {
+	return int(uint64(socketId) % uint64(len(r.shards)))
+}
+
+// shard returns the shard owning the socket.
+func (r *ShardedRegistry) shard(socketId ID) *RegistryServer {
+	return r.shards[r.shardIndex(socketId)]
+}
+
+// Close implements the Closer interface.
+// The dispatchers and all the shards terminate (if running).
+func (r *ShardedRegistry) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		for _, shard := range r.shards {
+			shard.Close()
+		}
+	})
+	return nil
+}
+
+// Ping checks that the event loops of all the shards are handling events.
+func (r *ShardedRegistry) Ping(ctx context.Context) error {
+	for i, shard := range r.shards {
+		if err := shard.Ping(ctx); err != nil {
+			return fmt.Errorf("shard %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// Messages implements the Registry interface.
+func (r *ShardedRegistry) Messages() chan<- Message {
+	return r.messages
+}
+
+// SocketMessages implements the Registry interface.
+func (r *ShardedRegistry) SocketMessages(socketId ID) chan<- Message {
+	return r.shard(socketId).messages
+}
+
+// Multicasts implements the Registry interface.
+func (r *ShardedRegistry) Multicasts() chan<- Multicast {
+	return r.multicasts
+}
+
+// Register implements the Registry interface.
+func (r *ShardedRegistry) Register(messages chan []byte) (ID, error) {
+	return r.RegisterSocket(Socket{Messages: messages})
+}
+
+// RegisterUser implements the Registry interface.
+func (r *ShardedRegistry) RegisterUser(userID string, messages chan []byte) (ID, error) {
+	return r.RegisterSocket(Socket{UserID: userID, Messages: messages})
+}
+
+// RegisterSocket implements the Registry interface.
+func (r *ShardedRegistry) RegisterSocket(s Socket) (ID, error) {
+	socketId, err := newID()
+	if err != nil {
+		return 0, err
+	}
+	r.shard(socketId).registerID(socketId, s)
+	return socketId, nil
+}
+
+// Unregister implements the Registry interface.
+func (r *ShardedRegistry) Unregister(socketId ID) {
+	r.shard(socketId).Unregister(socketId)
+}
+
+// Subscribe implements the Registry interface.
+func (r *ShardedRegistry) Subscribe(socketId ID, topic string) error {
+	return r.shard(socketId).Subscribe(socketId, topic)
+}
+
+// Unsubscribe implements the Registry interface.
+func (r *ShardedRegistry) Unsubscribe(socketId ID, topic string) error {
+	return r.shard(socketId).Unsubscribe(socketId, topic)
+}
@@ -0,0 +1,248 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package socket_test
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+func runShardedRegistry(t *testing.T, shards int) (*socket.ShardedRegistry, func()) {
+	reg := socket.NewShardedRegistry(shards)
+	done := make(chan struct{})
+	go func() {
+		reg.Run()
+		close(done)
+	}()
+	return reg, func() {
+		reg.Close()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Millisecond):
+			t.Fatal("Registry not closing")
+		}
+	}
+}
+
+func TestShardedRegistrySendMessage(t *testing.T) {
+	t.Parallel()
+	reg, stop := runShardedRegistry(t, 4)
+	defer stop()
+
+	channels := make([]chan []byte, 10)
+	ids := make([]socket.ID, len(channels))
+	for i := range channels {
+		channels[i] = make(chan []byte, 1)
+		id, err := reg.Register(channels[i])
+		if err != nil {
+			t.Fatalf("Registering socket should not fail but got: %s", err)
+		}
+		ids[i] = id
+	}
+
+	for i, id := range ids {
+		status := make(chan socket.DeliveryStatus, 1)
+		messages := reg.Messages()
+		if i%2 == 1 {
+			messages = reg.SocketMessages(id)
+		}
+		messages <- socket.Message{
+			SocketID: id,
+			Data:     []byte{byte('a' + i)},
+			Status:   status,
+		}
+		if s := <-status; s != socket.Delivered {
+			t.Errorf("Expecting message to be delivered but got: %s", s)
+		}
+	}
+	for i, c := range channels {
+		checkReceivedMessage(t, c, string([]byte{byte('a' + i)}))
+	}
+}
+
+func TestShardedRegistryMulticastKeepsOrder(t *testing.T) {
+	t.Parallel()
+	reg, stop := runShardedRegistry(t, 4)
+	defer stop()
+
+	var targets []socket.ID
+	var expected []socket.Delivery
+	for i := 0; i < 10; i++ {
+		id, err := reg.Register(make(chan []byte, 1))
+		if err != nil {
+			t.Fatalf("Registering socket should not fail but got: %s", err)
+		}
+		targets = append(targets, id, id+1)
+		expected = append(expected,
+			socket.Delivery{SocketID: id, Status: socket.Delivered},
+			socket.Delivery{SocketID: id + 1, Status: socket.NotFound})
+	}
+
+	results := make(chan []socket.Delivery, 1)
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		SocketIDs: targets,
+		Data:      []byte("abc"),
+		Results:   results,
+	})
+	checkDeliveries(t, results, expected)
+}
+
+func TestShardedRegistryMulticastDoesNotBlockDispatcher(t *testing.T) {
+	t.Parallel()
+	reg, stop := runShardedRegistry(t, 1)
+	defer stop()
+
+	c := make(chan []byte, 2)
+	id, err := reg.Register(c)
+	if err != nil {
+		t.Fatalf("Registering socket should not fail but got: %s", err)
+	}
+	results := make(chan []socket.Delivery)
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		SocketIDs: []socket.ID{id},
+		Data:      []byte("abc"),
+		Results:   results,
+	})
+	// The multicast results are not read yet but the messages are still
+	// routed.
+	status := make(chan socket.DeliveryStatus, 1)
+	select {
+	case reg.Messages() <- socket.Message{SocketID: id, Data: []byte("def"), Status: status}:
+	case <-time.After(time.Second):
+		t.Fatal("Dispatcher blocked by the multicast results")
+	}
+	if s := <-status; s != socket.Delivered {
+		t.Errorf("Expecting message to be delivered but got: %s", s)
+	}
+	checkDeliveries(t, results, []socket.Delivery{{SocketID: id, Status: socket.Delivered}})
+}
+
+func TestShardedRegistryUserAndTopic(t *testing.T) {
+	t.Parallel()
+	reg, stop := runShardedRegistry(t, 4)
+	defer stop()
+
+	channels := make([]chan []byte, 5)
+	for i := range channels {
+		channels[i] = make(chan []byte, 2)
+		id, err := reg.RegisterUser("user1", channels[i])
+		if err != nil {
+			t.Fatalf("Registering socket should not fail but got: %s", err)
+		}
+		if err := reg.Subscribe(id, "lobby:42"); err != nil {
+			t.Fatalf("Subscribing should not fail but got: %s", err)
+		}
+	}
+
+	results := make(chan []socket.Delivery, 1)
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		UserID:  "user1",
+		Data:    []byte("abc"),
+		Results: results,
+	})
+	if d := <-results; len(d) != len(channels) {
+		t.Errorf("Expecting %d deliveries but got: %v", len(channels), d)
+	}
+	socketSendMulticast(t, reg.Multicasts(), socket.Multicast{
+		Topic:   "lobby:42",
+		Data:    []byte("def"),
+		Results: results,
+	})
+	if d := <-results; len(d) != len(channels) {
+		t.Errorf("Expecting %d deliveries but got: %v", len(channels), d)
+	}
+	for _, c := range channels {
+		checkReceivedMessage(t, c, "abc")
+		checkReceivedMessage(t, c, "def")
+	}
+}
+
+type runnableRegistry interface {
+	socket.Registry
+	Run()
+	Close() error
+}
+
+// benchmarkRegistry measures the message routing throughput of the registry
+// with thousands of concurrent senders.
+func benchmarkRegistry(b *testing.B, reg runnableRegistry) {
+	go reg.Run()
+	defer reg.Close()
+
+	const sockets = 1024
+	ids := make([]socket.ID, sockets)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := range ids {
+		c := make(chan []byte, 128)
+		id, err := reg.Register(c)
+		if err != nil {
+			b.Fatalf("Registering socket should not fail but got: %s", err)
+		}
+		ids[i] = id
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-c:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	data := []byte("abc")
+	var next int
+	var mu sync.Mutex
+	b.SetParallelism(4096 / runtime.GOMAXPROCS(0))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mu.Lock()
+		i := next
+		next++
+		mu.Unlock()
+		status := make(chan socket.DeliveryStatus, 1)
+		for pb.Next() {
+			reg.SocketMessages(ids[i%sockets]) <- socket.Message{
+				SocketID: ids[i%sockets],
+				Data:     data,
+				Status:   status,
+			}
+			<-status
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
+
+func BenchmarkRegistryServer(b *testing.B) {
+	benchmarkRegistry(b, socket.NewRegistry())
+}
+
+func BenchmarkShardedRegistry4(b *testing.B) {
+	benchmarkRegistry(b, socket.NewShardedRegistry(4))
+}
+
+func BenchmarkShardedRegistry16(b *testing.B) {
+	benchmarkRegistry(b, socket.NewShardedRegistry(16))
+}
@@ -6,11 +6,26 @@
 Package socket is a generated protocol buffer package.
 
 It is generated from these files:
+
 	socket.proto
 
 It has these top-level messages:
+
+	Overflow
 	SendRequest
 	SendReply
+	MulticastRequest
+	MulticastReply
+	BroadcastRequest
+	BroadcastReply
+	UserRequest
+	UserReply
+	PublishRequest
+	PublishReply
+	SubscriptionRequest
+	SubscriptionReply
+	SocketDelivery
+	DeliveryReport
 */
 package socket
 
@@ -28,15 +43,113 @@ var _ grpc.ClientConn
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
 
+type SocketDelivery_Status int32
+
+const (
+	SocketDelivery_DELIVERED  SocketDelivery_Status = 0
+	SocketDelivery_QUEUE_FULL SocketDelivery_Status = 1
+	SocketDelivery_NOT_FOUND  SocketDelivery_Status = 2
+)
+
+var SocketDelivery_Status_name = map[int32]string{
+	0: "DELIVERED",
+	1: "QUEUE_FULL",
+	2: "NOT_FOUND",
+}
+var SocketDelivery_Status_value = map[string]int32{
+	"DELIVERED":  0,
+	"QUEUE_FULL": 1,
+	"NOT_FOUND":  2,
+}
+
+func (x SocketDelivery_Status) String() string {
+	return proto.EnumName(SocketDelivery_Status_name, int32(x))
+}
+
+type MessagePriority int32
+
+const (
+	MessagePriority_NORMAL MessagePriority = 0
+	MessagePriority_HIGH   MessagePriority = 1
+	MessagePriority_LOW    MessagePriority = 2
+)
+
+var MessagePriority_name = map[int32]string{
+	0: "NORMAL",
+	1: "HIGH",
+	2: "LOW",
+}
+var MessagePriority_value = map[string]int32{
+	"NORMAL": 0,
+	"HIGH":   1,
+	"LOW":    2,
+}
+
+func (x MessagePriority) String() string {
+	return proto.EnumName(MessagePriority_name, int32(x))
+}
+
+type Overflow_Action int32
+
+const (
+	Overflow_SOCKET_DEFAULT Overflow_Action = 0
+	Overflow_DROP_NEWEST    Overflow_Action = 1
+	Overflow_DROP_OLDEST    Overflow_Action = 2
+	Overflow_COALESCE       Overflow_Action = 3
+	Overflow_BLOCK          Overflow_Action = 4
+	Overflow_DISCONNECT     Overflow_Action = 5
+)
+
+var Overflow_Action_name = map[int32]string{
+	0: "SOCKET_DEFAULT",
+	1: "DROP_NEWEST",
+	2: "DROP_OLDEST",
+	3: "COALESCE",
+	4: "BLOCK",
+	5: "DISCONNECT",
+}
+var Overflow_Action_value = map[string]int32{
+	"SOCKET_DEFAULT": 0,
+	"DROP_NEWEST":    1,
+	"DROP_OLDEST":    2,
+	"COALESCE":       3,
+	"BLOCK":          4,
+	"DISCONNECT":     5,
+}
+
+func (x Overflow_Action) String() string {
+	return proto.EnumName(Overflow_Action_name, int32(x))
+}
+
+type Overflow struct {
+	Action    Overflow_Action `protobuf:"varint,1,opt,name=action,enum=socket.Overflow_Action" json:"action,omitempty"`
+	Key       string          `protobuf:"bytes,2,opt,name=key" json:"key,omitempty"`
+	TimeoutMs int64           `protobuf:"varint,3,opt,name=timeout_ms" json:"timeout_ms,omitempty"`
+	CloseCode int32           `protobuf:"varint,4,opt,name=close_code" json:"close_code,omitempty"`
+}
+
+func (m *Overflow) Reset()         { *m = Overflow{} }
+func (m *Overflow) String() string { return proto.CompactTextString(m) }
+func (*Overflow) ProtoMessage()    {}
+
 type SendRequest struct {
-	SocketId int64  `protobuf:"varint,1,opt,name=socket_id" json:"socket_id,omitempty"`
-	Data     []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	SocketId int64           `protobuf:"varint,1,opt,name=socket_id" json:"socket_id,omitempty"`
+	Data     []byte          `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Overflow *Overflow       `protobuf:"bytes,3,opt,name=overflow" json:"overflow,omitempty"`
+	Priority MessagePriority `protobuf:"varint,4,opt,name=priority,enum=socket.MessagePriority" json:"priority,omitempty"`
 }
 
 func (m *SendRequest) Reset()         { *m = SendRequest{} }
 func (m *SendRequest) String() string { return proto.CompactTextString(m) }
 func (*SendRequest) ProtoMessage()    {}
 
+func (m *SendRequest) GetOverflow() *Overflow {
+	if m != nil {
+		return m.Overflow
+	}
+	return nil
+}
+
 type SendReply struct {
 }
 
@@ -44,13 +157,198 @@ func (m *SendReply) Reset()         { *m = SendReply{} }
 func (m *SendReply) String() string { return proto.CompactTextString(m) }
 func (*SendReply) ProtoMessage()    {}
 
+type MulticastRequest struct {
+	SocketIds []int64         `protobuf:"varint,1,rep,name=socket_ids" json:"socket_ids,omitempty"`
+	Data      []byte          `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Overflow  *Overflow       `protobuf:"bytes,3,opt,name=overflow" json:"overflow,omitempty"`
+	Priority  MessagePriority `protobuf:"varint,4,opt,name=priority,enum=socket.MessagePriority" json:"priority,omitempty"`
+}
+
+func (m *MulticastRequest) Reset()         { *m = MulticastRequest{} }
+func (m *MulticastRequest) String() string { return proto.CompactTextString(m) }
+func (*MulticastRequest) ProtoMessage()    {}
+
+func (m *MulticastRequest) GetOverflow() *Overflow {
+	if m != nil {
+		return m.Overflow
+	}
+	return nil
+}
+
+type MulticastReply struct {
+	Deliveries []*SocketDelivery `protobuf:"bytes,1,rep,name=deliveries" json:"deliveries,omitempty"`
+}
+
+func (m *MulticastReply) Reset()         { *m = MulticastReply{} }
+func (m *MulticastReply) String() string { return proto.CompactTextString(m) }
+func (*MulticastReply) ProtoMessage()    {}
+
+func (m *MulticastReply) GetDeliveries() []*SocketDelivery {
+	if m != nil {
+		return m.Deliveries
+	}
+	return nil
+}
+
+type BroadcastRequest struct {
+	Data     []byte          `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	Overflow *Overflow       `protobuf:"bytes,2,opt,name=overflow" json:"overflow,omitempty"`
+	Priority MessagePriority `protobuf:"varint,3,opt,name=priority,enum=socket.MessagePriority" json:"priority,omitempty"`
+}
+
+func (m *BroadcastRequest) Reset()         { *m = BroadcastRequest{} }
+func (m *BroadcastRequest) String() string { return proto.CompactTextString(m) }
+func (*BroadcastRequest) ProtoMessage()    {}
+
+func (m *BroadcastRequest) GetOverflow() *Overflow {
+	if m != nil {
+		return m.Overflow
+	}
+	return nil
+}
+
+type BroadcastReply struct {
+	Deliveries []*SocketDelivery `protobuf:"bytes,1,rep,name=deliveries" json:"deliveries,omitempty"`
+}
+
+func (m *BroadcastReply) Reset()         { *m = BroadcastReply{} }
+func (m *BroadcastReply) String() string { return proto.CompactTextString(m) }
+func (*BroadcastReply) ProtoMessage()    {}
+
+func (m *BroadcastReply) GetDeliveries() []*SocketDelivery {
+	if m != nil {
+		return m.Deliveries
+	}
+	return nil
+}
+
+type UserRequest struct {
+	UserId   string          `protobuf:"bytes,1,opt,name=user_id" json:"user_id,omitempty"`
+	Data     []byte          `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Overflow *Overflow       `protobuf:"bytes,3,opt,name=overflow" json:"overflow,omitempty"`
+	Priority MessagePriority `protobuf:"varint,4,opt,name=priority,enum=socket.MessagePriority" json:"priority,omitempty"`
+}
+
+func (m *UserRequest) Reset()         { *m = UserRequest{} }
+func (m *UserRequest) String() string { return proto.CompactTextString(m) }
+func (*UserRequest) ProtoMessage()    {}
+
+func (m *UserRequest) GetOverflow() *Overflow {
+	if m != nil {
+		return m.Overflow
+	}
+	return nil
+}
+
+type UserReply struct {
+	Deliveries []*SocketDelivery `protobuf:"bytes,1,rep,name=deliveries" json:"deliveries,omitempty"`
+}
+
+func (m *UserReply) Reset()         { *m = UserReply{} }
+func (m *UserReply) String() string { return proto.CompactTextString(m) }
+func (*UserReply) ProtoMessage()    {}
+
+func (m *UserReply) GetDeliveries() []*SocketDelivery {
+	if m != nil {
+		return m.Deliveries
+	}
+	return nil
+}
+
+type PublishRequest struct {
+	Topic    string          `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Data     []byte          `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Overflow *Overflow       `protobuf:"bytes,3,opt,name=overflow" json:"overflow,omitempty"`
+	Priority MessagePriority `protobuf:"varint,4,opt,name=priority,enum=socket.MessagePriority" json:"priority,omitempty"`
+}
+
+func (m *PublishRequest) Reset()         { *m = PublishRequest{} }
+func (m *PublishRequest) String() string { return proto.CompactTextString(m) }
+func (*PublishRequest) ProtoMessage()    {}
+
+func (m *PublishRequest) GetOverflow() *Overflow {
+	if m != nil {
+		return m.Overflow
+	}
+	return nil
+}
+
+type PublishReply struct {
+	Deliveries []*SocketDelivery `protobuf:"bytes,1,rep,name=deliveries" json:"deliveries,omitempty"`
+}
+
+func (m *PublishReply) Reset()         { *m = PublishReply{} }
+func (m *PublishReply) String() string { return proto.CompactTextString(m) }
+func (*PublishReply) ProtoMessage()    {}
+
+func (m *PublishReply) GetDeliveries() []*SocketDelivery {
+	if m != nil {
+		return m.Deliveries
+	}
+	return nil
+}
+
+type SubscriptionRequest struct {
+	SocketId int64  `protobuf:"varint,1,opt,name=socket_id" json:"socket_id,omitempty"`
+	Topic    string `protobuf:"bytes,2,opt,name=topic" json:"topic,omitempty"`
+}
+
+func (m *SubscriptionRequest) Reset()         { *m = SubscriptionRequest{} }
+func (m *SubscriptionRequest) String() string { return proto.CompactTextString(m) }
+func (*SubscriptionRequest) ProtoMessage()    {}
+
+type SubscriptionReply struct {
+}
+
+func (m *SubscriptionReply) Reset()         { *m = SubscriptionReply{} }
+func (m *SubscriptionReply) String() string { return proto.CompactTextString(m) }
+func (*SubscriptionReply) ProtoMessage()    {}
+
+type SocketDelivery struct {
+	SocketId int64                 `protobuf:"varint,1,opt,name=socket_id" json:"socket_id,omitempty"`
+	Status   SocketDelivery_Status `protobuf:"varint,2,opt,name=status,enum=socket.SocketDelivery_Status" json:"status,omitempty"`
+}
+
+func (m *SocketDelivery) Reset()         { *m = SocketDelivery{} }
+func (m *SocketDelivery) String() string { return proto.CompactTextString(m) }
+func (*SocketDelivery) ProtoMessage()    {}
+
+type DeliveryReport struct {
+	Delivered uint64            `protobuf:"varint,1,opt,name=delivered" json:"delivered,omitempty"`
+	QueueFull uint64            `protobuf:"varint,2,opt,name=queue_full" json:"queue_full,omitempty"`
+	NotFound  uint64            `protobuf:"varint,3,opt,name=not_found" json:"not_found,omitempty"`
+	Invalid   uint64            `protobuf:"varint,4,opt,name=invalid" json:"invalid,omitempty"`
+	Failures  []*SocketDelivery `protobuf:"bytes,5,rep,name=failures" json:"failures,omitempty"`
+}
+
+func (m *DeliveryReport) Reset()         { *m = DeliveryReport{} }
+func (m *DeliveryReport) String() string { return proto.CompactTextString(m) }
+func (*DeliveryReport) ProtoMessage()    {}
+
+func (m *DeliveryReport) GetFailures() []*SocketDelivery {
+	if m != nil {
+		return m.Failures
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("socket.MessagePriority", MessagePriority_name, MessagePriority_value)
+	proto.RegisterEnum("socket.Overflow_Action", Overflow_Action_name, Overflow_Action_value)
+	proto.RegisterEnum("socket.SocketDelivery_Status", SocketDelivery_Status_name, SocketDelivery_Status_value)
 }
 
 // Client API for Sender service
 
 type SenderClient interface {
 	SendMessage(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendReply, error)
+	SendMulticast(ctx context.Context, in *MulticastRequest, opts ...grpc.CallOption) (*MulticastReply, error)
+	Broadcast(ctx context.Context, in *BroadcastRequest, opts ...grpc.CallOption) (*BroadcastReply, error)
+	SendToUser(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*UserReply, error)
+	PublishToTopic(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishReply, error)
+	Subscribe(ctx context.Context, in *SubscriptionRequest, opts ...grpc.CallOption) (*SubscriptionReply, error)
+	Unsubscribe(ctx context.Context, in *SubscriptionRequest, opts ...grpc.CallOption) (*SubscriptionReply, error)
+	SendStream(ctx context.Context, opts ...grpc.CallOption) (Sender_SendStreamClient, error)
 }
 
 type senderClient struct {
@@ -70,10 +368,102 @@ func (c *senderClient) SendMessage(ctx context.Context, in *SendRequest, opts ..
 	return out, nil
 }
 
+func (c *senderClient) SendMulticast(ctx context.Context, in *MulticastRequest, opts ...grpc.CallOption) (*MulticastReply, error) {
+	out := new(MulticastReply)
+	err := grpc.Invoke(ctx, "/socket.Sender/SendMulticast", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *senderClient) Broadcast(ctx context.Context, in *BroadcastRequest, opts ...grpc.CallOption) (*BroadcastReply, error) {
+	out := new(BroadcastReply)
+	err := grpc.Invoke(ctx, "/socket.Sender/Broadcast", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *senderClient) SendToUser(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*UserReply, error) {
+	out := new(UserReply)
+	err := grpc.Invoke(ctx, "/socket.Sender/SendToUser", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *senderClient) PublishToTopic(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishReply, error) {
+	out := new(PublishReply)
+	err := grpc.Invoke(ctx, "/socket.Sender/PublishToTopic", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *senderClient) Subscribe(ctx context.Context, in *SubscriptionRequest, opts ...grpc.CallOption) (*SubscriptionReply, error) {
+	out := new(SubscriptionReply)
+	err := grpc.Invoke(ctx, "/socket.Sender/Subscribe", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *senderClient) Unsubscribe(ctx context.Context, in *SubscriptionRequest, opts ...grpc.CallOption) (*SubscriptionReply, error) {
+	out := new(SubscriptionReply)
+	err := grpc.Invoke(ctx, "/socket.Sender/Unsubscribe", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *senderClient) SendStream(ctx context.Context, opts ...grpc.CallOption) (Sender_SendStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Sender_serviceDesc.Streams[0], c.cc, "/socket.Sender/SendStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &senderSendStreamClient{stream}
+	return x, nil
+}
+
+type Sender_SendStreamClient interface {
+	Send(*SendRequest) error
+	Recv() (*DeliveryReport, error)
+	grpc.ClientStream
+}
+
+type senderSendStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *senderSendStreamClient) Send(m *SendRequest) error {
+	return x.ClientStream.SendProto(m)
+}
+
+func (x *senderSendStreamClient) Recv() (*DeliveryReport, error) {
+	m := new(DeliveryReport)
+	if err := x.ClientStream.RecvProto(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Server API for Sender service
 
 type SenderServer interface {
 	SendMessage(context.Context, *SendRequest) (*SendReply, error)
+	SendMulticast(context.Context, *MulticastRequest) (*MulticastReply, error)
+	Broadcast(context.Context, *BroadcastRequest) (*BroadcastReply, error)
+	SendToUser(context.Context, *UserRequest) (*UserReply, error)
+	PublishToTopic(context.Context, *PublishRequest) (*PublishReply, error)
+	Subscribe(context.Context, *SubscriptionRequest) (*SubscriptionReply, error)
+	Unsubscribe(context.Context, *SubscriptionRequest) (*SubscriptionReply, error)
+	SendStream(Sender_SendStreamServer) error
 }
 
 func RegisterSenderServer(s *grpc.Server, srv SenderServer) {
@@ -92,6 +482,104 @@ func _Sender_SendMessage_Handler(srv interface{}, ctx context.Context, buf []byt
 	return out, nil
 }
 
+func _Sender_SendMulticast_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(MulticastRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(SenderServer).SendMulticast(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Sender_Broadcast_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(BroadcastRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(SenderServer).Broadcast(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Sender_SendToUser_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(UserRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(SenderServer).SendToUser(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Sender_PublishToTopic_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(PublishRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(SenderServer).PublishToTopic(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Sender_Subscribe_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(SubscriptionRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(SenderServer).Subscribe(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Sender_Unsubscribe_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(SubscriptionRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(SenderServer).Unsubscribe(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Sender_SendStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SenderServer).SendStream(&senderSendStreamServer{stream})
+}
+
+type Sender_SendStreamServer interface {
+	Send(*DeliveryReport) error
+	Recv() (*SendRequest, error)
+	grpc.ServerStream
+}
+
+type senderSendStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *senderSendStreamServer) Send(m *DeliveryReport) error {
+	return x.ServerStream.SendProto(m)
+}
+
+func (x *senderSendStreamServer) Recv() (*SendRequest, error) {
+	m := new(SendRequest)
+	if err := x.ServerStream.RecvProto(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _Sender_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "socket.Sender",
 	HandlerType: (*SenderServer)(nil),
@@ -100,6 +588,37 @@ var _Sender_serviceDesc = grpc.ServiceDesc{
 			MethodName: "SendMessage",
 			Handler:    _Sender_SendMessage_Handler,
 		},
+		{
+			MethodName: "SendMulticast",
+			Handler:    _Sender_SendMulticast_Handler,
+		},
+		{
+			MethodName: "Broadcast",
+			Handler:    _Sender_Broadcast_Handler,
+		},
+		{
+			MethodName: "SendToUser",
+			Handler:    _Sender_SendToUser_Handler,
+		},
+		{
+			MethodName: "PublishToTopic",
+			Handler:    _Sender_PublishToTopic_Handler,
+		},
+		{
+			MethodName: "Subscribe",
+			Handler:    _Sender_Subscribe_Handler,
+		},
+		{
+			MethodName: "Unsubscribe",
+			Handler:    _Sender_Unsubscribe_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SendStream",
+			Handler:       _Sender_SendStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams: []grpc.StreamDesc{},
 }
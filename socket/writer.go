@@ -17,19 +17,48 @@ package socket
 import (
 	"io"
 	"sync"
+	"time"
 
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
 )
 
+// DefaultStarvationLimit is the default number of times in a row a waiting
+// lower priority message can be passed over by the writer.
+const DefaultStarvationLimit = 8
+
+// BinaryWriter is implemented by the writers that can write binary messages.
+// Batch frames are not valid UTF-8 so they are written with WriteBinary if
+// the writer implements it.
+type BinaryWriter interface {
+	WriteBinary(p []byte) (int, error)
+}
+
 // MessageWriter is a worker that writes the messages to the specified io.Writer.
 // If the Reader is set it will be closed after the Run terminates.
-// The Reader should not be set while the writer is running.
+// The high and low priority messages are taken from HighMessages and
+// LowMessages if they are set. Messages of a higher priority are written
+// first but a lower priority queue that was passed over StarvationLimit times
+// in a row while it had messages waiting is served next.
+// If Batch is set the queued messages are combined into batch frames of at
+// most BatchSize bytes. The writer waits up to BatchLinger for more messages
+// before writing a batch frame that is not full.
+// The fields should not be set while the writer is running.
 type MessageWriter struct {
 	w         io.Writer
 	messages  chan []byte
 	close     chan struct{}
 	closeOnce sync.Once
+	skips     [numPriorities]int
+	pending   []byte
 	Reader    io.Closer
+
+	HighMessages    chan []byte
+	LowMessages     chan []byte
+	StarvationLimit int
+
+	Batch       bool
+	BatchSize   int
+	BatchLinger time.Duration
 }
 
 // NewMessageWriter constructs a new MessageWriter for a given writer.
@@ -51,18 +80,138 @@ func (w *MessageWriter) Run() {
 		}
 	}()
 	for {
-		select {
-		case msg := <-w.messages:
-			glog.V(4).Info("Writing message")
-			_, err := w.w.Write(msg)
-			if err != nil {
-				glog.Warning("Unable to write: ", err)
-				return
-			}
-		case <-w.close:
+		msg, ok := w.next()
+		if !ok {
 			glog.Info("Closing message writer")
 			return
 		}
+		count := 1
+		if w.Batch {
+			msg, count = w.batch(msg)
+			writerBatches.Inc()
+		}
+		glog.V(4).Info("Writing message")
+		_, err := w.write(msg)
+		if err != nil {
+			glog.Warning("Unable to write: ", err)
+			return
+		}
+		writerMessages.Add(uint64(count))
+		writerBytes.Add(uint64(len(msg)))
+	}
+}
+
+// write writes the message, as a binary message if it is a batch frame and
+// the writer supports them.
+func (w *MessageWriter) write(msg []byte) (int, error) {
+	if bw, ok := w.w.(BinaryWriter); ok && w.Batch {
+		return bw.WriteBinary(msg)
+	}
+	return w.w.Write(msg)
+}
+
+// batch combines the message with the messages queued after it into a batch
+// frame. It returns the frame and the number of messages in it.
+func (w *MessageWriter) batch(msg []byte) ([]byte, int) {
+	size := w.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	// Without a linger time only the already queued messages are batched.
+	expired := make(chan time.Time)
+	close(expired)
+	timeout := (<-chan time.Time)(expired)
+	if w.BatchLinger > 0 {
+		timer := time.NewTimer(w.BatchLinger)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	frame := appendBatched([]byte{BatchPrefix}, msg)
+	count := 1
+	for len(frame) < size {
+		msg, ok := w.wait(timeout)
+		if !ok {
+			break
+		}
+		if len(frame)+batchedLen(msg) > size {
+			w.pending = msg
+			break
+		}
+		frame = appendBatched(frame, msg)
+		count++
+	}
+	return frame, count
+}
+
+// next waits for the next message to write. It returns false once the writer
+// is closed.
+func (w *MessageWriter) next() ([]byte, bool) {
+	return w.wait(nil)
+}
+
+// wait waits for the next message to write until the timeout fires. It
+// returns false if there is no message or the writer is closed.
+func (w *MessageWriter) wait(timeout <-chan time.Time) ([]byte, bool) {
+	if msg := w.pending; msg != nil {
+		w.pending = nil
+		return msg, true
+	}
+	select {
+	case <-w.close:
+		return nil, false
+	default:
+	}
+
+	// Queues ordered from the highest priority.
+	queues := [...]chan []byte{w.HighMessages, w.messages, w.LowMessages}
+	limit := w.StarvationLimit
+	if limit <= 0 {
+		limit = DefaultStarvationLimit
+	}
+	for i := len(queues) - 1; i > 0; i-- {
+		if w.skips[i] < limit {
+			continue
+		}
+		select {
+		case msg := <-queues[i]:
+			w.served(queues[:], i)
+			return msg, true
+		default:
+			w.skips[i] = 0
+		}
+	}
+	for i, q := range queues {
+		select {
+		case msg := <-q:
+			w.served(queues[:], i)
+			return msg, true
+		default:
+		}
+	}
+
+	select {
+	case msg := <-queues[0]:
+		return msg, true
+	case msg := <-queues[1]:
+		return msg, true
+	case msg := <-queues[2]:
+		return msg, true
+	case <-w.close:
+		return nil, false
+	case <-timeout:
+		return nil, false
+	}
+}
+
+// served counts the queues of a lower priority than the served one that were
+// passed over while they had messages waiting.
+func (w *MessageWriter) served(queues []chan []byte, i int) {
+	w.skips[i] = 0
+	for j := i + 1; j < len(queues); j++ {
+		if len(queues[j]) > 0 {
+			w.skips[j]++
+		}
 	}
 }
 
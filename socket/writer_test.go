@@ -82,6 +82,143 @@ func TestMessageWriterMessagesAreWritten(t *testing.T) {
 	}
 }
 
+func TestMessageWriterWritesHigherPriorityFirst(t *testing.T) {
+	t.Parallel()
+	written := make(chanWriter, 3)
+	w := socket.NewMessageWriter(written, make(chan []byte, 1))
+	w.HighMessages = make(chan []byte, 1)
+	w.LowMessages = make(chan []byte, 1)
+	w.LowMessages <- []byte("l")
+	w.Messages() <- []byte("n")
+	w.HighMessages <- []byte("h")
+	checkWritten(t, w, written, "h", "n", "l")
+}
+
+func TestMessageWriterStarvationLimit(t *testing.T) {
+	t.Parallel()
+	written := make(chanWriter, 5)
+	w := socket.NewMessageWriter(written, make(chan []byte, 4))
+	w.LowMessages = make(chan []byte, 1)
+	w.StarvationLimit = 2
+	w.LowMessages <- []byte("l")
+	for i := 0; i < 4; i++ {
+		w.Messages() <- []byte("n")
+	}
+	checkWritten(t, w, written, "n", "n", "l", "n", "n")
+}
+
+func TestMessageWriterBatchesQueuedMessages(t *testing.T) {
+	t.Parallel()
+	written := make(chanWriter, 2)
+	w := socket.NewMessageWriter(written, make(chan []byte, 3))
+	w.Batch = true
+	w.BatchSize = 8
+	w.Messages() <- []byte("abc")
+	w.Messages() <- []byte("de")
+	w.Messages() <- []byte("fgh")
+	go w.Run()
+	defer w.Close()
+
+	checkBatch(t, written, "abc", "de")
+	checkBatch(t, written, "fgh")
+}
+
+func TestMessageWriterBatchLinger(t *testing.T) {
+	t.Parallel()
+	written := make(chanWriter, 1)
+	w := socket.NewMessageWriter(written, make(chan []byte, 2))
+	w.Batch = true
+	w.BatchLinger = 50 * time.Millisecond
+	go w.Run()
+	defer w.Close()
+
+	sendMessage(t, w.Messages(), "abc")
+	sendMessage(t, w.Messages(), "d")
+	checkBatch(t, written, "abc", "d")
+}
+
+func TestMessageWriterWritesBatchesAsBinary(t *testing.T) {
+	t.Parallel()
+	written := make(chanWriter, 1)
+	binary := make(chanWriter, 1)
+	w := socket.NewMessageWriter(binaryWriter{written, binary}, make(chan []byte, 1))
+	w.Batch = true
+	w.Messages() <- []byte("abc")
+	go w.Run()
+	defer w.Close()
+
+	checkBatch(t, binary, "abc")
+	select {
+	case msg := <-written:
+		t.Errorf("Expecting batch frames to be written as binary but got text '%s'", msg)
+	default:
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	msgs, err := socket.SplitBatch(socket.EncodeBatch([]byte("abc"), nil, []byte("de")))
+	if err != nil {
+		t.Fatalf("Splitting batch should not fail but got: %s", err)
+	}
+	if len(msgs) != 3 || string(msgs[0]) != "abc" || len(msgs[1]) != 0 || string(msgs[2]) != "de" {
+		t.Errorf("Expecting the encoded messages but got %q", msgs)
+	}
+}
+
+func checkBatch(t *testing.T, written chanWriter, expected ...string) {
+	var frame string
+	select {
+	case frame = <-written:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Batch not written")
+	}
+	msgs, err := socket.SplitBatch([]byte(frame))
+	if err != nil {
+		t.Fatalf("Splitting batch should not fail but got: %s", err)
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("Expecting batch of %v but got %q", expected, msgs)
+	}
+	for i := range msgs {
+		if string(msgs[i]) != expected[i] {
+			t.Errorf("Expecting '%s' in the batch but got '%s'", expected[i], msgs[i])
+		}
+	}
+}
+
+// chanWriter sends every written message on the channel.
+type chanWriter chan string
+
+func (c chanWriter) Write(b []byte) (int, error) {
+	c <- string(b)
+	return len(b), nil
+}
+
+type binaryWriter struct {
+	chanWriter
+	binary chanWriter
+}
+
+func (w binaryWriter) WriteBinary(b []byte) (int, error) {
+	return w.binary.Write(b)
+}
+
+// checkWritten runs the writer and checks the order of the written messages.
+func checkWritten(t *testing.T, w *socket.MessageWriter, written chanWriter, expected ...string) {
+	go w.Run()
+	defer w.Close()
+	for i, e := range expected {
+		select {
+		case m := <-written:
+			if m != e {
+				t.Errorf("Expecting message %d to be '%s' but got '%s'", i, e, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Message not written")
+		}
+	}
+}
+
 type WriterError struct{}
 
 func (w *WriterError) Write(b []byte) (int, error) {
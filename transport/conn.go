@@ -0,0 +1,388 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Close status codes defined by RFC 6455.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// maxCloseReason is the maximum size of a close reason so the close frame
+// fits in a control frame.
+const maxCloseReason = maxControlPayload - 2
+
+var (
+	// ErrCloseSent is returned when writing to a connection after a close
+	// frame was sent.
+	ErrCloseSent = errors.New("close frame already sent")
+	// ErrMessageTooLarge is returned when the client sends a message larger
+	// than the maximum message size.
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrFrameTooLarge is returned when the client sends a frame larger than
+	// the maximum frame size.
+	ErrFrameTooLarge = errors.New("frame too large")
+
+	errInvalidUTF8 = errors.New("invalid UTF-8 in text message")
+)
+
+// CloseError is returned by ReadMessage when the client closes the
+// connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("connection closed by client: %d", e.Code)
+	}
+	return fmt.Sprintf("connection closed by client: %d %s", e.Code, e.Reason)
+}
+
+// Conn is the server side of a websocket connection. Messages are written as
+// single text frames. A single goroutine may read from the connection while
+// others write to it.
+type Conn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	request *http.Request
+	deflate *deflate
+	// subprotocol is the negotiated subprotocol. maxMessageSize and
+	// maxFrameSize limit the size of the read messages and frames if they
+	// are positive.
+	subprotocol    string
+	maxMessageSize int64
+	maxFrameSize   int64
+	// pongHandler is called with the payload of every pong read.
+	pongHandler func(data []byte)
+
+	wmu       sync.Mutex
+	w         *bufio.Writer
+	closeSent bool
+	// rawBytes and wireBytes count the written message bytes before and
+	// after compression.
+	rawBytes  uint64
+	wireBytes uint64
+
+	closeOnce sync.Once
+}
+
+func newConn(conn net.Conn, r *bufio.Reader, req *http.Request) *Conn {
+	return &Conn{
+		conn:    conn,
+		r:       r,
+		request: req,
+		w:       bufio.NewWriter(conn),
+	}
+}
+
+// Request returns the handshake request of the connection.
+func (c *Conn) Request() *http.Request {
+	return c.request
+}
+
+// Subprotocol returns the negotiated subprotocol or an empty string if none
+// was negotiated.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// SetPongHandler sets the function called by ReadMessage for every pong
+// received from the client. It must not be called while reading.
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.pongHandler = h
+}
+
+// ReadMessage reads the next message sent by the client. Fragmented messages
+// are reassembled and compressed messages are decompressed. Pings are
+// answered while waiting for the message. Once the client sends a close frame
+// it is echoed back, unless a close frame was already sent, and a *CloseError
+// is returned. Protocol violations close the connection with the matching
+// status code.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	var started, compressed, text bool
+	for {
+		h, err := readFrameHeader(c.r)
+		if err != nil {
+			if err == errControlFragment {
+				c.fail(CloseProtocolError, err)
+			}
+			return nil, err
+		}
+		if err := c.checkHeader(h, started); err != nil {
+			return nil, c.fail(CloseProtocolError, err)
+		}
+		if c.maxFrameSize > 0 && h.length > c.maxFrameSize {
+			return nil, c.fail(CloseMessageTooBig, ErrFrameTooLarge)
+		}
+		if !h.isControl() && c.tooLarge(int64(len(msg))+h.length) {
+			return nil, c.fail(CloseMessageTooBig, ErrMessageTooLarge)
+		}
+		payload, err := readPayload(c.r, h)
+		if err != nil {
+			return nil, err
+		}
+		switch h.opcode {
+		case opPing:
+			if err := c.writeFrame(frameHeader{fin: true, opcode: opPong}, payload); err != nil && err != ErrCloseSent {
+				return nil, err
+			}
+			continue
+		case opPong:
+			if c.pongHandler != nil {
+				c.pongHandler(payload)
+			}
+			continue
+		case opClose:
+			return nil, c.handleClose(payload)
+		case opText, opBinary:
+			started = true
+			compressed = h.rsv1
+			text = h.opcode == opText
+			msg = payload
+		case opContinuation:
+			msg = append(msg, payload...)
+		}
+		if h.fin {
+			break
+		}
+	}
+	if compressed {
+		var err error
+		msg, err = c.deflate.decompress(msg, c.maxMessageSize)
+		if err == ErrMessageTooLarge {
+			return nil, c.fail(CloseMessageTooBig, err)
+		} else if err != nil {
+			return nil, c.fail(CloseInvalidPayload, err)
+		}
+	}
+	if text && !utf8.Valid(msg) {
+		return nil, c.fail(CloseInvalidPayload, errInvalidUTF8)
+	}
+	return msg, nil
+}
+
+// tooLarge reports whether a message of the given size exceeds the maximum
+// message size.
+func (c *Conn) tooLarge(size int64) bool {
+	return c.maxMessageSize > 0 && size > c.maxMessageSize
+}
+
+// fail sends a close frame with the status code and the error as the reason
+// and returns the error.
+func (c *Conn) fail(status int, err error) error {
+	c.WriteClose(status, err.Error())
+	return err
+}
+
+// checkHeader checks that the frame is allowed to follow the previous frames
+// of the message being read.
+func (c *Conn) checkHeader(h frameHeader, started bool) error {
+	switch {
+	case !h.masked:
+		return errUnmasked
+	case h.rsv23, h.rsv1 && c.deflate == nil:
+		return errReservedBits
+	case h.rsv1 && (h.isControl() || h.opcode == opContinuation):
+		return errors.New("compressed control or continuation frame")
+	}
+	switch h.opcode {
+	case opText, opBinary:
+		if started {
+			return errors.New("new message before the previous one finished")
+		}
+	case opContinuation:
+		if !started {
+			return errors.New("continuation frame without a message")
+		}
+	case opClose, opPing, opPong:
+	default:
+		return fmt.Errorf("unknown opcode: %d", h.opcode)
+	}
+	return nil
+}
+
+// handleClose validates the client's close frame and echoes its status code.
+func (c *Conn) handleClose(payload []byte) error {
+	if len(payload) == 0 {
+		c.writeClose(nil)
+		return &CloseError{Code: CloseNoStatus}
+	}
+	if len(payload) == 1 {
+		return c.fail(CloseProtocolError, errors.New("truncated close frame"))
+	}
+	closeErr := &CloseError{
+		Code:   int(binary.BigEndian.Uint16(payload)),
+		Reason: string(payload[2:]),
+	}
+	if !validCloseCode(closeErr.Code) {
+		return c.fail(CloseProtocolError, fmt.Errorf("invalid close code: %d", closeErr.Code))
+	}
+	if !utf8.ValidString(closeErr.Reason) {
+		return c.fail(CloseInvalidPayload, errInvalidUTF8)
+	}
+	c.writeClose(payload[:2])
+	return closeErr
+}
+
+// validCloseCode reports whether the client is allowed to send the close
+// status code.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// Write writes the data as a single text message. The message is compressed
+// if permessage-deflate was negotiated and the message is large enough.
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.writeMessage(opText, p)
+}
+
+// WriteBinary writes the data as a single binary message. It is compressed
+// the same way as the text messages.
+func (c *Conn) WriteBinary(p []byte) (int, error) {
+	return c.writeMessage(opBinary, p)
+}
+
+func (c *Conn) writeMessage(opcode byte, p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	h := frameHeader{fin: true, opcode: opcode}
+	payload := p
+	if c.deflate != nil {
+		compressed, ok, err := c.deflate.compress(p)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			h.rsv1 = true
+			payload = compressed
+		}
+		c.rawBytes += uint64(len(p))
+		c.wireBytes += uint64(len(payload))
+		uncompressedBytes.Add(uint64(len(p)))
+		compressedBytes.Add(uint64(len(payload)))
+	}
+	if err := c.writeFrameLocked(h, payload); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteClose sends a close frame with the status code and the reason to the
+// client. Reasons longer than a close frame allows are truncated. No more
+// messages can be written afterwards.
+func (c *Conn) WriteClose(status int, reason string) error {
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+		// Drop a rune cut in half.
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(status))
+	copy(payload[2:], reason)
+	return c.writeClose(payload)
+}
+
+func (c *Conn) writeClose(payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.writeFrameLocked(frameHeader{fin: true, opcode: opClose}, payload); err != nil {
+		return err
+	}
+	c.closeSent = true
+	return nil
+}
+
+// Ping sends a ping with the data to the client. The data must fit in a
+// control frame.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("ping data too large")
+	}
+	return c.writeFrame(frameHeader{fin: true, opcode: opPing}, data)
+}
+
+func (c *Conn) writeFrame(h frameHeader, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrameLocked(h, payload)
+}
+
+func (c *Conn) writeFrameLocked(h frameHeader, payload []byte) error {
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	return writeFrame(c.w, h, payload)
+}
+
+// SetReadDeadline sets the deadline of the reads from the connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of the writes to the connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Close closes the underlying network connection without sending a close
+// frame.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(c.observeCompression)
+	return c.conn.Close()
+}
+
+// observeCompression records the compression ratio of the connection.
+func (c *Conn) observeCompression() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.deflate == nil || c.rawBytes == 0 {
+		return
+	}
+	ratio := float64(c.wireBytes) / float64(c.rawBytes)
+	compressionRatio.Observe(ratio)
+	glog.V(2).Infof("Connection compression ratio %.2f for %d bytes", ratio, c.rawBytes)
+}
@@ -0,0 +1,373 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// dial performs the websocket handshake with the server and returns the
+// client connection and the handshake response.
+func dial(t *testing.T, srv *httptest.Server, extensions string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if extensions != "" {
+		req.Header.Set("Sec-WebSocket-Extensions", extensions)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return conn, r, resp
+}
+
+// echoServer writes every message it reads back to the client. The error
+// ending the connection is sent to errs if it is set.
+func echoServer(u *Upgrader, errs chan<- error) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				if errs != nil {
+					errs <- err
+				}
+				return
+			}
+			c.Write(msg)
+		}
+	}))
+}
+
+func writeClientFrame(t *testing.T, conn net.Conn, h frameHeader, payload []byte) {
+	h.masked = true
+	h.mask = [4]byte{1, 2, 3, 4}
+	if err := writeFrame(bufio.NewWriter(conn), h, payload); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func readServerFrame(t *testing.T, r *bufio.Reader) (frameHeader, []byte) {
+	h, err := readFrameHeader(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	payload, err := readPayload(r, h)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return h, payload
+}
+
+// closeStatus returns the status code of a close frame payload.
+func closeStatus(payload []byte) int {
+	if len(payload) < 2 {
+		return CloseNoStatus
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func TestUpgradeHandshake(t *testing.T) {
+	srv := echoServer(&Upgrader{}, nil)
+	defer srv.Close()
+	conn, _, resp := dial(t, srv, "permessage-deflate")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected switching protocols but got: %s", resp.Status)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key: %s", accept)
+	}
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		t.Errorf("Expected no extensions without compression but got: %s", ext)
+	}
+}
+
+func TestUpgradeRejectsPlainRequest(t *testing.T) {
+	srv := echoServer(&Upgrader{}, nil)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request but got: %s", resp.Status)
+	}
+}
+
+func TestConnCompressedRoundTrip(t *testing.T) {
+	srv := echoServer(&Upgrader{Compression: &Compression{Level: flate.BestSpeed, Threshold: 16}}, nil)
+	defer srv.Close()
+	conn, r, resp := dial(t, srv, "permessage-deflate; client_max_window_bits")
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "permessage-deflate" {
+		t.Fatalf("Expected permessage-deflate to be negotiated but got: %q", ext)
+	}
+
+	client := newDeflate(deflateParams{level: flate.BestSpeed})
+	msg := bytes.Repeat([]byte("hello websocket "), 16)
+	compressed, _, _ := client.compress(msg)
+	writeClientFrame(t, conn, frameHeader{fin: true, rsv1: true, opcode: opText}, compressed)
+	h, payload := readServerFrame(t, r)
+	if !h.rsv1 || h.opcode != opText {
+		t.Fatalf("Expected compressed text frame but got: %+v", h)
+	}
+	data, err := client.decompress(payload, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !bytes.Equal(data, msg) {
+		t.Errorf("Expected %q but got %q", msg, data)
+	}
+
+	writeClientFrame(t, conn, frameHeader{fin: true, opcode: opText}, []byte("short"))
+	h, payload = readServerFrame(t, r)
+	if h.rsv1 || string(payload) != "short" {
+		t.Errorf("Expected uncompressed short message but got: %+v %q", h, payload)
+	}
+}
+
+func TestConnControlFrames(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := echoServer(&Upgrader{}, errs)
+	defer srv.Close()
+	conn, r, _ := dial(t, srv, "")
+	defer conn.Close()
+
+	writeClientFrame(t, conn, frameHeader{fin: true, opcode: opPing}, []byte("ping"))
+	writeClientFrame(t, conn, frameHeader{opcode: opText}, []byte("frag"))
+	writeClientFrame(t, conn, frameHeader{fin: true, opcode: opContinuation}, []byte("ment"))
+	if h, payload := readServerFrame(t, r); h.opcode != opPong || string(payload) != "ping" {
+		t.Errorf("Expected pong but got: %+v %q", h, payload)
+	}
+	if h, payload := readServerFrame(t, r); h.opcode != opText || string(payload) != "fragment" {
+		t.Errorf("Expected reassembled message but got: %+v %q", h, payload)
+	}
+
+	writeClientFrame(t, conn, frameHeader{fin: true, opcode: opClose}, []byte("\x03\xe8bye"))
+	if h, payload := readServerFrame(t, r); h.opcode != opClose || !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+		t.Errorf("Expected close frame echo but got: %+v %v", h, payload)
+	}
+	if _, err := readFrameHeader(r); err != io.EOF {
+		t.Errorf("Expected connection to be closed but got: %v", err)
+	}
+	err := <-errs
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != CloseNormal || closeErr.Reason != "bye" {
+		t.Errorf("Expected close error but got: %v", err)
+	}
+}
+
+func TestConnReadViolations(t *testing.T) {
+	tests := []struct {
+		frames []frameHeader
+		status int
+		err    error
+	}{
+		{[]frameHeader{{fin: true, opcode: opText, length: 11}}, CloseMessageTooBig, ErrFrameTooLarge},
+		{[]frameHeader{{opcode: opBinary, length: 6}, {fin: true, opcode: opContinuation, length: 6}}, CloseMessageTooBig, ErrMessageTooLarge},
+		{[]frameHeader{{fin: true, opcode: opText, length: 2}}, CloseInvalidPayload, errInvalidUTF8},
+		{[]frameHeader{{fin: true, opcode: opContinuation, length: 1}}, CloseProtocolError, nil},
+		{[]frameHeader{{fin: true, opcode: 0x3, length: 1}}, CloseProtocolError, nil},
+	}
+	for _, test := range tests {
+		errs := make(chan error, 1)
+		srv := echoServer(&Upgrader{MaxMessageSize: 10, MaxFrameSize: 8}, errs)
+		conn, r, _ := dial(t, srv, "")
+		for _, h := range test.frames {
+			writeClientFrame(t, conn, h, bytes.Repeat([]byte{0xff}, int(h.length)))
+		}
+		if h, payload := readServerFrame(t, r); h.opcode != opClose || closeStatus(payload) != test.status {
+			t.Errorf("Expected close status %d but got: %+v %q", test.status, h, payload)
+		}
+		if err := <-errs; test.err != nil && err != test.err {
+			t.Errorf("Expected error %v but got: %v", test.err, err)
+		}
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func TestConnDefaultFrameLimit(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := echoServer(&Upgrader{}, errs)
+	defer srv.Close()
+	conn, r, _ := dial(t, srv, "")
+	defer conn.Close()
+
+	// Only the header of a huge frame is sent, the server must reject it
+	// without waiting for or allocating the payload.
+	header := []byte{0x80 | opBinary, 0x80 | 127, 0, 0, 1, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+	if _, err := conn.Write(header); err != nil {
+		t.Fatalf("Writing frame header should not fail but got: %s", err)
+	}
+	if h, payload := readServerFrame(t, r); h.opcode != opClose || closeStatus(payload) != CloseMessageTooBig {
+		t.Errorf("Expected message too big close frame but got: %+v %q", h, payload)
+	}
+	if err := <-errs; err != ErrFrameTooLarge {
+		t.Errorf("Expected frame too large error but got: %v", err)
+	}
+}
+
+func TestReadPayloadTruncated(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("abc"))
+	if _, err := readPayload(r, frameHeader{length: 1 << 40}); err == nil {
+		t.Error("Expected reading a truncated payload to fail")
+	}
+}
+
+func TestConnWriteCloseTruncatesReason(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&Upgrader{}).Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.WriteClose(CloseGoingAway, strings.Repeat("é", 100))
+		if _, err := c.Write([]byte("late")); err != ErrCloseSent {
+			t.Errorf("Expected close sent error but got: %v", err)
+		}
+	}))
+	defer srv.Close()
+	conn, r, _ := dial(t, srv, "")
+	defer conn.Close()
+
+	h, payload := readServerFrame(t, r)
+	if h.opcode != opClose || closeStatus(payload) != CloseGoingAway {
+		t.Fatalf("Expected going away close frame but got: %+v", h)
+	}
+	if reason := payload[2:]; len(reason) != 122 || !utf8.Valid(reason) {
+		t.Errorf("Expected reason truncated to a valid 122 bytes but got %d bytes", len(reason))
+	}
+}
+
+func TestUpgradeSubprotocol(t *testing.T) {
+	tests := []struct {
+		offer    string
+		selected string
+	}{
+		{"v1.socket, v2.socket", "v2.socket"},
+		{"v1.socket", "v1.socket"},
+		{"V2.SOCKET, chat", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		protocols := make(chan string, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := (&Upgrader{Subprotocols: []string{"v2.socket", "v1.socket"}}).Upgrade(w, r)
+			if err != nil {
+				return
+			}
+			protocols <- c.Subprotocol()
+			c.Close()
+		}))
+		conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if test.offer != "" {
+			req.Header.Set("Sec-WebSocket-Protocol", test.offer)
+		}
+		req.Write(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != test.selected {
+			t.Errorf("Expected subprotocol %q for %q but got %q", test.selected, test.offer, p)
+		}
+		if p := <-protocols; p != test.selected {
+			t.Errorf("Expected connection subprotocol %q but got %q", test.selected, p)
+		}
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func TestConnRejectsUnnegotiatedCompression(t *testing.T) {
+	srv := echoServer(&Upgrader{}, nil)
+	defer srv.Close()
+	conn, r, _ := dial(t, srv, "")
+	defer conn.Close()
+
+	writeClientFrame(t, conn, frameHeader{fin: true, rsv1: true, opcode: opText}, []byte("data"))
+	if h, payload := readServerFrame(t, r); h.opcode != opClose || closeStatus(payload) != CloseProtocolError {
+		t.Errorf("Expected protocol error close frame but got: %+v %q", h, payload)
+	}
+}
+
+func TestConnPingPong(t *testing.T) {
+	pongs := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&Upgrader{}).Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetPongHandler(func(data []byte) { pongs <- string(data) })
+		if err := c.Ping([]byte("hello")); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		c.ReadMessage()
+	}))
+	defer srv.Close()
+	conn, r, _ := dial(t, srv, "")
+	defer conn.Close()
+
+	h, payload := readServerFrame(t, r)
+	if h.opcode != opPing || string(payload) != "hello" {
+		t.Fatalf("Expected ping but got: %+v %q", h, payload)
+	}
+	writeClientFrame(t, conn, frameHeader{fin: true, opcode: opPong}, payload)
+	select {
+	case data := <-pongs:
+		if data != "hello" {
+			t.Errorf("Expected pong payload hello but got %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("Pong handler not called")
+	}
+}
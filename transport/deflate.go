@@ -0,0 +1,215 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Compression configures the permessage-deflate extension.
+type Compression struct {
+	// Level is the flate compression level.
+	Level int
+	// Threshold is the minimum size of a message in bytes that is compressed.
+	// Smaller messages are sent uncompressed.
+	Threshold int
+	// ServerNoContextTakeover compresses every message on its own instead of
+	// reusing the compression state of the previous messages. This saves
+	// the memory held by every connection at the cost of the ratio.
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover asks the clients to compress every message on
+	// its own.
+	ClientNoContextTakeover bool
+}
+
+// deflateExtension is the token of the permessage-deflate extension.
+const deflateExtension = "permessage-deflate"
+
+// flateTail is removed from the end of every compressed message and added
+// back before decompressing it.
+var flateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// flateFinal is an empty final block appended after the tail so the
+// decompressor reports the end of the message.
+var flateFinal = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// extension is a single extension offer with its parameters.
+type extension struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions parses the Sec-WebSocket-Extensions headers.
+func parseExtensions(h http.Header) []extension {
+	var exts []extension
+	for _, header := range h[http.CanonicalHeaderKey("Sec-WebSocket-Extensions")] {
+		for _, offer := range strings.Split(header, ",") {
+			parts := strings.Split(offer, ";")
+			ext := extension{
+				name:   strings.TrimSpace(parts[0]),
+				params: make(map[string]string),
+			}
+			if ext.name == "" {
+				continue
+			}
+			for _, p := range parts[1:] {
+				kv := strings.SplitN(p, "=", 2)
+				value := ""
+				if len(kv) == 2 {
+					value = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+				}
+				ext.params[strings.TrimSpace(kv[0])] = value
+			}
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// negotiate picks the first permessage-deflate offer the server can accept
+// and returns the parameters to use and the extension response. It returns
+// nil if no offer is acceptable.
+func (c Compression) negotiate(offers []extension) (*deflateParams, string) {
+	for _, offer := range offers {
+		if offer.name != deflateExtension {
+			continue
+		}
+		params := &deflateParams{
+			level:                   c.Level,
+			threshold:               c.Threshold,
+			serverNoContextTakeover: c.ServerNoContextTakeover,
+			clientNoContextTakeover: c.ClientNoContextTakeover,
+		}
+		ok := true
+		for name, value := range offer.params {
+			switch name {
+			case "server_no_context_takeover":
+				params.serverNoContextTakeover = true
+			case "client_no_context_takeover":
+				params.clientNoContextTakeover = true
+			case "client_max_window_bits":
+				// The server decompresses with the default window which
+				// handles any smaller window the client uses.
+			case "server_max_window_bits":
+				// The compressor always uses the full window.
+				ok = value == "15"
+			default:
+				ok = false
+			}
+		}
+		if !ok {
+			continue
+		}
+		response := deflateExtension
+		if params.serverNoContextTakeover {
+			response += "; server_no_context_takeover"
+		}
+		if params.clientNoContextTakeover {
+			response += "; client_no_context_takeover"
+		}
+		return params, response
+	}
+	return nil, ""
+}
+
+// deflateParams are the negotiated permessage-deflate parameters.
+type deflateParams struct {
+	level                   int
+	threshold               int
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+// deflate compresses and decompresses the messages of a connection.
+type deflate struct {
+	params deflateParams
+
+	buf bytes.Buffer
+	w   *flate.Writer
+	// dict holds the end of the previously decompressed messages used when
+	// the client reuses its compression state.
+	dict []byte
+}
+
+func newDeflate(params deflateParams) *deflate {
+	return &deflate{params: params}
+}
+
+// compress returns the compressed message or false if the message should be
+// sent uncompressed.
+func (d *deflate) compress(msg []byte) ([]byte, bool, error) {
+	if len(msg) < d.params.threshold {
+		return nil, false, nil
+	}
+	d.buf.Reset()
+	if d.w == nil {
+		w, err := flate.NewWriter(&d.buf, d.params.level)
+		if err != nil {
+			return nil, false, fmt.Errorf("creating compressor: %s", err)
+		}
+		d.w = w
+	} else if d.params.serverNoContextTakeover {
+		d.w.Reset(&d.buf)
+	}
+	if _, err := d.w.Write(msg); err != nil {
+		return nil, false, err
+	}
+	if err := d.w.Flush(); err != nil {
+		return nil, false, err
+	}
+	out := d.buf.Bytes()
+	out = out[:len(out)-len(flateTail)]
+	compressed := make([]byte, len(out))
+	copy(compressed, out)
+	return compressed, true, nil
+}
+
+// decompress decompresses a message received with the RSV1 bit set. It
+// returns ErrMessageTooLarge if the message decompresses to more than limit
+// bytes and the limit is positive.
+func (d *deflate) decompress(msg []byte, limit int64) ([]byte, error) {
+	var r io.Reader = flate.NewReaderDict(io.MultiReader(
+		bytes.NewReader(msg),
+		bytes.NewReader(flateTail),
+		bytes.NewReader(flateFinal),
+	), d.dict)
+	defer r.(io.Closer).Close()
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing message: %s", err)
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return nil, ErrMessageTooLarge
+	}
+	if !d.params.clientNoContextTakeover {
+		d.dict = append(d.dict, data...)
+		if len(d.dict) > maxWindow {
+			d.dict = d.dict[len(d.dict)-maxWindow:]
+		}
+	}
+	return data, nil
+}
+
+// maxWindow is the size of the largest deflate window.
+const maxWindow = 1 << 15
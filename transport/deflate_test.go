@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"net/http"
+	"testing"
+)
+
+func TestParseExtensions(t *testing.T) {
+	h := http.Header{}
+	h.Add("Sec-WebSocket-Extensions", `permessage-deflate; client_max_window_bits, permessage-deflate; server_max_window_bits="15"`)
+	h.Add("Sec-WebSocket-Extensions", "x-webkit-deflate-frame")
+	exts := parseExtensions(h)
+	if len(exts) != 3 {
+		t.Fatalf("Expected 3 extensions but got: %v", exts)
+	}
+	if _, ok := exts[0].params["client_max_window_bits"]; !ok || exts[0].name != deflateExtension {
+		t.Errorf("Unexpected first extension: %v", exts[0])
+	}
+	if exts[1].params["server_max_window_bits"] != "15" {
+		t.Errorf("Expected unquoted parameter value but got: %v", exts[1])
+	}
+	if exts[2].name != "x-webkit-deflate-frame" {
+		t.Errorf("Unexpected last extension: %v", exts[2])
+	}
+}
+
+func TestCompressionNegotiate(t *testing.T) {
+	tests := []struct {
+		config   Compression
+		offer    string
+		response string
+	}{
+		{Compression{}, "permessage-deflate", "permessage-deflate"},
+		{Compression{}, "permessage-deflate; client_max_window_bits", "permessage-deflate"},
+		{Compression{}, "permessage-deflate; server_no_context_takeover", "permessage-deflate; server_no_context_takeover"},
+		{Compression{ServerNoContextTakeover: true, ClientNoContextTakeover: true}, "permessage-deflate",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{Compression{}, "permessage-deflate; server_max_window_bits=10, permessage-deflate", "permessage-deflate"},
+		{Compression{}, "permessage-deflate; server_max_window_bits=10", ""},
+		{Compression{}, "permessage-deflate; unknown", ""},
+		{Compression{}, "x-webkit-deflate-frame", ""},
+	}
+	for _, test := range tests {
+		h := http.Header{}
+		h.Set("Sec-WebSocket-Extensions", test.offer)
+		params, response := test.config.negotiate(parseExtensions(h))
+		if response != test.response {
+			t.Errorf("Expected response %q for %q but got %q", test.response, test.offer, response)
+		}
+		if (params != nil) != (test.response != "") {
+			t.Errorf("Unexpected parameters for %q: %v", test.offer, params)
+		}
+	}
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	for _, takeover := range []bool{true, false} {
+		params := deflateParams{
+			level:                   flate.BestSpeed,
+			threshold:               10,
+			serverNoContextTakeover: !takeover,
+			clientNoContextTakeover: !takeover,
+		}
+		server, client := newDeflate(params), newDeflate(params)
+		for i := 0; i < 3; i++ {
+			msg := bytes.Repeat([]byte("compressible message "), 20)
+			compressed, ok, err := server.compress(msg)
+			if err != nil || !ok {
+				t.Fatalf("Expected message to be compressed but got: %t %v", ok, err)
+			}
+			if len(compressed) >= len(msg) {
+				t.Errorf("Expected compressed message to be smaller but got %d bytes", len(compressed))
+			}
+			data, err := client.decompress(compressed, 0)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !bytes.Equal(data, msg) {
+				t.Errorf("Expected %q but got %q", msg, data)
+			}
+		}
+	}
+}
+
+func TestDeflateThreshold(t *testing.T) {
+	d := newDeflate(deflateParams{level: flate.BestSpeed, threshold: 10})
+	if _, ok, err := d.compress([]byte("short")); ok || err != nil {
+		t.Errorf("Expected short message to be sent uncompressed but got: %t %v", ok, err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package transport implements the server side of the websocket protocol
+// (RFC 6455) with support for the permessage-deflate extension (RFC 7692).
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Frame opcodes.
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xa
+)
+
+// maxControlPayload is the maximum payload size of a control frame.
+const maxControlPayload = 125
+
+var (
+	errUnmasked        = errors.New("client frame is not masked")
+	errReservedBits    = errors.New("reserved bits set without a negotiated extension")
+	errControlFragment = errors.New("fragmented or oversized control frame")
+)
+
+// frameHeader is the header of a single websocket frame.
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	rsv23  bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+// isControl reports whether the frame is a control frame.
+func (h frameHeader) isControl() bool {
+	return h.opcode&0x8 != 0
+}
+
+// readFrameHeader reads the header of the next frame.
+func readFrameHeader(r *bufio.Reader) (frameHeader, error) {
+	var h frameHeader
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return h, err
+	}
+	h.fin = b[0]&0x80 != 0
+	h.rsv1 = b[0]&0x40 != 0
+	h.rsv23 = b[0]&0x30 != 0
+	h.opcode = b[0] & 0x0f
+	h.masked = b[1]&0x80 != 0
+	switch n := b[1] & 0x7f; n {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return h, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return h, err
+		}
+		h.length = int64(binary.BigEndian.Uint64(b[:8]) & (1<<63 - 1))
+	default:
+		h.length = int64(n)
+	}
+	if h.masked {
+		if _, err := io.ReadFull(r, h.mask[:]); err != nil {
+			return h, err
+		}
+	}
+	if h.isControl() && (!h.fin || h.length > maxControlPayload) {
+		return h, errControlFragment
+	}
+	return h, nil
+}
+
+// readChunk is the most memory allocated for a payload before its bytes
+// arrive so a peer announcing a large frame can't make the reader allocate
+// it upfront.
+const readChunk = 64 * 1024
+
+// readPayload reads the frame's payload and unmasks it.
+func readPayload(r *bufio.Reader, h frameHeader) ([]byte, error) {
+	size := h.length
+	if size > readChunk {
+		size = readChunk
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := io.CopyN(buf, r, h.length); err != nil {
+		return nil, err
+	}
+	payload := buf.Bytes()
+	if h.masked {
+		maskBytes(h.mask, payload)
+	}
+	return payload, nil
+}
+
+// writeFrame writes a single frame. The payload is masked if a mask is given.
+func writeFrame(w *bufio.Writer, h frameHeader, payload []byte) error {
+	var b [14]byte
+	b[0] = h.opcode
+	if h.fin {
+		b[0] |= 0x80
+	}
+	if h.rsv1 {
+		b[0] |= 0x40
+	}
+	n := 2
+	switch l := len(payload); {
+	case l <= 125:
+		b[1] = byte(l)
+	case l <= 0xffff:
+		b[1] = 126
+		binary.BigEndian.PutUint16(b[2:], uint16(l))
+		n += 2
+	default:
+		b[1] = 127
+		binary.BigEndian.PutUint64(b[2:], uint64(l))
+		n += 8
+	}
+	if h.masked {
+		b[1] |= 0x80
+		copy(b[n:], h.mask[:])
+		n += 4
+		masked := make([]byte, len(payload))
+		copy(masked, payload)
+		maskBytes(h.mask, masked)
+		payload = masked
+	}
+	if _, err := w.Write(b[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// maskBytes masks or unmasks the data in place.
+func maskBytes(mask [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package transport
+
+import "github.com/protogalaxy/service-socket/metrics"
+
+var (
+	deflateConnections = metrics.NewCounter("socket_ws_deflate_connections_total", "Total number of connections that negotiated permessage-deflate.")
+	uncompressedBytes  = metrics.NewCounter("socket_ws_uncompressed_bytes_total", "Total number of message bytes written to compressing connections before compression.")
+	compressedBytes    = metrics.NewCounter("socket_ws_compressed_bytes_total", "Total number of message bytes written to compressing connections after compression.")
+	compressionRatio   = metrics.NewHistogram("socket_ws_compression_ratio", "Ratio of the written message bytes after and before compression per connection.",
+		[]float64{.05, .1, .2, .3, .4, .5, .6, .7, .8, .9, 1})
+)
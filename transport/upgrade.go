@@ -0,0 +1,181 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package transport
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// acceptGUID is appended to the client's key to compute the accept key.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultMaxMessageSize and DefaultMaxFrameSize limit the size of the
+// messages and frames read from the connections of an Upgrader that does not
+// set its own limits.
+const (
+	DefaultMaxMessageSize = 1 << 20
+	DefaultMaxFrameSize   = 1 << 20
+)
+
+// Upgrader upgrades HTTP requests to websocket connections.
+type Upgrader struct {
+	// Compression enables the permessage-deflate extension for the clients
+	// that offer it. Compression is disabled if it is not set.
+	Compression *Compression
+	// Subprotocols lists the supported subprotocols in the order of
+	// preference. The first one the client offers is selected.
+	Subprotocols []string
+	// MaxMessageSize limits the size of the messages read from the
+	// connections. Larger messages close the connection.
+	// DefaultMaxMessageSize is used if it is not set.
+	MaxMessageSize int64
+	// MaxFrameSize limits the size of the frames read from the connections.
+	// Larger frames close the connection. DefaultMaxFrameSize is used if it
+	// is not set.
+	MaxFrameSize int64
+	// CheckOrigin reports whether the request's origin may open a
+	// connection. Requests it rejects get a 403 response. All origins are
+	// allowed if it is not set.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Upgrade performs the websocket handshake and takes over the request's
+// connection. If the request is not a valid websocket handshake an error
+// response is sent and an error is returned.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" {
+		return nil, handshakeError(w, http.StatusMethodNotAllowed, "websocket handshake must use GET")
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, handshakeError(w, http.StatusBadRequest, "not a websocket handshake")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, handshakeError(w, http.StatusBadRequest, "unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		return nil, handshakeError(w, http.StatusBadRequest, "missing websocket key")
+	}
+	if u.CheckOrigin != nil && !u.CheckOrigin(r) {
+		return nil, handshakeError(w, http.StatusForbidden, "origin not allowed")
+	}
+
+	var d *deflate
+	var extensions string
+	if u.Compression != nil {
+		if params, response := u.Compression.negotiate(parseExtensions(r.Header)); params != nil {
+			d = newDeflate(*params)
+			extensions = response
+			deflateConnections.Inc()
+		}
+	}
+
+	subprotocol := u.selectSubprotocol(r.Header)
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, handshakeError(w, http.StatusInternalServerError, "connection does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("hijacking connection: %s", err)
+	}
+
+	resp := bufio.NewWriter(conn)
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	resp.WriteString("Upgrade: websocket\r\n")
+	resp.WriteString("Connection: Upgrade\r\n")
+	resp.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n")
+	if subprotocol != "" {
+		resp.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+	}
+	if extensions != "" {
+		resp.WriteString("Sec-WebSocket-Extensions: " + extensions + "\r\n")
+	}
+	resp.WriteString("\r\n")
+	if err := resp.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing handshake response: %s", err)
+	}
+	c := newConn(conn, rw.Reader, r)
+	c.deflate = d
+	c.subprotocol = subprotocol
+	c.maxMessageSize = u.MaxMessageSize
+	if c.maxMessageSize <= 0 {
+		c.maxMessageSize = DefaultMaxMessageSize
+	}
+	c.maxFrameSize = u.MaxFrameSize
+	if c.maxFrameSize <= 0 {
+		c.maxFrameSize = DefaultMaxFrameSize
+	}
+	return c, nil
+}
+
+// selectSubprotocol returns the most preferred supported subprotocol offered
+// by the client or an empty string if there is none.
+func (u *Upgrader) selectSubprotocol(h http.Header) string {
+	offered := headerTokens(h, "Sec-WebSocket-Protocol")
+	for _, supported := range u.Subprotocols {
+		for _, p := range offered {
+			if p == supported {
+				return supported
+			}
+		}
+	}
+	return ""
+}
+
+// handshakeError sends the error response and returns the error.
+func handshakeError(w http.ResponseWriter, status int, reason string) error {
+	http.Error(w, reason, status)
+	return fmt.Errorf("websocket handshake failed: %s", reason)
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value for the client's key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerHasToken reports whether the comma separated header values contain
+// the token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, t := range headerTokens(h, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTokens returns the tokens of the comma separated header values.
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+// ControlPrefix is the first byte of every control frame. The rest of the
+// frame is a JSON encoded ControlFrame. The control frames sent by a client
+// that opted in to framed messages, see FramingParam, are handled by the
+// gateway itself and are not routed to the message broker.
+const ControlPrefix byte = 0
+
+// Control frame types.
+const (
+	ControlSubscribe   = "subscribe"
+	ControlUnsubscribe = "unsubscribe"
+	// ControlReconnect is sent by the gateway before it goes away. The client
+	// should reconnect after the suggested delay.
+	ControlReconnect = "reconnect"
+	// ControlThrottle is sent by the gateway when the client exceeds its rate
+	// limits. The client should wait for the suggested delay before sending
+	// more messages.
+	ControlThrottle = "throttle"
+)
+
+// ControlFrame is a request exchanged between the client and the gateway.
+type ControlFrame struct {
+	Type    string `json:"type"`
+	Topic   string `json:"topic,omitempty"`
+	DelayMs int64  `json:"delay_ms,omitempty"`
+}
+
+// encodeControlFrame encodes the control frame to be sent to the client.
+func encodeControlFrame(f ControlFrame) []byte {
+	data, err := json.Marshal(f)
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{ControlPrefix}, data...)
+}
+
+// writeControlFrame writes the control frame to the client. It is wrapped in
+// a binary batch frame for the clients that opted in to batch frames so they
+// only ever receive a single kind of frame.
+func writeControlFrame(c Conn, batch bool, f ControlFrame) error {
+	var err error
+	if batch {
+		_, err = c.WriteBinary(socket.EncodeBatch(encodeControlFrame(f)))
+	} else {
+		_, err = c.Write(encodeControlFrame(f))
+	}
+	return err
+}
+
+// isControlFrame reports whether the message read from the client is a control frame.
+func isControlFrame(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == ControlPrefix
+}
+
+// parseControlFrame decodes the control frame from the message.
+func parseControlFrame(msg []byte) (*ControlFrame, error) {
+	if !isControlFrame(msg) {
+		return nil, fmt.Errorf("not a control frame")
+	}
+	var f ControlFrame
+	if err := json.Unmarshal(msg[1:], &f); err != nil {
+		return nil, fmt.Errorf("decoding control frame: %s", err)
+	}
+	return &f, nil
+}
+
+// handleControl executes the control frame received from the client.
+func (s *States) handleControl(msg []byte) {
+	f, err := parseControlFrame(msg)
+	if err != nil {
+		glog.Warningf("Invalid control frame from socket %s: %s", s.socketID, err)
+		return
+	}
+	switch f.Type {
+	case ControlSubscribe:
+		err = s.subscribe(f.Topic)
+	case ControlUnsubscribe:
+		err = s.unsubscribe(f.Topic)
+	default:
+		err = fmt.Errorf("unknown control frame type: %s", f.Type)
+	}
+	if err != nil {
+		glog.Warningf("Handling control frame from socket %s: %s", s.socketID, err)
+	}
+}
+
+// subscribe subscribes the socket to the topic if the user is allowed to and
+// the socket has not reached its subscription limit.
+func (s *States) subscribe(topic string) error {
+	if topic == "" {
+		return errors.New("missing topic")
+	}
+	if s.AuthorizeSubscription == nil || !s.AuthorizeSubscription(s.userID, topic) {
+		return fmt.Errorf("subscription to topic %q not allowed", topic)
+	}
+	max := s.MaxSubscriptions
+	if max <= 0 {
+		max = DefaultMaxSubscriptions
+	}
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+	if _, ok := s.subscriptions[topic]; ok {
+		return nil
+	}
+	if len(s.subscriptions) >= max {
+		return fmt.Errorf("subscription limit of %d topics reached", max)
+	}
+	if err := s.Registry.Subscribe(s.socketID, topic); err != nil {
+		return err
+	}
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[string]struct{})
+	}
+	s.subscriptions[topic] = struct{}{}
+	return nil
+}
+
+// unsubscribe removes the socket's subscription to the topic.
+func (s *States) unsubscribe(topic string) error {
+	if topic == "" {
+		return errors.New("missing topic")
+	}
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+	if err := s.Registry.Unsubscribe(s.socketID, topic); err != nil {
+		return err
+	}
+	delete(s.subscriptions, topic)
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"testing"
+
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+func TestControlFrameDetection(t *testing.T) {
+	if isControlFrame([]byte(`{"a":1}`)) {
+		t.Error("Regular message should not be a control frame")
+	}
+	if isControlFrame(nil) {
+		t.Error("Empty message should not be a control frame")
+	}
+	if !isControlFrame([]byte("\x00{}")) {
+		t.Error("Message with control prefix should be a control frame")
+	}
+}
+
+func TestControlFrameParse(t *testing.T) {
+	f, err := parseControlFrame([]byte("\x00{\"type\":\"subscribe\",\"topic\":\"lobby:42\"}"))
+	if err != nil {
+		t.Fatalf("Parsing control frame should not fail but got: %s", err)
+	}
+	if f.Type != ControlSubscribe || f.Topic != "lobby:42" {
+		t.Errorf("Unexpected control frame: %#v", f)
+	}
+	if _, err := parseControlFrame([]byte("\x00{")); err == nil {
+		t.Error("Parsing invalid control frame should fail")
+	}
+}
+
+func TestControlSubscribe(t *testing.T) {
+	var subscribed, unsubscribed string
+	s := &States{
+		Registry: &RegistryMock{
+			OnSubscribe: func(socketID socket.ID, topic string) error {
+				if socketID != 9 {
+					t.Errorf("Unexpected socket id: %s", socketID)
+				}
+				subscribed = topic
+				return nil
+			},
+			OnUnsubscribe: func(socketID socket.ID, topic string) error {
+				unsubscribed = topic
+				return nil
+			},
+		},
+		AuthorizeSubscription: func(userID, topic string) bool {
+			return true
+		},
+	}
+	s.socketID = 9
+	s.handleControl([]byte("\x00{\"type\":\"subscribe\",\"topic\":\"match:abc\"}"))
+	if subscribed != "match:abc" {
+		t.Errorf("Socket should be subscribed to the topic but got: %s", subscribed)
+	}
+	s.handleControl([]byte("\x00{\"type\":\"unsubscribe\",\"topic\":\"match:abc\"}"))
+	if unsubscribed != "match:abc" {
+		t.Errorf("Socket should be unsubscribed from the topic but got: %s", unsubscribed)
+	}
+}
+
+func TestControlSubscribeRejected(t *testing.T) {
+	var subscribed []string
+	topics, _ := ParseTopicAllowlist([]string{"match:*"})
+	s := &States{
+		Registry: &RegistryMock{
+			OnSubscribe: func(socketID socket.ID, topic string) error {
+				subscribed = append(subscribed, topic)
+				return nil
+			},
+		},
+		AuthorizeSubscription: topics.Allowed,
+		MaxSubscriptions:      2,
+	}
+	for _, topic := range []string{"", "admin", "match:a", "match:a", "match:b", "match:c"} {
+		s.handleControl(encodeControlFrame(ControlFrame{Type: ControlSubscribe, Topic: topic}))
+	}
+	if len(subscribed) != 2 || subscribed[0] != "match:a" || subscribed[1] != "match:b" {
+		t.Errorf("Expected only the allowed topics within the limit to be subscribed but got: %q", subscribed)
+	}
+
+	s = &States{Registry: &RegistryMock{
+		OnSubscribe: func(socketID socket.ID, topic string) error {
+			t.Errorf("Socket should not be subscribed without an authorizer but got: %s", topic)
+			return nil
+		},
+	}}
+	s.handleControl(encodeControlFrame(ControlFrame{Type: ControlSubscribe, Topic: "match:a"}))
+}
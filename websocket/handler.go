@@ -15,50 +15,310 @@
 package websocket
 
 import (
-	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/websocket"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/auth"
 	"github.com/protogalaxy/service-socket/devicepresence"
 	"github.com/protogalaxy/service-socket/messagebroker"
+	"github.com/protogalaxy/service-socket/presence"
+	"github.com/protogalaxy/service-socket/ratelimit"
 	"github.com/protogalaxy/service-socket/socket"
+	"github.com/protogalaxy/service-socket/transport"
 )
 
 type ConnectionHandler struct {
-	Registry       *socket.RegistryServer
+	Authenticator  auth.Authenticator
+	Registry       socket.Registry
 	DevicePresence devicepresence.PresenceManagerClient
 	MessageBroker  messagebroker.BrokerClient
+	Leases         *presence.LeaseRenewer
+	GatewayID      string
+	Policies       Policies
+
+	// RouteConcurrency limits the Route calls in flight per connection,
+	// DefaultRouteConcurrency is used if it is not set. The messages are
+	// routed one at a time in order if RouteOrdered is set.
+	RouteConcurrency int
+	RouteOrdered     bool
+
+	// QueueSize is the number of outgoing messages of every priority class
+	// buffered for a connection. DefaultQueueSize is used if it is not set.
+	QueueSize int
+
+	// Overflow is applied to the messages routed to a connection while its
+	// queue is full.
+	Overflow socket.OverflowPolicy
+
+	// BatchSize and BatchLinger bound the batch frames written to the
+	// clients that opted in to them. socket.DefaultBatchSize is used if
+	// BatchSize is not set and only the already queued messages are batched
+	// if BatchLinger is not set.
+	BatchSize   int
+	BatchLinger time.Duration
+
+	// Compression enables permessage-deflate for the clients that offer it.
+	// The messages are sent uncompressed if it is not set.
+	Compression *transport.Compression
+
+	// Subprotocols lists the supported subprotocols in the order of
+	// preference. MaxMessageSize limits the size of the messages read from
+	// the clients, transport.DefaultMaxMessageSize is used if it is not set.
+	Subprotocols   []string
+	MaxMessageSize int64
+
+	// Origins lists the origins allowed to open connections. Only the
+	// gateway's own origin is allowed if it is not set.
+	Origins *OriginAllowlist
+	// MaxFrameSize limits the size of the frames read from the clients,
+	// transport.DefaultMaxFrameSize is used if it is not set.
+	MaxFrameSize int64
+
+	// ConnLimits limit the inbound messages of every connection and
+	// UserLimits those of all the connections of a user. RateLimitAction is
+	// taken on the messages exceeding them.
+	ConnLimits      ratelimit.Limits
+	UserLimits      *ratelimit.Users
+	RateLimitAction RateLimitAction
+
+	// AuthorizeSubscription reports whether the user may subscribe to the
+	// topic with a control frame. The clients can't subscribe to any topic
+	// if it is not set. MaxSubscriptions limits the topics a client can be
+	// subscribed to this way, DefaultMaxSubscriptions is used if it is not
+	// set.
+	AuthorizeSubscription func(userID, topic string) bool
+	MaxSubscriptions      int
+
+	// Keepalive detects the dead and idle clients so their connections run
+	// the normal disconnect path.
+	Keepalive Keepalive
+
+	// ReconnectDelay is the maximum reconnect delay suggested to the clients
+	// when the gateway shuts down. Every client gets a random delay so they
+	// don't all reconnect at once.
+	ReconnectDelay time.Duration
+
+	mu       sync.Mutex
+	draining bool
+	conns    map[*MsgConn]struct{}
+	active   sync.WaitGroup
 }
 
+// DefaultQueueSize is the default number of outgoing messages buffered for
+// a connection.
+const DefaultQueueSize = 10
+
+// Transport is the websocket protocol implementation a MsgConn is built on.
+type Transport interface {
+	Request() *http.Request
+	ReadMessage() ([]byte, error)
+	io.Writer
+	// WriteBinary writes the data as a single binary message.
+	WriteBinary(p []byte) (int, error)
+	// WriteClose sends a close frame with the status code and the reason.
+	WriteClose(status int, reason string) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	// Ping sends a ping to the client and the pong handler is called for
+	// every pong read from the client.
+	Ping(data []byte) error
+	SetPongHandler(h func(data []byte))
+	// Close closes the network connection without sending a close frame.
+	io.Closer
+}
+
+// MsgConn adapts a Transport to the Conn used by the connection states.
+// Keepalive is applied to the connection once the handler starts it. Batch
+// is set if the client opted in to batch frames.
 type MsgConn struct {
-	*websocket.Conn
+	// lastMessage is the time in nanoseconds the last message was read.
+	lastMessage int64
+
+	Transport
+	Keepalive Keepalive
+	Batch     bool
+
+	closeOnce sync.Once
+	mu        sync.Mutex
+	closing   bool
 }
 
-func (c *MsgConn) ReadMessage() ([]byte, error) {
-	var data []byte
-	err := websocket.Message.Receive(c.Conn, &data)
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
+var errCloseSent = errors.New("close frame already sent")
+
+// CloseWithStatus sends a close frame with the status code and the reason to
+// the client. Only a single close frame is ever sent over the connection.
+func (c *MsgConn) CloseWithStatus(status int, reason string) error {
+	err := errCloseSent
+	c.closeOnce.Do(func() {
+		c.extendWriteDeadline()
+		err = c.Transport.WriteClose(status, reason)
+	})
+	return err
+}
+
+// Write writes the message to the client within the write timeout.
+func (c *MsgConn) Write(p []byte) (int, error) {
+	c.extendWriteDeadline()
+	return c.Transport.Write(p)
+}
+
+// WriteBinary writes the binary message to the client within the write
+// timeout.
+func (c *MsgConn) WriteBinary(p []byte) (int, error) {
+	c.extendWriteDeadline()
+	return c.Transport.WriteBinary(p)
+}
+
+// Close sends a normal close frame, unless a close frame was already sent,
+// and closes the connection interrupting any pending reads.
+func (c *MsgConn) Close() error {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	c.CloseWithStatus(CloseNormal, "")
+	return c.Transport.Close()
 }
 
-func (h *ConnectionHandler) Handler() websocket.Handler {
-	return websocket.Handler(func(raw *websocket.Conn) {
-		ws := &MsgConn{raw}
+func (h *ConnectionHandler) Handler() http.Handler {
+	upgrader := &transport.Upgrader{
+		Compression:    h.Compression,
+		Subprotocols:   h.Subprotocols,
+		MaxMessageSize: h.MaxMessageSize,
+		MaxFrameSize:   h.MaxFrameSize,
+		CheckOrigin:    h.Origins.Check,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			glog.V(2).Infof("Rejected websocket connection: %s", err)
+			return
+		}
+		batch := batchRequested(raw.Request())
+		ws := &MsgConn{Transport: raw, Keepalive: h.Keepalive, Batch: batch}
 		defer ws.Close()
-		s := States{
-			Registry:       h.Registry,
-			DevicePresence: h.DevicePresence,
-			MessageBroker:  h.MessageBroker,
-			Conn:           ws,
-			Messages:       make(chan []byte, 10),
+		if !h.track(ws) {
+			ws.CloseWithStatus(CloseGoingAway, "server shutting down")
+			return
+		}
+		defer h.untrack(ws)
+		defer ws.startKeepalive()()
+		queueSize := h.QueueSize
+		if queueSize <= 0 {
+			queueSize = DefaultQueueSize
 		}
+		routeConcurrency := h.RouteConcurrency
+		if routeConcurrency <= 0 {
+			routeConcurrency = DefaultRouteConcurrency
+		}
+		var connLimiter *ratelimit.Limiter
+		if h.ConnLimits.Enabled() {
+			connLimiter = ratelimit.NewLimiter(h.ConnLimits)
+		}
+		s := States{
+			Authenticator:    h.Authenticator,
+			Registry:         h.Registry,
+			DevicePresence:   h.DevicePresence,
+			MessageBroker:    h.MessageBroker,
+			Leases:           h.Leases,
+			GatewayID:        h.GatewayID,
+			Policies:         h.Policies,
+			RouteConcurrency: routeConcurrency,
+			RouteOrdered:     h.RouteOrdered,
+			Overflow:         h.Overflow,
+			Conn:             ws,
+			Messages:         make(chan []byte, queueSize),
+			HighMessages:     make(chan []byte, queueSize),
+			LowMessages:      make(chan []byte, queueSize),
+			Batch:            batch,
+			BatchSize:        h.BatchSize,
+			BatchLinger:      h.BatchLinger,
+			Framing:          framingRequested(raw.Request()),
+			ConnLimiter:      connLimiter,
+			UserLimits:       h.UserLimits,
+			RateLimitAction:  h.RateLimitAction,
 
-		// TODO: set device status to offline
-		defer func() {
-			if s.socketID != 0 {
-				h.Registry.Unregister(s.socketID)
-			}
-		}()
+			AuthorizeSubscription: h.AuthorizeSubscription,
+			MaxSubscriptions:      h.MaxSubscriptions,
+		}
 
 		Run(&s)
 	})
 }
+
+// track adds the connection to the active connections unless the handler
+// is shutting down.
+func (h *ConnectionHandler) track(c *MsgConn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return false
+	}
+	if h.conns == nil {
+		h.conns = make(map[*MsgConn]struct{})
+	}
+	h.conns[c] = struct{}{}
+	h.active.Add(1)
+	return true
+}
+
+// untrack removes the connection from the active connections.
+func (h *ConnectionHandler) untrack(c *MsgConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, c)
+	h.active.Done()
+}
+
+// Shutdown stops accepting new connections and asks all the connected clients
+// to reconnect later. It waits until every connection is handled to the end,
+// including marking its device offline, or until the context is done.
+func (h *ConnectionHandler) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.draining = true
+	conns := make([]*MsgConn, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.mu.Unlock()
+
+	glog.Infof("Closing %d websocket connections", len(conns))
+	for _, c := range conns {
+		go h.goAway(ctx, c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// goAway sends the client a reconnect hint followed by a going away close
+// frame and interrupts the connection's reads.
+func (h *ConnectionHandler) goAway(ctx context.Context, c *MsgConn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetWriteDeadline(deadline)
+	}
+	var delay int64
+	if h.ReconnectDelay > 0 {
+		delay = rand.Int63n(int64(h.ReconnectDelay/time.Millisecond) + 1)
+	}
+	writeControlFrame(c, c.Batch, ControlFrame{
+		Type:    ControlReconnect,
+		DelayMs: delay,
+	})
+	c.CloseWithStatus(CloseGoingAway, "server shutting down")
+	c.Close()
+}
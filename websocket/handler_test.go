@@ -0,0 +1,270 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/websocket"
+	"github.com/protogalaxy/service-socket/auth"
+	"github.com/protogalaxy/service-socket/devicepresence"
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+func dialHandler(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	config, err := websocket.NewConfig(url, srv.URL)
+	if err != nil {
+		t.Fatalf("Creating websocket config should not fail but got: %s", err)
+	}
+	config.Header = http.Header{"Cookie": {"auth=token"}}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("Dialing websocket should not fail but got: %s", err)
+	}
+	return ws
+}
+
+func TestConnectionHandlerShutdown(t *testing.T) {
+	var mu sync.Mutex
+	var statuses []devicepresence.Device_Status
+	online := make(chan struct{})
+	unregistered := make(chan struct{})
+	h := &ConnectionHandler{
+		Authenticator: &AuthenticatorMock{
+			OnAuthenticate: func(ctx context.Context, token string) (string, error) {
+				return "user", nil
+			},
+		},
+		Registry: &RegistryMock{
+			OnRegisterSocket: func(s socket.Socket) (socket.ID, error) {
+				return 123, nil
+			},
+			OnUnregister: func(socketID socket.ID) {
+				close(unregistered)
+			},
+		},
+		DevicePresence: &DevicePresenceMock{
+			OnSetStatus: func(ctx context.Context, req *devicepresence.StatusRequest) (*devicepresence.StatusReply, error) {
+				mu.Lock()
+				statuses = append(statuses, req.Device.Status)
+				mu.Unlock()
+				if req.Device.Status == devicepresence.Device_ONLINE {
+					close(online)
+				}
+				return &devicepresence.StatusReply{}, nil
+			},
+		},
+		ReconnectDelay: time.Second,
+	}
+	srv := httptest.NewServer(h.Handler())
+	defer srv.Close()
+
+	ws := dialHandler(t, srv)
+	defer ws.Close()
+	select {
+	case <-online:
+	case <-time.After(time.Second):
+		t.Fatal("Device not marked online")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown should not fail but got: %s", err)
+	}
+
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Fatalf("Expected reconnect frame but got: %s", err)
+	}
+	if !isControlFrame(data) {
+		t.Fatalf("Expected control frame but got: %q", data)
+	}
+	frame, err := parseControlFrame(data)
+	if err != nil {
+		t.Fatalf("Parsing control frame should not fail but got: %s", err)
+	}
+	if frame.Type != ControlReconnect {
+		t.Errorf("Expected reconnect frame but got: %s", frame.Type)
+	}
+	if frame.DelayMs < 0 || frame.DelayMs > 1000 {
+		t.Errorf("Reconnect delay out of range: %d", frame.DelayMs)
+	}
+	if err := websocket.Message.Receive(ws, &data); err != io.EOF {
+		t.Errorf("Expected connection to be closed but got: %v", err)
+	}
+
+	select {
+	case <-unregistered:
+	default:
+		t.Error("Socket should be unregistered before shutdown returns")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(statuses) != 2 || statuses[1] != devicepresence.Device_OFFLINE {
+		t.Errorf("Expected device to be marked offline but got: %v", statuses)
+	}
+}
+
+func TestConnectionHandlerRejectsAfterShutdown(t *testing.T) {
+	h := &ConnectionHandler{}
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown without connections should not fail but got: %s", err)
+	}
+	srv := httptest.NewServer(h.Handler())
+	defer srv.Close()
+
+	ws := dialHandler(t, srv)
+	defer ws.Close()
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != io.EOF {
+		t.Errorf("Expected connection to be closed but got: %v", err)
+	}
+}
+
+// readRawFrame reads a single unmasked frame sent by the server.
+func readRawFrame(r *bufio.Reader) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(h[1] & 0x7f)
+	switch {
+	case n == 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(ext[0])<<8 | int(ext[1])
+	case n > 126:
+		return 0, nil, errors.New("unexpected extended payload length")
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return h[0] & 0x0f, payload, nil
+}
+
+// rawHandshake opens a websocket connection to the url without a client
+// library so the test can read the frames as sent by the server.
+func rawHandshake(t *testing.T, url string) (net.Conn, *bufio.Reader) {
+	req, _ := http.NewRequest("GET", url, nil)
+	conn, err := net.Dial("tcp", req.URL.Host)
+	if err != nil {
+		t.Fatalf("Dialing should not fail but got: %s", err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Cookie", "auth=token")
+	req.Write(conn)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		t.Fatalf("Expected websocket handshake but got: %v %v", resp, err)
+	}
+	return conn, r
+}
+
+func TestConnectionHandlerWritesBatchFramesAsBinary(t *testing.T) {
+	msg := []byte(strings.Repeat("m", 200))
+	h := &ConnectionHandler{
+		Authenticator: &AuthenticatorMock{
+			OnAuthenticate: func(ctx context.Context, token string) (string, error) {
+				return "user", nil
+			},
+		},
+		Registry: &RegistryMock{
+			OnRegisterSocket: func(s socket.Socket) (socket.ID, error) {
+				s.Messages <- msg
+				return 123, nil
+			},
+			OnUnregister: func(socketID socket.ID) {},
+		},
+		DevicePresence: &DevicePresenceMock{
+			OnSetStatus: func(ctx context.Context, req *devicepresence.StatusRequest) (*devicepresence.StatusReply, error) {
+				return &devicepresence.StatusReply{}, nil
+			},
+		},
+	}
+	srv := httptest.NewServer(h.Handler())
+	defer srv.Close()
+
+	conn, r := rawHandshake(t, srv.URL+"/?"+BatchParam+"=true")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	opcode, payload, err := readRawFrame(r)
+	if err != nil || opcode != 0x2 {
+		t.Fatalf("Expected binary batch frame but got: %d %v", opcode, err)
+	}
+	msgs, err := socket.SplitBatch(payload)
+	if err != nil {
+		t.Fatalf("Splitting batch should not fail but got: %s", err)
+	}
+	if len(msgs) != 1 || string(msgs[0]) != string(msg) {
+		t.Errorf("Expected the 200 byte message in the batch but got: %q", msgs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go h.Shutdown(ctx)
+	opcode, payload, err = readRawFrame(r)
+	if err != nil || opcode != 0x2 {
+		t.Fatalf("Expected binary batch frame but got: %d %v", opcode, err)
+	}
+	if msgs, err = socket.SplitBatch(payload); err != nil || len(msgs) != 1 {
+		t.Fatalf("Expected a single control frame in the batch but got: %q %v", msgs, err)
+	}
+	if frame, err := parseControlFrame(msgs[0]); err != nil || frame.Type != ControlReconnect {
+		t.Errorf("Expected reconnect frame in the batch but got: %+v %v", frame, err)
+	}
+}
+
+func TestConnectionHandlerClosesConnectionAfterCloseFrame(t *testing.T) {
+	h := &ConnectionHandler{
+		Authenticator: &AuthenticatorMock{
+			OnAuthenticate: func(ctx context.Context, token string) (string, error) {
+				return "", auth.ErrInvalidToken
+			},
+		},
+	}
+	srv := httptest.NewServer(h.Handler())
+	defer srv.Close()
+
+	conn, r := rawHandshake(t, srv.URL)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	opcode, payload, err := readRawFrame(r)
+	if err != nil || opcode != 0x8 || len(payload) < 2 || int(payload[0])<<8|int(payload[1]) != CloseUnauthorized {
+		t.Fatalf("Expected unauthorized close frame but got: %d %q %v", opcode, payload, err)
+	}
+	if _, _, err := readRawFrame(r); err != io.EOF {
+		t.Errorf("Expected the server to close the connection but got: %v", err)
+	}
+}
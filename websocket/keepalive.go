@@ -0,0 +1,150 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Keepalive detects dead and idle clients. The checks that are not set are
+// disabled.
+type Keepalive struct {
+	// PingInterval is the interval of the pings sent to the client. The
+	// connection is considered dead if nothing is received from the client,
+	// including the pongs, for PingInterval plus PongTimeout.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// IdleTimeout closes connections that don't send any messages for the
+	// given time. Pings and pongs don't count as messages.
+	IdleTimeout time.Duration
+	// WriteTimeout limits the time a single write to the connection can take.
+	WriteTimeout time.Duration
+}
+
+// pingData is the payload of the keepalive pings. Some client libraries fail
+// on pings without a payload.
+var pingData = []byte("keepalive")
+
+// readTimeout returns the time the client can stay silent before the
+// connection is considered dead.
+func (k Keepalive) readTimeout() time.Duration {
+	if k.PingInterval <= 0 {
+		return 0
+	}
+	return k.PingInterval + k.PongTimeout
+}
+
+// extendReadDeadline moves the read deadline forward unless the connection is
+// closing and its reads are interrupted.
+func (c *MsgConn) extendReadDeadline() {
+	timeout := c.Keepalive.readTimeout()
+	if timeout <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closing {
+		c.Transport.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// extendWriteDeadline bounds the next write by the write timeout.
+func (c *MsgConn) extendWriteDeadline() {
+	if c.Keepalive.WriteTimeout > 0 {
+		c.Transport.SetWriteDeadline(time.Now().Add(c.Keepalive.WriteTimeout))
+	}
+}
+
+// ReadMessage reads the next message from the client. Reading fails once the
+// client stops responding to the pings.
+func (c *MsgConn) ReadMessage() ([]byte, error) {
+	c.extendReadDeadline()
+	data, err := c.Transport.ReadMessage()
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() && !c.isClosing() {
+			glog.Infof("Client stopped responding: %s", err)
+			keepaliveDisconnects.With("pong_timeout").Inc()
+		}
+		return nil, err
+	}
+	atomic.StoreInt64(&c.lastMessage, time.Now().UnixNano())
+	return data, nil
+}
+
+func (c *MsgConn) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+// keepalive pings the client and closes the connection once it stays idle
+// for too long. It runs until stop is closed.
+func (c *MsgConn) keepalive(stop <-chan struct{}) {
+	k := c.Keepalive
+	var pings <-chan time.Time
+	if k.PingInterval > 0 {
+		ticker := time.NewTicker(k.PingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if k.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(k.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	for {
+		select {
+		case <-pings:
+			c.extendWriteDeadline()
+			if err := c.Transport.Ping(pingData); err != nil {
+				glog.V(2).Infof("Unable to ping client: %s", err)
+				return
+			}
+		case <-idle:
+			last := time.Unix(0, atomic.LoadInt64(&c.lastMessage))
+			if since := time.Since(last); since < k.IdleTimeout {
+				idleTimer.Reset(k.IdleTimeout - since)
+				continue
+			}
+			glog.Infof("Closing connection idle since %s", last)
+			keepaliveDisconnects.With("idle").Inc()
+			c.CloseWithStatus(CloseNormal, "idle timeout")
+			c.Close()
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// startKeepalive starts the keepalive checks of the connection and returns a
+// function stopping them.
+func (c *MsgConn) startKeepalive() func() {
+	atomic.StoreInt64(&c.lastMessage, time.Now().UnixNano())
+	k := c.Keepalive
+	if k.PingInterval <= 0 && k.IdleTimeout <= 0 {
+		return func() {}
+	}
+	c.Transport.SetPongHandler(func([]byte) { c.extendReadDeadline() })
+	stop := make(chan struct{})
+	go c.keepalive(stop)
+	return func() { close(stop) }
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/websocket"
+	"github.com/protogalaxy/service-socket/devicepresence"
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+// keepaliveHandler returns a handler accepting every client that reports the
+// device statuses it sets.
+func keepaliveHandler(k Keepalive, statuses chan<- devicepresence.Device_Status) *ConnectionHandler {
+	return &ConnectionHandler{
+		Authenticator: &AuthenticatorMock{
+			OnAuthenticate: func(ctx context.Context, token string) (string, error) {
+				return "user", nil
+			},
+		},
+		Registry: &RegistryMock{
+			OnRegisterSocket: func(s socket.Socket) (socket.ID, error) {
+				return 123, nil
+			},
+			OnUnregister: func(socketID socket.ID) {},
+		},
+		DevicePresence: &DevicePresenceMock{
+			OnSetStatus: func(ctx context.Context, req *devicepresence.StatusRequest) (*devicepresence.StatusReply, error) {
+				statuses <- req.Device.Status
+				return &devicepresence.StatusReply{}, nil
+			},
+		},
+		Keepalive: k,
+	}
+}
+
+func expectStatus(t *testing.T, statuses <-chan devicepresence.Device_Status, expected devicepresence.Device_Status) {
+	select {
+	case status := <-statuses:
+		if status != expected {
+			t.Fatalf("Expected device status %s but got %s", expected, status)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Device not marked %s", expected)
+	}
+}
+
+func TestKeepaliveDisconnectsDeadClient(t *testing.T) {
+	statuses := make(chan devicepresence.Device_Status, 2)
+	h := keepaliveHandler(Keepalive{PingInterval: 10 * time.Millisecond, PongTimeout: 10 * time.Millisecond}, statuses)
+	srv := httptest.NewServer(h.Handler())
+	defer srv.Close()
+
+	// The client never reads so it never answers the pings.
+	ws := dialHandler(t, srv)
+	defer ws.Close()
+	expectStatus(t, statuses, devicepresence.Device_ONLINE)
+	expectStatus(t, statuses, devicepresence.Device_OFFLINE)
+}
+
+func TestKeepaliveKeepsRespondingClient(t *testing.T) {
+	statuses := make(chan devicepresence.Device_Status, 2)
+	h := keepaliveHandler(Keepalive{PingInterval: 10 * time.Millisecond, PongTimeout: 100 * time.Millisecond}, statuses)
+	srv := httptest.NewServer(h.Handler())
+	defer srv.Close()
+
+	ws := dialHandler(t, srv)
+	go func() {
+		var data []byte
+		for websocket.Message.Receive(ws, &data) == nil {
+		}
+	}()
+	expectStatus(t, statuses, devicepresence.Device_ONLINE)
+	select {
+	case status := <-statuses:
+		t.Fatalf("Responding client should stay connected but got status %s", status)
+	case <-time.After(300 * time.Millisecond):
+	}
+	ws.Close()
+	expectStatus(t, statuses, devicepresence.Device_OFFLINE)
+}
+
+func TestKeepaliveClosesIdleClient(t *testing.T) {
+	statuses := make(chan devicepresence.Device_Status, 2)
+	h := keepaliveHandler(Keepalive{IdleTimeout: 50 * time.Millisecond}, statuses)
+	srv := httptest.NewServer(h.Handler())
+	defer srv.Close()
+
+	ws := dialHandler(t, srv)
+	defer ws.Close()
+	expectStatus(t, statuses, devicepresence.Device_ONLINE)
+	start := time.Now()
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != io.EOF {
+		t.Errorf("Expected idle connection to be closed but got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Connection closed before the idle timeout after %s", elapsed)
+	}
+	expectStatus(t, statuses, devicepresence.Device_OFFLINE)
+}
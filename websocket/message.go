@@ -0,0 +1,90 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// BatchParam is the query parameter of the handshake request a client sets to
+// true to opt in to batch frames. Every frame written to such a client,
+// including the control frames, is a binary batch frame as described by
+// socket.BatchPrefix.
+const BatchParam = "batch"
+
+// batchRequested reports whether the client opted in to batch frames.
+func batchRequested(r *http.Request) bool {
+	batch, _ := strconv.ParseBool(r.URL.Query().Get(BatchParam))
+	return batch
+}
+
+// FramingParam is the query parameter of the handshake request a client sets
+// to true to opt in to framed inbound messages. The first byte of a message
+// sent by such a client is a prefix if it is at most MaxFramingPrefix:
+//
+//	0x00  control frame, see ControlPrefix
+//	0x01  message carrying the client's message id, see IdentifiedPrefix
+//
+// Messages starting with any other reserved prefix are rejected and all the
+// other messages are routed to the message broker as they are. The messages
+// of clients that did not opt in are always routed as they are.
+const FramingParam = "framing"
+
+// MaxFramingPrefix is the largest first byte of a message reserved for the
+// framing prefixes.
+const MaxFramingPrefix byte = 7
+
+// framingRequested reports whether the client opted in to framed messages.
+func framingRequested(r *http.Request) bool {
+	framing, _ := strconv.ParseBool(r.URL.Query().Get(FramingParam))
+	return framing
+}
+
+// isFramed reports whether the message read from a client that opted in to
+// framed messages starts with a framing prefix.
+func isFramed(msg []byte) bool {
+	return len(msg) > 0 && msg[0] <= MaxFramingPrefix
+}
+
+// IdentifiedPrefix is the first byte of a message sent by a client that opted
+// in to framed messages together with its own message id. It is followed by a
+// single byte holding the length of the id, the id itself and the message
+// data. The id is passed on to the message broker so the replies can refer to
+// it.
+const IdentifiedPrefix byte = 1
+
+// isIdentified reports whether the message read from the client carries a
+// message id.
+func isIdentified(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == IdentifiedPrefix
+}
+
+// parseIdentified splits the identified message into the message id and the
+// data.
+func parseIdentified(msg []byte) (string, []byte, error) {
+	if !isIdentified(msg) {
+		return "", nil, fmt.Errorf("not an identified message")
+	}
+	if len(msg) < 2 {
+		return "", nil, fmt.Errorf("missing message id length")
+	}
+	n := int(msg[1])
+	if len(msg) < 2+n {
+		return "", nil, fmt.Errorf("message id truncated")
+	}
+	return string(msg[2 : 2+n]), msg[2+n:], nil
+}
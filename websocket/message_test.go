@@ -0,0 +1,190 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/messagebroker"
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+// encodeIdentified prefixes the data with the message id like the clients do.
+func encodeIdentified(id string, data []byte) []byte {
+	msg := append([]byte{IdentifiedPrefix, byte(len(id))}, id...)
+	return append(msg, data...)
+}
+
+func TestParseIdentified(t *testing.T) {
+	id, data, err := parseIdentified(encodeIdentified("req-1", []byte("abc")))
+	if err != nil {
+		t.Fatalf("Parsing message should not fail but got: %s", err)
+	}
+	if id != "req-1" || string(data) != "abc" {
+		t.Errorf("Unexpected message id %q and data %q", id, data)
+	}
+
+	invalid := [][]byte{
+		[]byte("abc"),
+		{IdentifiedPrefix},
+		{IdentifiedPrefix, 5, 'a'},
+	}
+	for _, msg := range invalid {
+		if _, _, err := parseIdentified(msg); err == nil {
+			t.Errorf("Expected error parsing %q", msg)
+		}
+	}
+}
+
+func TestHandleInboundIdentity(t *testing.T) {
+	tests := []struct {
+		msg  []byte
+		id   string
+		data string
+	}{
+		{[]byte("abc"), "", "abc"},
+		{encodeIdentified("req-1", []byte("abc")), "req-1", "abc"},
+	}
+	for _, test := range tests {
+		var req *messagebroker.RouteRequest
+		s := &States{
+			GatewayID: "gw",
+			Framing:   true,
+			MessageBroker: &BrokerMock{
+				OnRoute: func(ctx context.Context, r *messagebroker.RouteRequest) (*messagebroker.RouteReply, error) {
+					req = r
+					return &messagebroker.RouteReply{}, nil
+				},
+			},
+		}
+		s.socketID = 9
+		s.userID = "13"
+		before := time.Now().UnixNano()
+		s.handleInbound(test.msg)
+
+		if req == nil {
+			t.Fatalf("Message %q should be routed", test.msg)
+		}
+		if req.SocketId != 9 || req.UserId != "13" || req.GatewayId != "gw" {
+			t.Errorf("Unexpected identity in request: %s", req)
+		}
+		if req.MessageId != test.id || string(req.Data) != test.data {
+			t.Errorf("Unexpected message id %q and data %q", req.MessageId, req.Data)
+		}
+		if req.ReceivedAt < before || req.ReceivedAt > time.Now().UnixNano() {
+			t.Errorf("Unexpected receive timestamp: %d", req.ReceivedAt)
+		}
+	}
+}
+
+func TestHandleInboundInvalidIdentified(t *testing.T) {
+	s := &States{
+		Framing: true,
+		MessageBroker: &BrokerMock{
+			OnRoute: func(ctx context.Context, r *messagebroker.RouteRequest) (*messagebroker.RouteReply, error) {
+				t.Errorf("Invalid message should not be routed: %s", r)
+				return &messagebroker.RouteReply{}, nil
+			},
+		},
+	}
+	s.handleInbound([]byte{IdentifiedPrefix, 10})
+}
+
+func TestBatchRequested(t *testing.T) {
+	tests := map[string]bool{
+		"/":               false,
+		"/?batch=1":       true,
+		"/?batch=true":    true,
+		"/?batch=0":       false,
+		"/?batch=maybe":   false,
+		"/?x=1&batch=yes": false,
+	}
+	for url, expected := range tests {
+		r, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch := batchRequested(r); batch != expected {
+			t.Errorf("Expecting batch %t for %s but got %t", expected, url, batch)
+		}
+	}
+}
+
+func TestHandleInboundFraming(t *testing.T) {
+	control := encodeControlFrame(ControlFrame{Type: ControlSubscribe, Topic: "match:a"})
+	tests := []struct {
+		framing    bool
+		msg        []byte
+		routed     bool
+		subscribed bool
+	}{
+		{false, control, true, false},
+		{false, encodeIdentified("req-1", []byte("abc")), true, false},
+		{false, []byte{5, 'a'}, true, false},
+		{true, control, false, true},
+		{true, []byte{5, 'a'}, false, false},
+		{true, []byte{MaxFramingPrefix + 1, 'a'}, true, false},
+		{true, []byte("abc"), true, false},
+	}
+	for _, test := range tests {
+		var routed, subscribed bool
+		s := &States{
+			Framing: test.framing,
+			MessageBroker: &BrokerMock{
+				OnRoute: func(ctx context.Context, r *messagebroker.RouteRequest) (*messagebroker.RouteReply, error) {
+					routed = string(r.Data) == string(test.msg)
+					return &messagebroker.RouteReply{}, nil
+				},
+			},
+			Registry: &RegistryMock{
+				OnSubscribe: func(socketID socket.ID, topic string) error {
+					subscribed = true
+					return nil
+				},
+			},
+			AuthorizeSubscription: func(userID, topic string) bool {
+				return true
+			},
+		}
+		s.handleInbound(test.msg)
+		if routed != test.routed || subscribed != test.subscribed {
+			t.Errorf("Expecting %q with framing %t to be routed %t and subscribed %t but got %t and %t",
+				test.msg, test.framing, test.routed, test.subscribed, routed, subscribed)
+		}
+	}
+}
+
+func TestFramingRequested(t *testing.T) {
+	tests := map[string]bool{
+		"/":                 false,
+		"/?framing=1":       true,
+		"/?framing=true":    true,
+		"/?framing=0":       false,
+		"/?batch=1":         false,
+		"/?batch=1&framing": false,
+	}
+	for url, expected := range tests {
+		r, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if framing := framingRequested(r); framing != expected {
+			t.Errorf("Expecting framing %t for %s but got %t", expected, url, framing)
+		}
+	}
+}
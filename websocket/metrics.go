@@ -0,0 +1,66 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"time"
+
+	"github.com/protogalaxy/service-socket/metrics"
+)
+
+var (
+	routeDuration = metrics.NewHistogram("socket_broker_route_duration_seconds", "Latency of the Broker.Route calls.", nil)
+	routeErrors   = metrics.NewCounter("socket_broker_route_errors_total", "Total number of failed Broker.Route calls.")
+
+	routesInFlight = metrics.NewGauge("socket_broker_routes_in_flight", "Number of Broker.Route calls in flight.")
+
+	setStatusDuration = metrics.NewHistogram("socket_presence_set_status_duration_seconds", "Latency of the PresenceManager.SetStatus calls.", nil)
+	setStatusErrors   = metrics.NewCounter("socket_presence_set_status_errors_total", "Total number of failed PresenceManager.SetStatus calls.")
+
+	keepaliveDisconnects = metrics.NewCounterVec("socket_keepalive_disconnects_total", "Total number of connections closed by the keepalive checks by reason.", "reason")
+
+	rateLimited = metrics.NewCounterVec("socket_rate_limited_total", "Total number of inbound messages exceeding the rate limits by scope and action.", "scope", "action")
+
+	originRejections = metrics.NewCounterVec("socket_origin_rejections_total", "Total number of websocket upgrades rejected because of their origin by reason.", "reason")
+
+	stateDuration = metrics.NewHistogramVec("socket_state_duration_seconds", "Time spent in each connection state.",
+		[]float64{.001, .01, .1, 1, 10, 60, 600, 3600, 86400}, "state")
+)
+
+// stateNames are the metric labels of the connection states.
+var stateNames = map[*StateFunc]string{
+	&AuthenticateUser: "authenticate_user",
+	&RegisterSocket:   "register_socket",
+	&SetDeviceStatus:  "set_device_status",
+	&HandleMessages:   "handle_messages",
+	&Disconnect:       "disconnect",
+}
+
+// stateName returns the metric label of the state.
+func stateName(state *StateFunc) string {
+	if name, ok := stateNames[state]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// observeCall records the latency of a downstream call and counts it as
+// failed if it returned an error.
+func observeCall(duration *metrics.Histogram, errors *metrics.Counter, start time.Time, err error) {
+	duration.ObserveSince(start)
+	if err != nil {
+		errors.Inc()
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// OriginAllowlist decides which origins may open websocket connections so
+// other sites can't use the clients' auth cookies. Every pattern is an origin
+// like "https://app.example.com". The scheme can be left out to allow both
+// http and https and a host starting with "*." matches all its subdomains.
+// Patterns without a port only match origins on the default port while a "*"
+// port matches any port. The pattern "*" allows all origins.
+type OriginAllowlist struct {
+	patterns []originPattern
+}
+
+type originPattern struct {
+	any    bool
+	scheme string
+	host   string
+	port   string
+}
+
+// ParseOriginAllowlist parses the allowed origin patterns.
+func ParseOriginAllowlist(patterns []string) (*OriginAllowlist, error) {
+	a := &OriginAllowlist{}
+	for _, p := range patterns {
+		pattern, err := parseOriginPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		a.patterns = append(a.patterns, pattern)
+	}
+	return a, nil
+}
+
+func parseOriginPattern(p string) (originPattern, error) {
+	if p == "*" {
+		return originPattern{any: true}, nil
+	}
+	var pattern originPattern
+	hostport := strings.ToLower(p)
+	if i := strings.Index(hostport, "://"); i >= 0 {
+		pattern.scheme, hostport = hostport[:i], hostport[i+3:]
+		if pattern.scheme != "http" && pattern.scheme != "https" {
+			return pattern, fmt.Errorf("invalid origin pattern %q: unsupported scheme", p)
+		}
+	}
+	pattern.host, pattern.port = splitHostPort(hostport)
+	host := strings.TrimPrefix(pattern.host, "*.")
+	if host == "" || strings.ContainsAny(host, "*/") {
+		return pattern, fmt.Errorf("invalid origin pattern %q", p)
+	}
+	return pattern, nil
+}
+
+// splitHostPort splits the port from the host if there is one.
+func splitHostPort(hostport string) (string, string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, ""
+	}
+	return host, port
+}
+
+// withDefaultPort returns the default port of the scheme if the port is not
+// set.
+func withDefaultPort(port, scheme string) string {
+	if port != "" {
+		return port
+	}
+	switch scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+// sameHost reports whether the hosts are the same once the default port of
+// the scheme is applied to both.
+func sameHost(a, b, scheme string) bool {
+	hostA, portA := splitHostPort(strings.ToLower(a))
+	hostB, portB := splitHostPort(strings.ToLower(b))
+	return hostA == hostB && withDefaultPort(portA, scheme) == withDefaultPort(portB, scheme)
+}
+
+func (p originPattern) matches(origin *url.URL) bool {
+	if p.any {
+		return true
+	}
+	if p.scheme != "" && p.scheme != origin.Scheme {
+		return false
+	}
+	host, port := splitHostPort(strings.ToLower(origin.Host))
+	if p.port != "*" && withDefaultPort(p.port, origin.Scheme) != withDefaultPort(port, origin.Scheme) {
+		return false
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		return strings.HasSuffix(host, p.host[1:])
+	}
+	return host == p.host
+}
+
+// Check reports whether the request's origin may open a connection. Requests
+// without an Origin header don't come from browsers and are allowed. If no
+// patterns are set only the origin of the gateway itself is allowed.
+func (a *OriginAllowlist) Check(r *http.Request) bool {
+	header := r.Header.Get("Origin")
+	if header == "" {
+		return true
+	}
+	origin, err := url.Parse(header)
+	if err != nil || origin.Host == "" || (origin.Scheme != "http" && origin.Scheme != "https") {
+		glog.Infof("Rejecting websocket connection with invalid origin %q", header)
+		originRejections.With("invalid").Inc()
+		return false
+	}
+	if a == nil || len(a.patterns) == 0 {
+		if sameHost(origin.Host, r.Host, origin.Scheme) {
+			return true
+		}
+	} else {
+		for _, p := range a.patterns {
+			if p.matches(origin) {
+				return true
+			}
+		}
+	}
+	glog.Infof("Rejecting websocket connection from origin %q", header)
+	originRejections.With("not_allowed").Inc()
+	return false
+}
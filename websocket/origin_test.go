@@ -0,0 +1,108 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowlist(t *testing.T) {
+	a, err := ParseOriginAllowlist([]string{"https://app.example.com", "*.example.org", "http://localhost:*"})
+	if err != nil {
+		t.Fatalf("Parsing allowlist should not fail but got: %s", err)
+	}
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"https://app.example.com:443", true},
+		{"https://app.example.com:80", false},
+		{"http://chat.example.org:80", true},
+		{"https://chat.example.org:443", true},
+		{"https://other.example.com", false},
+		{"https://chat.example.org", true},
+		{"http://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://localhost:3000", true},
+		{"null", false},
+		{"file://app.example.com", false},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://gateway.example.com/", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if allowed := a.Check(r); allowed != test.allowed {
+			t.Errorf("Expected origin %q allowed to be %t", test.origin, test.allowed)
+		}
+	}
+}
+
+func TestOriginAllowlistSameOrigin(t *testing.T) {
+	for _, a := range []*OriginAllowlist{nil, {}} {
+		r, _ := http.NewRequest("GET", "http://gateway.example.com/", nil)
+		r.Header.Set("Origin", "https://gateway.example.com")
+		if !a.Check(r) {
+			t.Error("Expected the gateway's own origin to be allowed")
+		}
+		r.Header.Set("Origin", "https://evil.example.com")
+		if a.Check(r) {
+			t.Error("Expected other origins to be rejected")
+		}
+		r.Host = "gateway.example.com:443"
+		r.Header.Set("Origin", "https://gateway.example.com")
+		if !a.Check(r) {
+			t.Error("Expected the gateway's own origin on the default port to be allowed")
+		}
+	}
+}
+
+func TestParseOriginAllowlistErrors(t *testing.T) {
+	for _, p := range []string{"ftp://example.com", "*", "https://", "https://*", "example.com/path", "*.*.example.com"} {
+		_, err := ParseOriginAllowlist([]string{p})
+		if (err == nil) != (p == "*") {
+			t.Errorf("Unexpected result parsing %q: %v", p, err)
+		}
+	}
+}
+
+func TestConnectionHandlerRejectsOrigin(t *testing.T) {
+	h := &ConnectionHandler{}
+	srv := httptest.NewServer(h.Handler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", "https://evil.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request should not fail but got: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected forbidden but got: %s", resp.Status)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// RateLimitAction selects what happens to an inbound message exceeding the
+// rate limits. The message is never routed.
+type RateLimitAction int
+
+const (
+	// RateLimitDrop drops the message.
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitThrottle drops the message and sends the client a throttle
+	// control frame with the time to wait before sending more messages.
+	RateLimitThrottle
+	// RateLimitClose drops the message and closes the connection with a
+	// policy violation.
+	RateLimitClose
+)
+
+var rateLimitActionNames = map[RateLimitAction]string{
+	RateLimitDrop:     "drop",
+	RateLimitThrottle: "throttle",
+	RateLimitClose:    "close",
+}
+
+func (a RateLimitAction) String() string {
+	if name, ok := rateLimitActionNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("RateLimitAction(%d)", int(a))
+}
+
+// ParseRateLimitAction returns the action with the given name.
+func ParseRateLimitAction(name string) (RateLimitAction, error) {
+	for a, n := range rateLimitActionNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rate limit action: %q", name)
+}
+
+// limitInbound reports whether the inbound message is within the rate limits
+// of the connection and of its user. The rate limit action is taken if it is
+// not. A message rejected by the user limit is refunded to the connection so
+// it only counts against the limit that rejected it.
+func (s *States) limitInbound(msg []byte) bool {
+	scope := "connection"
+	ok, wait := true, time.Duration(0)
+	if s.ConnLimiter != nil {
+		ok, wait = s.ConnLimiter.Allow(len(msg))
+	}
+	if ok && s.userLimiter != nil {
+		scope = "user"
+		ok, wait = s.userLimiter.Allow(len(msg))
+		if !ok && s.ConnLimiter != nil {
+			s.ConnLimiter.Refund(len(msg))
+		}
+	}
+	if ok {
+		return true
+	}
+	rateLimited.With(scope, s.RateLimitAction.String()).Inc()
+	switch s.RateLimitAction {
+	case RateLimitThrottle:
+		s.throttle(wait)
+	case RateLimitClose:
+		glog.Warningf("Closing socket %s exceeding the %s rate limit", s.socketID, scope)
+		s.Conn.CloseWithStatus(ClosePolicyViolation, "rate limit exceeded")
+		s.Conn.Close()
+	}
+	return false
+}
+
+// throttle tells the client to wait before sending more messages. Only a
+// single notice is sent until the wait is over.
+func (s *States) throttle(wait time.Duration) {
+	now := time.Now().UnixNano()
+	until := atomic.LoadInt64(&s.throttledUntil)
+	if now < until || !atomic.CompareAndSwapInt64(&s.throttledUntil, until, now+int64(wait)) {
+		return
+	}
+	glog.V(2).Infof("Throttling socket %s for %s", s.socketID, wait)
+	writeControlFrame(s.Conn, s.Batch, ControlFrame{
+		Type:    ControlThrottle,
+		DelayMs: int64((wait + time.Millisecond - 1) / time.Millisecond),
+	})
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/messagebroker"
+	"github.com/protogalaxy/service-socket/ratelimit"
+	"github.com/protogalaxy/service-socket/socket"
+)
+
+// frozenLimiter returns a limiter that never refills.
+func frozenLimiter(l ratelimit.Limits) *ratelimit.Limiter {
+	limiter := ratelimit.NewLimiter(l)
+	now := time.Unix(0, 0)
+	limiter.Now = func() time.Time { return now }
+	return limiter
+}
+
+// countingBroker returns a broker counting the routed messages.
+func countingBroker(mu *sync.Mutex, routed *int) *BrokerMock {
+	return &BrokerMock{
+		OnRoute: func(ctx context.Context, req *messagebroker.RouteRequest) (*messagebroker.RouteReply, error) {
+			mu.Lock()
+			*routed++
+			mu.Unlock()
+			return &messagebroker.RouteReply{}, nil
+		},
+	}
+}
+
+func TestParseRateLimitAction(t *testing.T) {
+	for _, a := range []RateLimitAction{RateLimitDrop, RateLimitThrottle, RateLimitClose} {
+		parsed, err := ParseRateLimitAction(a.String())
+		if err != nil || parsed != a {
+			t.Errorf("Expected %s to parse but got: %s %v", a, parsed, err)
+		}
+	}
+	if _, err := ParseRateLimitAction("ignore"); err == nil {
+		t.Error("Expected unknown action to fail")
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	var mu sync.Mutex
+	var routed int
+	s := &States{
+		MessageBroker: countingBroker(&mu, &routed),
+		ConnLimiter:   frozenLimiter(ratelimit.Limits{Bytes: ratelimit.Rate{PerSecond: 10}}),
+	}
+	routeAll(s, []string{"aaaa", "bbbb", "cccc", "dddd"}, 1, true)
+	if routed != 2 {
+		t.Errorf("Expected 2 messages within the byte limit to be routed but got %d", routed)
+	}
+}
+
+func TestRateLimitThrottle(t *testing.T) {
+	var mu sync.Mutex
+	var routed int
+	var notices [][]byte
+	s := &States{
+		MessageBroker: countingBroker(&mu, &routed),
+		Conn: &ConnMock{
+			OnWrite: func(p []byte) (int, error) {
+				notices = append(notices, p)
+				return len(p), nil
+			},
+		},
+		ConnLimiter:     frozenLimiter(ratelimit.Limits{Messages: ratelimit.Rate{PerSecond: 2, Burst: 1}}),
+		RateLimitAction: RateLimitThrottle,
+	}
+	routeAll(s, []string{"a", "b", "c"}, 1, true)
+	if routed != 1 {
+		t.Errorf("Expected a single message to be routed but got %d", routed)
+	}
+	if len(notices) != 1 {
+		t.Fatalf("Expected a single throttle notice but got %d", len(notices))
+	}
+	frame, err := parseControlFrame(notices[0])
+	if err != nil {
+		t.Fatalf("Parsing control frame should not fail but got: %s", err)
+	}
+	if frame.Type != ControlThrottle || frame.DelayMs != 500 {
+		t.Errorf("Expected throttle notice for 500ms but got: %+v", frame)
+	}
+}
+
+func TestRateLimitThrottleBatch(t *testing.T) {
+	var mu sync.Mutex
+	var routed int
+	var notices [][]byte
+	s := &States{
+		MessageBroker: countingBroker(&mu, &routed),
+		Conn: &ConnMock{
+			OnWriteBinary: func(p []byte) (int, error) {
+				notices = append(notices, p)
+				return len(p), nil
+			},
+		},
+		Batch:           true,
+		ConnLimiter:     frozenLimiter(ratelimit.Limits{Messages: ratelimit.Rate{PerSecond: 2, Burst: 1}}),
+		RateLimitAction: RateLimitThrottle,
+	}
+	routeAll(s, []string{"a", "b"}, 1, true)
+	if len(notices) != 1 {
+		t.Fatalf("Expected a single throttle notice but got %d", len(notices))
+	}
+	msgs, err := socket.SplitBatch(notices[0])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Expected the throttle notice in a batch frame but got: %q %v", notices[0], err)
+	}
+	if frame, err := parseControlFrame(msgs[0]); err != nil || frame.Type != ControlThrottle {
+		t.Errorf("Expected throttle notice but got: %+v %v", frame, err)
+	}
+}
+
+func TestRateLimitClose(t *testing.T) {
+	var mu sync.Mutex
+	var routed int
+	var status int
+	closed := false
+	s := &States{
+		MessageBroker: countingBroker(&mu, &routed),
+		Conn: &ConnMock{
+			OnCloseWithStatus: func(st int, reason string) error {
+				status = st
+				return nil
+			},
+			OnClose: func() error {
+				closed = true
+				return nil
+			},
+		},
+		ConnLimiter:     frozenLimiter(ratelimit.Limits{Messages: ratelimit.Rate{PerSecond: 1}}),
+		RateLimitAction: RateLimitClose,
+	}
+	routeAll(s, []string{"a", "b"}, 1, true)
+	if routed != 1 {
+		t.Errorf("Expected a single message to be routed but got %d", routed)
+	}
+	if status != ClosePolicyViolation || !closed {
+		t.Errorf("Expected connection to be closed with policy violation but got: %d %t", status, closed)
+	}
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	var mu sync.Mutex
+	var routed int
+	users := ratelimit.NewUsers(ratelimit.Limits{Messages: ratelimit.Rate{PerSecond: 3}})
+	for i := 0; i < 2; i++ {
+		s := &States{
+			MessageBroker: countingBroker(&mu, &routed),
+			userLimiter:   users.Acquire("user"),
+		}
+		routeAll(s, []string{"a", "b", "c"}, 1, true)
+	}
+	if routed != 3 {
+		t.Errorf("Expected the connections to share the user limit of 3 messages but got %d", routed)
+	}
+}
+
+func TestRateLimitUserRejectionKeepsConnectionBudget(t *testing.T) {
+	conn := frozenLimiter(ratelimit.Limits{Messages: ratelimit.Rate{PerSecond: 2}})
+	s := &States{
+		ConnLimiter: conn,
+		userLimiter: frozenLimiter(ratelimit.Limits{Messages: ratelimit.Rate{PerSecond: 1}}),
+	}
+	if !s.limitInbound([]byte("a")) {
+		t.Fatal("Expected the first message to be allowed")
+	}
+	if s.limitInbound([]byte("b")) {
+		t.Fatal("Expected the second message to exceed the user limit")
+	}
+	if ok, _ := conn.Allow(1); !ok {
+		t.Error("Message rejected by the user limit should not use up the connection limit")
+	}
+}
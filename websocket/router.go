@@ -0,0 +1,93 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/messagebroker"
+)
+
+// DefaultRouteConcurrency is the default number of Route calls a connection
+// can have in flight.
+const DefaultRouteConcurrency = 4
+
+// routeMessages forwards the inbound messages to the broker until the
+// messages channel is closed. Up to concurrency messages are routed at once
+// by separate workers so the reader is blocked while all of them are busy.
+// If ordered is set the messages are routed one at a time in the order they
+// were received. The method returns once all the in-flight calls finish.
+func (s *States) routeMessages(messages <-chan []byte, concurrency int, ordered bool) {
+	if ordered || concurrency < 1 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range messages {
+				if s.limitInbound(msg) {
+					s.handleInbound(msg)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// handleInbound handles a single message received from the client.
+func (s *States) handleInbound(msg []byte) {
+	req := &messagebroker.RouteRequest{
+		Data:       msg,
+		SocketId:   int64(s.socketID),
+		UserId:     s.userID,
+		GatewayId:  s.GatewayID,
+		ReceivedAt: time.Now().UnixNano(),
+	}
+	if s.Framing && isFramed(msg) {
+		switch msg[0] {
+		case ControlPrefix:
+			s.handleControl(msg)
+			return
+		case IdentifiedPrefix:
+			id, data, err := parseIdentified(msg)
+			if err != nil {
+				glog.Warningf("Invalid message from socket %s: %s", s.socketID, err)
+				return
+			}
+			req.MessageId = id
+			req.Data = data
+		default:
+			glog.Warningf("Unknown message prefix %#x from socket %s", msg[0], s.socketID)
+			return
+		}
+	}
+
+	routesInFlight.Inc()
+	defer routesInFlight.Dec()
+	err := s.Policies.withDefaults().Broker.Call(context.Background(), func(ctx context.Context) error {
+		start := time.Now()
+		_, err := s.MessageBroker.Route(ctx, req)
+		observeCall(routeDuration, routeErrors, start, err)
+		return err
+	})
+	if err != nil {
+		glog.Errorf("handling message: %s", err)
+	}
+}
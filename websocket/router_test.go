@@ -0,0 +1,151 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc/codes"
+	"github.com/protogalaxy/service-socket/messagebroker"
+)
+
+type BrokerMock struct {
+	OnRoute func(context.Context, *messagebroker.RouteRequest) (*messagebroker.RouteReply, error)
+}
+
+func (m *BrokerMock) Route(ctx context.Context, req *messagebroker.RouteRequest, opts ...grpc.CallOption) (*messagebroker.RouteReply, error) {
+	return m.OnRoute(ctx, req)
+}
+
+func (m *BrokerMock) RouteStream(ctx context.Context, opts ...grpc.CallOption) (messagebroker.Broker_RouteStreamClient, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "streaming not supported")
+}
+
+func routeAll(s *States, data []string, concurrency int, ordered bool) {
+	messages := make(chan []byte)
+	go func() {
+		for _, d := range data {
+			messages <- []byte(d)
+		}
+		close(messages)
+	}()
+	s.routeMessages(messages, concurrency, ordered)
+}
+
+func TestRouteMessagesOrdered(t *testing.T) {
+	var routed []string
+	s := &States{
+		MessageBroker: &BrokerMock{
+			OnRoute: func(ctx context.Context, req *messagebroker.RouteRequest) (*messagebroker.RouteReply, error) {
+				routed = append(routed, string(req.Data))
+				return &messagebroker.RouteReply{}, nil
+			},
+		},
+	}
+	routeAll(s, []string{"a", "b", "c", "d"}, 4, true)
+
+	if len(routed) != 4 || routed[0] != "a" || routed[1] != "b" || routed[2] != "c" || routed[3] != "d" {
+		t.Errorf("Expected messages to be routed in order but got: %v", routed)
+	}
+}
+
+func TestRouteMessagesConcurrencyLimit(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight, count int
+	s := &States{
+		MessageBroker: &BrokerMock{
+			OnRoute: func(ctx context.Context, req *messagebroker.RouteRequest) (*messagebroker.RouteReply, error) {
+				mu.Lock()
+				inFlight++
+				count++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+				return &messagebroker.RouteReply{}, nil
+			},
+		},
+	}
+	routeAll(s, []string{"a", "b", "c", "d", "e", "f", "g", "h"}, 3, false)
+
+	if count != 8 {
+		t.Errorf("Expected all messages to be routed but got %d", count)
+	}
+	if maxInFlight > 3 {
+		t.Errorf("Expected at most 3 routes in flight but got %d", maxInFlight)
+	}
+	if inFlight != 0 {
+		t.Errorf("Routing should wait for the in-flight calls but %d are left", inFlight)
+	}
+}
+
+func TestHandleMessagesStopsRouting(t *testing.T) {
+	reads := make(chan []byte, 1)
+	reads <- []byte("abc")
+	close(reads)
+	routed := make(chan string, 1)
+	s := &States{
+		Conn: &ConnMock{
+			OnReadMessage: func() ([]byte, error) {
+				if msg, ok := <-reads; ok {
+					return msg, nil
+				}
+				return nil, errors.New("closed")
+			},
+			OnClose: func() error {
+				return nil
+			},
+		},
+		MessageBroker: &BrokerMock{
+			OnRoute: func(ctx context.Context, req *messagebroker.RouteRequest) (*messagebroker.RouteReply, error) {
+				time.Sleep(time.Millisecond)
+				routed <- string(req.Data)
+				return &messagebroker.RouteReply{}, nil
+			},
+		},
+		Messages:         make(chan []byte),
+		RouteConcurrency: 2,
+	}
+
+	next := make(chan *StateFunc)
+	go func() {
+		next <- s.handleMessages()
+	}()
+	select {
+	case n := <-next:
+		if n != &Disconnect {
+			t.Errorf("Invalid next state")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Read error should end message handling")
+	}
+	select {
+	case msg := <-routed:
+		if msg != "abc" {
+			t.Errorf("Unexpected routed message: %s", msg)
+		}
+	default:
+		t.Error("In-flight message should be routed before message handling ends")
+	}
+}
@@ -17,11 +17,17 @@ package websocket
 import (
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/protogalaxy/service-socket/auth"
 	"github.com/protogalaxy/service-socket/devicepresence"
+	"github.com/protogalaxy/service-socket/downstream"
 	"github.com/protogalaxy/service-socket/messagebroker"
+	"github.com/protogalaxy/service-socket/presence"
+	"github.com/protogalaxy/service-socket/ratelimit"
 	"github.com/protogalaxy/service-socket/socket"
 )
 
@@ -30,24 +36,119 @@ type StateFunc func(*States) *StateFunc
 func Run(s *States) {
 	curr := s.Initial()
 	for curr != nil {
-		curr = (*curr)(s)
+		start := time.Now()
+		next := (*curr)(s)
+		stateDuration.With(stateName(curr)).ObserveSince(start)
+		curr = next
 	}
 }
 
 type States struct {
+	// throttledUntil is the time in nanoseconds until which no more throttle
+	// notices are sent.
+	throttledUntil int64
+
+	Authenticator  auth.Authenticator
 	Registry       socket.Registry
 	DevicePresence devicepresence.PresenceManagerClient
 	MessageBroker  messagebroker.BrokerClient
-	Conn           Conn
-	Messages       chan []byte
-	socketID       socket.ID
-	userID         string
+	Leases         *presence.LeaseRenewer
+	GatewayID      string
+	Policies       Policies
+	// RouteConcurrency limits the Route calls in flight, the messages are
+	// routed in order if RouteOrdered is set.
+	RouteConcurrency int
+	RouteOrdered     bool
+	// Overflow is applied to the messages routed to the connection while its
+	// queue is full.
+	Overflow socket.OverflowPolicy
+	Conn     Conn
+	// Messages, HighMessages and LowMessages queue the messages of the
+	// normal, high and low priority classes written to the connection.
+	Messages     chan []byte
+	HighMessages chan []byte
+	LowMessages  chan []byte
+	// Batch enables batch frames of at most BatchSize bytes waiting up to
+	// BatchLinger for more messages.
+	Batch       bool
+	BatchSize   int
+	BatchLinger time.Duration
+	// Framing is set if the client opted in to framed inbound messages.
+	Framing bool
+	// ConnLimiter limits the inbound messages of the connection and
+	// UserLimits those of all the connections of a user. RateLimitAction is
+	// taken on the messages exceeding either of them.
+	ConnLimiter     *ratelimit.Limiter
+	UserLimits      *ratelimit.Users
+	RateLimitAction RateLimitAction
+	// AuthorizeSubscription reports whether the user may subscribe to the
+	// topic with a control frame. No topics are allowed if it is not set.
+	// The client can be subscribed to at most MaxSubscriptions topics this
+	// way, DefaultMaxSubscriptions is used if it is not set.
+	AuthorizeSubscription func(userID, topic string) bool
+	MaxSubscriptions      int
+	socketID              socket.ID
+	userID                string
+	userLimiter           *ratelimit.Limiter
+
+	subscriptionsMu sync.Mutex
+	subscriptions   map[string]struct{}
 }
 
 type Conn interface {
 	Request() *http.Request
 	ReadMessage() ([]byte, error)
+	// CloseWithStatus sends a close frame with the status code and the
+	// reason to the client.
+	CloseWithStatus(status int, reason string) error
 	io.Writer
+	// WriteBinary writes the data as a single binary message.
+	WriteBinary(p []byte) (int, error)
+	// Close closes the connection interrupting any pending reads.
+	io.Closer
+}
+
+// Close status codes sent to the clients.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	ClosePolicyViolation = 1008
+	CloseTryAgainLater   = 1013
+	// CloseSlowConsumer is sent when the client is disconnected because it
+	// does not keep up with its messages, unless the overflow policy sets
+	// another close code.
+	CloseSlowConsumer = 4008
+	// CloseUnauthorized is sent when the client could not be authenticated.
+	CloseUnauthorized = 4401
+)
+
+// Policies apply deadlines, retries and circuit breaking to the calls made
+// on behalf of a connection. Missing policies are replaced by the defaults.
+type Policies struct {
+	Auth     *downstream.Policy
+	Presence *downstream.Policy
+	Broker   *downstream.Policy
+}
+
+// DefaultPolicies are used in place of missing Policies. They don't have
+// circuit breakers as those must be shared by all the connections.
+var DefaultPolicies = Policies{
+	Auth:     &downstream.Policy{Name: "auth", Timeout: 5 * time.Second, Attempts: 3, BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second},
+	Presence: &downstream.Policy{Name: "presence", Timeout: 2 * time.Second, Attempts: 3, BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second},
+	Broker:   &downstream.Policy{Name: "broker", Timeout: 5 * time.Second, Attempts: 1},
+}
+
+func (p Policies) withDefaults() Policies {
+	if p.Auth == nil {
+		p.Auth = DefaultPolicies.Auth
+	}
+	if p.Presence == nil {
+		p.Presence = DefaultPolicies.Presence
+	}
+	if p.Broker == nil {
+		p.Broker = DefaultPolicies.Broker
+	}
+	return p
 }
 
 var (
@@ -55,6 +156,7 @@ var (
 	RegisterSocket   StateFunc = (*States).registerSocket
 	SetDeviceStatus  StateFunc = (*States).setDeviceStatus
 	HandleMessages   StateFunc = (*States).handleMessages
+	Disconnect       StateFunc = (*States).disconnect
 )
 
 func (s *States) Initial() *StateFunc {
@@ -65,16 +167,41 @@ func (s *States) authenticateUser() *StateFunc {
 	c, err := s.Conn.Request().Cookie("auth")
 	if err != nil {
 		glog.Info("Missing authentication cookie")
+		s.Conn.CloseWithStatus(CloseUnauthorized, "missing authentication cookie")
 		return nil
 	}
-	// TODO: call the auth service
-	s.userID = c.Value
+	var userID string
+	err = s.Policies.withDefaults().Auth.Retry(context.Background(), func(ctx context.Context) error {
+		var err error
+		userID, err = s.Authenticator.Authenticate(ctx, c.Value)
+		if err == auth.ErrInvalidToken {
+			return downstream.Permanent(err)
+		}
+		return err
+	})
+	if err == auth.ErrInvalidToken {
+		glog.Info("Invalid authentication token")
+		s.Conn.CloseWithStatus(CloseUnauthorized, "invalid authentication token")
+		return nil
+	} else if err != nil {
+		glog.Errorf("Problem authenticating user: %s", err)
+		s.Conn.CloseWithStatus(CloseTryAgainLater, "authentication unavailable")
+		return nil
+	}
+	s.userID = userID
 	glog.V(2).Infof("Athenticated as user %s", s.userID)
 	return &RegisterSocket
 }
 
 func (s *States) registerSocket() *StateFunc {
-	socketID, err := s.Registry.Register(s.Messages)
+	socketID, err := s.Registry.RegisterSocket(socket.Socket{
+		UserID:       s.userID,
+		Messages:     s.Messages,
+		HighMessages: s.HighMessages,
+		LowMessages:  s.LowMessages,
+		Overflow:     s.Overflow,
+		Disconnect:   s.disconnectSlow,
+	})
 	if err != nil {
 		glog.Errorf("Could not register socket: %s", err)
 		return nil
@@ -83,46 +210,117 @@ func (s *States) registerSocket() *StateFunc {
 	return &SetDeviceStatus
 }
 
+// disconnectSlow closes the connection of a client that does not keep up with
+// its messages. It is called by the registry so the connection is closed in
+// the background.
+func (s *States) disconnectSlow(closeCode int) {
+	if closeCode == 0 {
+		closeCode = CloseSlowConsumer
+	}
+	glog.Warningf("Disconnecting slow socket %s", s.socketID)
+	go func() {
+		s.Conn.CloseWithStatus(closeCode, "slow consumer")
+		s.Conn.Close()
+	}()
+}
+
 func (s *States) setDeviceStatus() *StateFunc {
-	// TODO: add timeout
-	ctx := context.Background()
-	_, err := s.DevicePresence.SetStatus(ctx, &devicepresence.StatusRequest{
-		Device: &devicepresence.Device{
-			Id:     s.socketID.String(),
-			Type:   devicepresence.Device_WS,
-			UserId: s.userID,
-			Status: devicepresence.Device_ONLINE,
-		},
-	})
+	device := s.device(devicepresence.Device_ONLINE)
+	req := &devicepresence.StatusRequest{
+		Device:    &device,
+		GatewayId: s.GatewayID,
+	}
+	if s.Leases != nil {
+		req.LeaseSeconds = s.Leases.LeaseSeconds()
+	}
+	err := s.Policies.withDefaults().Presence.Retry(context.Background(), s.setStatus(req))
 	if err != nil {
 		glog.Errorf("Problem setting device status: %s", err)
-		// TODO: transition to disconnected state
-		return nil
+		return &Disconnect
+	}
+	if s.Leases != nil {
+		s.Leases.Add(device)
 	}
 	return &HandleMessages
 }
 
+// setStatus returns a call setting the device status.
+func (s *States) setStatus(req *devicepresence.StatusRequest) func(context.Context) error {
+	return func(ctx context.Context) error {
+		start := time.Now()
+		_, err := s.DevicePresence.SetStatus(ctx, req)
+		observeCall(setStatusDuration, setStatusErrors, start, err)
+		return err
+	}
+}
+
+// device returns the presence device representing the socket.
+func (s *States) device(status devicepresence.Device_Status) devicepresence.Device {
+	return devicepresence.Device{
+		Id:     s.socketID.String(),
+		Type:   devicepresence.Device_WS,
+		UserId: s.userID,
+		Status: status,
+	}
+}
+
 func (s *States) handleMessages() *StateFunc {
+	if s.UserLimits != nil {
+		s.userLimiter = s.UserLimits.Acquire(s.userID)
+		defer s.UserLimits.Release(s.userID)
+	}
 	writer := socket.NewMessageWriter(s.Conn, s.Messages)
+	writer.HighMessages = s.HighMessages
+	writer.LowMessages = s.LowMessages
+	writer.Batch = s.Batch
+	writer.BatchSize = s.BatchSize
+	writer.BatchLinger = s.BatchLinger
 	reader := socket.NewMessageReader(s.Conn)
-	writer.Reader = reader
+	writer.Reader = closers{reader, s.Conn}
 	reader.Writer = writer
 
+	routed := make(chan struct{})
 	go writer.Run()
 	go func() {
-		for {
-			// TODO: timeout
-			ctx := context.Background()
-			msg := <-reader.Messages()
-			_, err := s.MessageBroker.Route(ctx, &messagebroker.RouteRequest{
-				Data: msg,
-			})
-			if err != nil {
-				glog.Errorf("handling message: %s", err)
-			}
-		}
+		s.routeMessages(reader.Messages(), s.RouteConcurrency, s.RouteOrdered)
+		close(routed)
 	}()
 	reader.Run()
+	<-routed
 
+	return &Disconnect
+}
+
+// closers is a Closer that closes all of its Closers.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var err error
+	for _, closer := range c {
+		if e := closer.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// disconnect unregisters the socket and marks the device offline.
+func (s *States) disconnect() *StateFunc {
+	s.Registry.Unregister(s.socketID)
+	if s.Leases != nil {
+		s.Leases.Remove(s.socketID.String())
+	}
+
+	device := s.device(devicepresence.Device_OFFLINE)
+	req := &devicepresence.StatusRequest{
+		Device:    &device,
+		GatewayId: s.GatewayID,
+	}
+	err := s.Policies.withDefaults().Presence.Retry(context.Background(), s.setStatus(req))
+	if err != nil {
+		glog.Errorf("Giving up setting device %s offline: %s", s.socketID, err)
+		return nil
+	}
+	glog.V(2).Infof("Device %s marked offline", s.socketID)
 	return nil
 }
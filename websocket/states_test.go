@@ -18,17 +18,24 @@ import (
 	"errors"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/protogalaxy/service-socket/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/protogalaxy/service-socket/auth"
 	"github.com/protogalaxy/service-socket/devicepresence"
+	"github.com/protogalaxy/service-socket/downstream"
+	"github.com/protogalaxy/service-socket/presence"
 	"github.com/protogalaxy/service-socket/socket"
 )
 
 type ConnMock struct {
-	OnRequest     func() *http.Request
-	OnReadMessage func() ([]byte, error)
-	OnWrite       func([]byte) (int, error)
+	OnRequest         func() *http.Request
+	OnReadMessage     func() ([]byte, error)
+	OnCloseWithStatus func(int, string) error
+	OnWrite           func([]byte) (int, error)
+	OnWriteBinary     func([]byte) (int, error)
+	OnClose           func() error
 }
 
 func (m *ConnMock) Request() *http.Request {
@@ -39,22 +46,52 @@ func (m *ConnMock) ReadMessage() ([]byte, error) {
 	return m.OnReadMessage()
 }
 
+func (m *ConnMock) CloseWithStatus(status int, reason string) error {
+	return m.OnCloseWithStatus(status, reason)
+}
+
 func (m *ConnMock) Write(p []byte) (int, error) {
 	return m.OnWrite(p)
 }
 
+func (m *ConnMock) WriteBinary(p []byte) (int, error) {
+	return m.OnWriteBinary(p)
+}
+
+func (m *ConnMock) Close() error {
+	return m.OnClose()
+}
+
+type AuthenticatorMock struct {
+	OnAuthenticate func(ctx context.Context, token string) (string, error)
+}
+
+func (m *AuthenticatorMock) Authenticate(ctx context.Context, token string) (string, error) {
+	return m.OnAuthenticate(ctx, token)
+}
+
+func authRequest() *http.Request {
+	req, _ := http.NewRequest("GET", "", nil)
+	req.AddCookie(&http.Cookie{
+		Name:  "auth",
+		Value: "token1",
+	})
+	return req
+}
+
 func TestStatesAuthenticateUser(t *testing.T) {
 	s := &States{
-		Conn: &ConnMock{
-			OnRequest: func() *http.Request {
-				req, _ := http.NewRequest("GET", "", nil)
-				req.AddCookie(&http.Cookie{
-					Name:  "auth",
-					Value: "user1",
-				})
-				return req
+		Authenticator: &AuthenticatorMock{
+			OnAuthenticate: func(ctx context.Context, token string) (string, error) {
+				if token != "token1" {
+					t.Errorf("Unexpected token: %s", token)
+				}
+				return "user1", nil
 			},
 		},
+		Conn: &ConnMock{
+			OnRequest: authRequest,
+		},
 	}
 	next := s.authenticateUser()
 	if next != &RegisterSocket {
@@ -66,46 +103,142 @@ func TestStatesAuthenticateUser(t *testing.T) {
 }
 
 func TestStatesAuthenticateUserMissingCookie(t *testing.T) {
+	var status int
 	s := &States{
 		Conn: &ConnMock{
 			OnRequest: func() *http.Request {
 				req, _ := http.NewRequest("GET", "", nil)
 				return req
 			},
+			OnCloseWithStatus: func(st int, reason string) error {
+				status = st
+				return nil
+			},
 		},
 	}
 	next := s.authenticateUser()
 	if next != nil {
 		t.Errorf("Invalid next state")
 	}
+	if status != CloseUnauthorized {
+		t.Errorf("Unexpected close status: %d", status)
+	}
+}
+
+func TestStatesAuthenticateUserInvalidToken(t *testing.T) {
+	var status int
+	s := &States{
+		Authenticator: &AuthenticatorMock{
+			OnAuthenticate: func(ctx context.Context, token string) (string, error) {
+				return "", auth.ErrInvalidToken
+			},
+		},
+		Conn: &ConnMock{
+			OnRequest: authRequest,
+			OnCloseWithStatus: func(st int, reason string) error {
+				status = st
+				return nil
+			},
+		},
+	}
+	next := s.authenticateUser()
+	if next != nil {
+		t.Errorf("Invalid next state")
+	}
+	if status != CloseUnauthorized {
+		t.Errorf("Unexpected close status: %d", status)
+	}
+}
+
+func TestStatesAuthenticateUserError(t *testing.T) {
+	var status int
+	s := &States{
+		Authenticator: &AuthenticatorMock{
+			OnAuthenticate: func(ctx context.Context, token string) (string, error) {
+				return "", errors.New("error")
+			},
+		},
+		Conn: &ConnMock{
+			OnRequest: authRequest,
+			OnCloseWithStatus: func(st int, reason string) error {
+				status = st
+				return nil
+			},
+		},
+	}
+	next := s.authenticateUser()
+	if next != nil {
+		t.Errorf("Invalid next state")
+	}
+	if status != CloseTryAgainLater {
+		t.Errorf("Unexpected close status: %d", status)
+	}
 }
 
 type RegistryMock struct {
-	OnMessages   func() chan<- socket.Message
-	OnRegister   func(messages chan<- []byte) (socket.ID, error)
-	OnUnregister func(socketID socket.ID)
+	OnMessages       func() chan<- socket.Message
+	OnSocketMessages func(socketID socket.ID) chan<- socket.Message
+	OnMulticasts     func() chan<- socket.Multicast
+	OnRegister       func(messages chan []byte) (socket.ID, error)
+	OnRegisterUser   func(userID string, messages chan []byte) (socket.ID, error)
+	OnRegisterSocket func(s socket.Socket) (socket.ID, error)
+	OnUnregister     func(socketID socket.ID)
+	OnSubscribe      func(socketID socket.ID, topic string) error
+	OnUnsubscribe    func(socketID socket.ID, topic string) error
 }
 
 func (m *RegistryMock) Messages() chan<- socket.Message {
 	return m.OnMessages()
 }
 
-func (m *RegistryMock) Register(messages chan<- []byte) (socket.ID, error) {
+func (m *RegistryMock) SocketMessages(socketID socket.ID) chan<- socket.Message {
+	return m.OnSocketMessages(socketID)
+}
+
+func (m *RegistryMock) Multicasts() chan<- socket.Multicast {
+	return m.OnMulticasts()
+}
+
+func (m *RegistryMock) Register(messages chan []byte) (socket.ID, error) {
 	return m.OnRegister(messages)
 }
 
+func (m *RegistryMock) RegisterUser(userID string, messages chan []byte) (socket.ID, error) {
+	return m.OnRegisterUser(userID, messages)
+}
+
+func (m *RegistryMock) RegisterSocket(s socket.Socket) (socket.ID, error) {
+	return m.OnRegisterSocket(s)
+}
+
 func (m *RegistryMock) Unregister(socketID socket.ID) {
 	m.OnUnregister(socketID)
 }
 
+func (m *RegistryMock) Subscribe(socketID socket.ID, topic string) error {
+	return m.OnSubscribe(socketID, topic)
+}
+
+func (m *RegistryMock) Unsubscribe(socketID socket.ID, topic string) error {
+	return m.OnUnsubscribe(socketID, topic)
+}
+
 func TestStatesRegisterSocket(t *testing.T) {
 	s := &States{
 		Registry: &RegistryMock{
-			OnRegister: func(msgs chan<- []byte) (socket.ID, error) {
+			OnRegisterSocket: func(s socket.Socket) (socket.ID, error) {
+				if s.UserID != "user1" {
+					t.Errorf("Unexpected user id: %s", s.UserID)
+				}
+				if s.Overflow.Action != socket.DropOldest {
+					t.Errorf("Unexpected overflow policy: %v", s.Overflow)
+				}
 				return 123, nil
 			},
 		},
+		Overflow: socket.OverflowPolicy{Action: socket.DropOldest},
 	}
+	s.userID = "user1"
 	next := s.registerSocket()
 	if next != &SetDeviceStatus {
 		t.Errorf("Invalid next state")
@@ -118,7 +251,7 @@ func TestStatesRegisterSocket(t *testing.T) {
 func TestStatesRegisterSocketError(t *testing.T) {
 	s := &States{
 		Registry: &RegistryMock{
-			OnRegister: func(msgs chan<- []byte) (socket.ID, error) {
+			OnRegisterSocket: func(s socket.Socket) (socket.ID, error) {
 				return 0, errors.New("error")
 			},
 		},
@@ -129,14 +262,43 @@ func TestStatesRegisterSocketError(t *testing.T) {
 	}
 }
 
+func TestStatesDisconnectSlow(t *testing.T) {
+	closed := make(chan int, 1)
+	s := &States{
+		Conn: &ConnMock{
+			OnCloseWithStatus: func(st int, reason string) error {
+				closed <- st
+				return nil
+			},
+			OnClose: func() error {
+				return nil
+			},
+		},
+	}
+	s.disconnectSlow(0)
+	select {
+	case st := <-closed:
+		if st != CloseSlowConsumer {
+			t.Errorf("Expecting slow consumer close status but got: %d", st)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Slow connection not closed")
+	}
+}
+
 type DevicePresenceMock struct {
-	OnSetStatus func(context.Context, *devicepresence.StatusRequest) (*devicepresence.StatusReply, error)
+	OnSetStatus   func(context.Context, *devicepresence.StatusRequest) (*devicepresence.StatusReply, error)
+	OnRenewLeases func(context.Context, *devicepresence.LeaseRequest) (*devicepresence.LeaseReply, error)
 }
 
 func (m *DevicePresenceMock) SetStatus(ctx context.Context, req *devicepresence.StatusRequest, opts ...grpc.CallOption) (*devicepresence.StatusReply, error) {
 	return m.OnSetStatus(ctx, req)
 }
 
+func (m *DevicePresenceMock) RenewLeases(ctx context.Context, req *devicepresence.LeaseRequest, opts ...grpc.CallOption) (*devicepresence.LeaseReply, error) {
+	return m.OnRenewLeases(ctx, req)
+}
+
 func TestStatesSetDeviceStatus(t *testing.T) {
 	s := &States{
 		DevicePresence: &DevicePresenceMock{
@@ -176,7 +338,153 @@ func TestStatesSetDeviceStatusError(t *testing.T) {
 	}
 	next := s.setDeviceStatus()
 
+	if next != &Disconnect {
+		t.Errorf("Invalid next state")
+	}
+}
+
+func TestStatesDisconnect(t *testing.T) {
+	var unregistered socket.ID
+	s := &States{
+		Registry: &RegistryMock{
+			OnUnregister: func(socketID socket.ID) {
+				unregistered = socketID
+			},
+		},
+		DevicePresence: &DevicePresenceMock{
+			OnSetStatus: func(ctx context.Context, req *devicepresence.StatusRequest) (*devicepresence.StatusReply, error) {
+				if unregistered != 9 {
+					t.Errorf("Socket should be unregistered before setting the status")
+				}
+				expected := devicepresence.Device{
+					Id:     "9",
+					Type:   devicepresence.Device_WS,
+					UserId: "13",
+					Status: devicepresence.Device_OFFLINE,
+				}
+				if expected != *req.Device {
+					t.Errorf("Unexpected device: %#v != %#v", expected, req.Device)
+				}
+				if _, ok := ctx.Deadline(); !ok {
+					t.Errorf("Setting the status should have a deadline")
+				}
+				return &devicepresence.StatusReply{}, nil
+			},
+		},
+	}
+	s.socketID = 9
+	s.userID = "13"
+	next := s.disconnect()
+
 	if next != nil {
 		t.Errorf("Invalid next state")
 	}
 }
+
+func TestStatesDisconnectRetry(t *testing.T) {
+	var calls int
+	s := &States{
+		Policies: Policies{
+			Presence: &downstream.Policy{Attempts: 3},
+		},
+		Registry: &RegistryMock{
+			OnUnregister: func(socketID socket.ID) {},
+		},
+		DevicePresence: &DevicePresenceMock{
+			OnSetStatus: func(ctx context.Context, req *devicepresence.StatusRequest) (*devicepresence.StatusReply, error) {
+				calls++
+				return nil, errors.New("error")
+			},
+		},
+	}
+	next := s.disconnect()
+
+	if next != nil {
+		t.Errorf("Invalid next state")
+	}
+	if calls != 3 {
+		t.Errorf("Expecting 3 attempts but got %d", calls)
+	}
+}
+
+func TestStatesHandleMessagesWriteError(t *testing.T) {
+	closed := make(chan struct{})
+	msgs := make(chan []byte, 1)
+	s := &States{
+		Conn: &ConnMock{
+			OnReadMessage: func() ([]byte, error) {
+				<-closed
+				return nil, errors.New("closed")
+			},
+			OnWrite: func(p []byte) (int, error) {
+				return 0, errors.New("error")
+			},
+			OnClose: func() error {
+				close(closed)
+				return nil
+			},
+		},
+		Messages: msgs,
+	}
+	msgs <- []byte("abc")
+
+	next := make(chan *StateFunc)
+	go func() {
+		next <- s.handleMessages()
+	}()
+	select {
+	case n := <-next:
+		if n != &Disconnect {
+			t.Errorf("Invalid next state")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Write error should end message handling")
+	}
+}
+
+func TestStatesDeviceLease(t *testing.T) {
+	fake := presence.NewFakeServer()
+	leases := presence.NewLeaseRenewer(fake.Client(), "gw1", 10*time.Second)
+	s := &States{
+		Registry: &RegistryMock{
+			OnUnregister: func(socketID socket.ID) {},
+		},
+		DevicePresence: fake.Client(),
+		Leases:         leases,
+		GatewayID:      "gw1",
+	}
+	s.socketID = 9
+	s.userID = "13"
+
+	if next := s.setDeviceStatus(); next != &HandleMessages {
+		t.Errorf("Invalid next state")
+	}
+	if _, ok := fake.Device("9"); !ok {
+		t.Error("Device should be online")
+	}
+	if next := s.disconnect(); next != nil {
+		t.Errorf("Invalid next state")
+	}
+	if _, ok := fake.Device("9"); ok {
+		t.Error("Device should be offline")
+	}
+}
+
+func TestRunRecordsStateDuration(t *testing.T) {
+	before := stateDuration.With("authenticate_user").Count()
+	s := &States{
+		Conn: &ConnMock{
+			OnRequest: func() *http.Request {
+				req, _ := http.NewRequest("GET", "", nil)
+				return req
+			},
+			OnCloseWithStatus: func(status int, reason string) error {
+				return nil
+			},
+		},
+	}
+	Run(s)
+	if after := stateDuration.With("authenticate_user").Count(); after != before+1 {
+		t.Errorf("Expected one observation of the authenticate state but got %d", after-before)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultMaxSubscriptions is the default number of topics a client can
+// subscribe to with control frames.
+const DefaultMaxSubscriptions = 32
+
+// UserPlaceholder is replaced in the topic patterns with the id of the user
+// subscribing to the topic.
+const UserPlaceholder = "{user}"
+
+// TopicAllowlist decides which topics the clients may subscribe to with
+// control frames. A pattern ending with "*" matches every topic starting with
+// the rest of the pattern, any other pattern matches a single topic. The
+// UserPlaceholder limits a pattern to the topics of the subscribing user,
+// e.g. "user:{user}:*".
+type TopicAllowlist struct {
+	patterns []string
+}
+
+// ParseTopicAllowlist parses the allowed topic patterns.
+func ParseTopicAllowlist(patterns []string) (*TopicAllowlist, error) {
+	a := &TopicAllowlist{}
+	for _, p := range patterns {
+		if p == "" || strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+			return nil, fmt.Errorf("invalid topic pattern %q", p)
+		}
+		a.patterns = append(a.patterns, p)
+	}
+	return a, nil
+}
+
+// Allowed reports whether the user may subscribe to the topic. No topics are
+// allowed by an empty or nil allowlist.
+func (a *TopicAllowlist) Allowed(userID, topic string) bool {
+	if a == nil || topic == "" {
+		return false
+	}
+	for _, p := range a.patterns {
+		p = strings.Replace(p, UserPlaceholder, userID, -1)
+		if prefix := strings.TrimSuffix(p, "*"); prefix != p {
+			if strings.HasPrefix(topic, prefix) {
+				return true
+			}
+		} else if topic == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2015 The Protogalaxy Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package websocket
+
+import "testing"
+
+func TestTopicAllowlist(t *testing.T) {
+	a, err := ParseTopicAllowlist([]string{"lobby", "match:*", "user:{user}:*"})
+	if err != nil {
+		t.Fatalf("Parsing topic allowlist should not fail but got: %s", err)
+	}
+	tests := []struct {
+		user, topic string
+		allowed     bool
+	}{
+		{"u1", "lobby", true},
+		{"u1", "lobby:1", false},
+		{"u1", "match:abc", true},
+		{"u1", "match", false},
+		{"u1", "user:u1:inbox", true},
+		{"u1", "user:u2:inbox", false},
+		{"u1", "", false},
+	}
+	for _, test := range tests {
+		if a.Allowed(test.user, test.topic) != test.allowed {
+			t.Errorf("Expected topic %q allowed for %s to be %t", test.topic, test.user, test.allowed)
+		}
+	}
+	var empty *TopicAllowlist
+	if empty.Allowed("u1", "lobby") {
+		t.Error("Empty allowlist should not allow any topic")
+	}
+}
+
+func TestParseTopicAllowlistInvalid(t *testing.T) {
+	for _, p := range []string{"", "a*b", "*:*"} {
+		if _, err := ParseTopicAllowlist([]string{p}); err == nil {
+			t.Errorf("Expected pattern %q to be rejected", p)
+		}
+	}
+}